@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+const ackTopicName = "gossipsub-acks"
+
+// AdaptiveConfig replaces the publishers' schedule with a closed loop for
+// Duration: every receiver acknowledges the messages it gets on an ack
+// topic, in batches every AckInterval (default 100ms), and every Window
+// (default 1s) a publisher looks at the messages it sent in the window
+// before the last one. If their p95 latency exceeded TargetLatency (default
+// 200ms) or less than TargetCoverage (default 0.99) of Receivers acked them,
+// the rate is multiplied by Decrease (default 0.5), otherwise it grows by
+// Increase (default 1) messages per second, between MinRate (default 1) and
+// MaxRate (default 1000), starting at InitialRate (default 10). Receivers
+// defaults to the number of nodes that have acked anything so far. Rates
+// are per publisher and topic.
+type AdaptiveConfig struct {
+	Duration       duration `json:"duration"`
+	InitialRate    float64  `json:"initialRate"`
+	MinRate        float64  `json:"minRate"`
+	MaxRate        float64  `json:"maxRate"`
+	TargetLatency  duration `json:"targetLatency"`
+	TargetCoverage float64  `json:"targetCoverage"`
+	Receivers      int      `json:"receivers"`
+	Window         duration `json:"window"`
+	Increase       float64  `json:"increase"`
+	Decrease       float64  `json:"decrease"`
+	AckInterval    duration `json:"ackInterval"`
+}
+
+func (a *AdaptiveConfig) validate() error {
+	if a.Duration <= 0 {
+		return fmt.Errorf("workload adaptive: duration must be positive")
+	}
+	if a.InitialRate < 0 || a.MinRate < 0 || a.MaxRate < 0 || a.Increase < 0 {
+		return fmt.Errorf("workload adaptive: rates must not be negative")
+	}
+	if d := a.withDefaults(); d.MinRate > d.MaxRate {
+		return fmt.Errorf("workload adaptive: minRate %g exceeds maxRate %g", d.MinRate, d.MaxRate)
+	}
+	if a.Decrease < 0 || a.Decrease >= 1 {
+		return fmt.Errorf("workload adaptive: decrease must be in [0, 1)")
+	}
+	if a.TargetCoverage < 0 || a.TargetCoverage > 1 {
+		return fmt.Errorf("workload adaptive: targetCoverage must be in [0, 1]")
+	}
+	if a.TargetLatency < 0 || a.Window < 0 || a.AckInterval < 0 {
+		return fmt.Errorf("workload adaptive: durations must not be negative")
+	}
+	return nil
+}
+
+func (a AdaptiveConfig) withDefaults() AdaptiveConfig {
+	if a.InitialRate == 0 {
+		a.InitialRate = 10
+	}
+	if a.MinRate == 0 {
+		a.MinRate = 1
+	}
+	if a.MaxRate == 0 {
+		a.MaxRate = 1000
+	}
+	if a.TargetLatency == 0 {
+		a.TargetLatency = duration(200 * time.Millisecond)
+	}
+	if a.TargetCoverage == 0 {
+		a.TargetCoverage = 0.99
+	}
+	if a.Window == 0 {
+		a.Window = duration(time.Second)
+	}
+	if a.Increase == 0 {
+		a.Increase = 1
+	}
+	if a.Decrease == 0 {
+		a.Decrease = 0.5
+	}
+	if a.AckInterval == 0 {
+		a.AckInterval = duration(100 * time.Millisecond)
+	}
+	return a
+}
+
+type ackEntry struct {
+	Publisher  int    `json:"publisher"`
+	Topic      string `json:"topic"`
+	Seq        uint64 `json:"seq"`
+	ReceivedAt int64  `json:"receivedAt"`
+}
+
+type ackBatch struct {
+	Node int        `json:"node"`
+	Acks []ackEntry `json:"acks"`
+}
+
+// acker batches a receiver's first deliveries into acks on the ack topic.
+type acker struct {
+	topic *pubsub.Topic
+	node  int
+
+	mu      sync.Mutex
+	pending []ackEntry
+}
+
+func newAcker(topic *pubsub.Topic, nodeNum int) *acker {
+	return &acker{topic: topic, node: nodeNum}
+}
+
+func (a *acker) add(hdr msgHeader, topic string, receivedAt time.Time) {
+	if a == nil || hdr.Publisher == a.node {
+		return
+	}
+	a.mu.Lock()
+	a.pending = append(a.pending, ackEntry{Publisher: hdr.Publisher, Topic: topic, Seq: hdr.Seq, ReceivedAt: receivedAt.UnixNano()})
+	a.mu.Unlock()
+}
+
+func (a *acker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		a.mu.Lock()
+		batch := ackBatch{Node: a.node, Acks: a.pending}
+		a.pending = nil
+		a.mu.Unlock()
+		if len(batch.Acks) == 0 {
+			continue
+		}
+		data, err := json.Marshal(batch)
+		if err != nil {
+			continue
+		}
+		if err := publish(ctx, a.topic, data); err != nil {
+			workloadLog.Warnf("Error publishing %d acks: %v", len(batch.Acks), err)
+			continue
+		}
+		stats.inc("acks_sent_total", float64(len(batch.Acks)))
+	}
+}
+
+// adaptiveStep is one rate decision of an adaptive publisher.
+type adaptiveStep struct {
+	At       int64   `json:"at"`
+	Rate     float64 `json:"rate"`
+	Messages int     `json:"messages"`
+	Coverage float64 `json:"coverage"`
+	P95Ms    float64 `json:"p95Ms"`
+	// Decreased is set if the window missed a target.
+	Decreased bool `json:"decreased,omitempty"`
+}
+
+type ackKey struct {
+	topic string
+	seq   uint64
+}
+
+// adaptiveController collects the acks for one publisher's messages and
+// decides its rate.
+type adaptiveController struct {
+	cfg  AdaptiveConfig
+	node int
+
+	mu        sync.Mutex
+	sent      map[ackKey]time.Time
+	latencies map[ackKey][]float64
+	receivers map[int]bool
+	evaluated time.Time
+	steps     []adaptiveStep
+}
+
+func newAdaptiveController(cfg AdaptiveConfig, nodeNum int) *adaptiveController {
+	return &adaptiveController{
+		cfg:       cfg,
+		node:      nodeNum,
+		sent:      make(map[ackKey]time.Time),
+		latencies: make(map[ackKey][]float64),
+		receivers: make(map[int]bool),
+		evaluated: time.Now(),
+	}
+}
+
+// watch reads the ack topic, keeping the acks for this publisher.
+func (c *adaptiveController) watch(ctx context.Context, sub *pubsub.Subscription) {
+	for {
+		msg, err := next(ctx, sub)
+		if err != nil {
+			return
+		}
+		var b ackBatch
+		if err := json.Unmarshal(msg.Data, &b); err != nil {
+			continue
+		}
+		c.mu.Lock()
+		for _, a := range b.Acks {
+			if a.Publisher != c.node {
+				continue
+			}
+			c.receivers[b.Node] = true
+			k := ackKey{a.Topic, a.Seq}
+			if sentAt, ok := c.sent[k]; ok {
+				c.latencies[k] = append(c.latencies[k], float64(a.ReceivedAt-sentAt.UnixNano())/1e6)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *adaptiveController) published(topic string, seq uint64, at time.Time) {
+	c.mu.Lock()
+	c.sent[ackKey{topic, seq}] = at
+	c.mu.Unlock()
+}
+
+// adjust evaluates the messages sent between the last evaluation and one
+// window ago and returns the new rate.
+func (c *adaptiveController) adjust(rate float64, now time.Time) float64 {
+	cutoff := now.Add(-time.Duration(c.cfg.Window))
+	c.mu.Lock()
+	var messages, acks int
+	var latencies []float64
+	for k, at := range c.sent {
+		if at.Before(c.evaluated) || !at.Before(cutoff) {
+			continue
+		}
+		messages++
+		acks += len(c.latencies[k])
+		latencies = append(latencies, c.latencies[k]...)
+		delete(c.sent, k)
+		delete(c.latencies, k)
+	}
+	receivers := c.cfg.Receivers
+	if receivers == 0 {
+		receivers = len(c.receivers)
+	}
+	c.evaluated = cutoff
+	c.mu.Unlock()
+	if messages == 0 {
+		return rate
+	}
+
+	coverage := 0.0
+	if receivers > 0 {
+		coverage = math.Min(float64(acks)/float64(messages*receivers), 1)
+	}
+	sort.Float64s(latencies)
+	p95 := percentile(latencies, 95)
+	step := adaptiveStep{At: now.UnixNano(), Messages: messages, Coverage: coverage, P95Ms: p95}
+	if p95 > float64(time.Duration(c.cfg.TargetLatency))/1e6 || coverage < c.cfg.TargetCoverage {
+		rate = math.Max(rate*c.cfg.Decrease, c.cfg.MinRate)
+		step.Decreased = true
+	} else {
+		rate = math.Min(rate+c.cfg.Increase, c.cfg.MaxRate)
+	}
+	step.Rate = rate
+
+	c.mu.Lock()
+	c.steps = append(c.steps, step)
+	c.mu.Unlock()
+	stats.set("workload_target_rate", rate)
+	stats.set("adaptive_coverage", coverage)
+	stats.set("adaptive_latency_p95_seconds", p95/1e3)
+	if step.Decreased {
+		emitEvent("adaptive_rate_decreased", map[string]interface{}{"rate": rate, "coverage": coverage, "p95Ms": p95})
+	}
+	workloadLog.Infof("Node %d adaptive rate %.2f msg/s after %d messages coverage=%.2f%% p95=%.1fms",
+		c.node, rate, messages, coverage*100, p95)
+	return rate
+}
+
+func (c *adaptiveController) records() []adaptiveStep {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]adaptiveStep(nil), c.steps...)
+}
+
+// runAdaptivePublisher publishes to every target at the controlled rate
+// until Duration has passed and returns what it sent.
+func runAdaptivePublisher(ctx context.Context, targets func(seq uint64) []*pubsub.Topic, nodeNum int, w WorkloadConfig, start time.Time, rec *recorder) []sentMessage {
+	a := w.Adaptive.withDefaults()
+	payloads, err := w.payloads(nodeNum)
+	if err != nil {
+		exit(configError(err))
+	}
+	c := rec.adaptive
+	end := start.Add(time.Duration(a.Duration))
+	rate := a.InitialRate
+	stats.set("workload_target_rate", rate)
+	next, adjusted := start, start
+	var sent []sentMessage
+	for seq := uint64(1); next.Before(end); seq++ {
+		time.Sleep(time.Until(next))
+		for _, topic := range targets(seq) {
+			m, ok := publishMessage(ctx, topic, nodeNum, seq, payloads, rec)
+			if !ok {
+				continue
+			}
+			c.published(topic.String(), seq, m.at)
+			if w.Republish != nil {
+				sent = append(sent, m)
+			}
+		}
+		if now := time.Now(); now.Sub(adjusted) >= time.Duration(a.Window) {
+			rate = c.adjust(rate, now)
+			adjusted = now
+		}
+		next = next.Add(time.Duration(float64(time.Second) / rate))
+	}
+	return sent
+}
+
+// adaptiveSummary is one adaptive publisher's rate over the run.
+type adaptiveSummary struct {
+	Node        int     `json:"node"`
+	Windows     int     `json:"windows"`
+	Decreases   int     `json:"decreases"`
+	MeanRate    float64 `json:"meanRate"`
+	MinRate     float64 `json:"minRate"`
+	MaxRate     float64 `json:"maxRate"`
+	FinalRate   float64 `json:"finalRate"`
+	MeanP95Ms   float64 `json:"meanP95Ms"`
+	MinCoverage float64 `json:"minCoverage"`
+}
+
+func analyzeAdaptive(reports []nodeReport) []adaptiveSummary {
+	var out []adaptiveSummary
+	for _, rep := range reports {
+		if len(rep.Adaptive) == 0 {
+			continue
+		}
+		s := adaptiveSummary{Node: rep.Node, Windows: len(rep.Adaptive), MinRate: math.Inf(1), MinCoverage: 1}
+		for _, st := range rep.Adaptive {
+			if st.Decreased {
+				s.Decreases++
+			}
+			s.MeanRate += st.Rate
+			s.MeanP95Ms += st.P95Ms
+			s.MinRate = math.Min(s.MinRate, st.Rate)
+			s.MaxRate = math.Max(s.MaxRate, st.Rate)
+			s.MinCoverage = math.Min(s.MinCoverage, st.Coverage)
+		}
+		s.MeanRate /= float64(s.Windows)
+		s.MeanP95Ms /= float64(s.Windows)
+		s.FinalRate = rep.Adaptive[len(rep.Adaptive)-1].Rate
+		out = append(out, s)
+	}
+	return out
+}
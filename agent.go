@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	lpevent "github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const agentProduct = "gossipsub-testbed"
+
+// peerAgent is what a node announces about itself in its identify agent
+// version, e.g. "gossipsub-testbed (node=3; role=publisher; experiment=x)",
+// so that external libp2p tools show which process a peer is.
+type peerAgent struct {
+	Node       int    `json:"node"`
+	Role       string `json:"role"`
+	Experiment string `json:"experiment,omitempty"`
+}
+
+// newPeerAgent replaces the characters that would end the experiment's
+// field in the agent version, so that the experiment peers parse from it
+// is the one a node compares theirs with.
+func newPeerAgent(nodeNum int, role, experiment string) peerAgent {
+	return peerAgent{
+		Node:       nodeNum,
+		Role:       role,
+		Experiment: strings.NewReplacer(";", "_", ")", "_").Replace(experiment),
+	}
+}
+
+func (a peerAgent) String() string {
+	s := fmt.Sprintf("%s (node=%d; role=%s", agentProduct, a.Node, a.Role)
+	if a.Experiment != "" {
+		s += "; experiment=" + a.Experiment
+	}
+	return s + ")"
+}
+
+// parseAgent reads the metadata of another node from its agent version.
+func parseAgent(s string) (peerAgent, bool) {
+	fields, ok := strings.CutPrefix(s, agentProduct+" (")
+	if !ok || !strings.HasSuffix(fields, ")") {
+		return peerAgent{}, false
+	}
+	a := peerAgent{Node: -1}
+	for _, f := range strings.Split(strings.TrimSuffix(fields, ")"), "; ") {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "node":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return peerAgent{}, false
+			}
+			a.Node = n
+		case "role":
+			a.Role = v
+		case "experiment":
+			a.Experiment = v
+		}
+	}
+	return a, a.Node >= 0
+}
+
+// nodeRole is the role a node announces: what it does in the workload.
+func nodeRole(cfg *Config, nodeNum int, publisher bool) string {
+	switch role := cfg.roleOf(nodeNum); {
+	case cfg.Misbehavior.applies(nodeNum):
+		return "adversary"
+	case role != "":
+		return role
+	case publisher:
+		return "publisher"
+	}
+	return "subscriber"
+}
+
+// peerAgentOf returns what the peerstore knows of p's agent version.
+func peerAgentOf(h host.Host, p peer.ID) (agent string, meta peerAgent, ok bool) {
+	v, err := h.Peerstore().Get(p, "AgentVersion")
+	if err != nil {
+		return "", peerAgent{}, false
+	}
+	agent, _ = v.(string)
+	meta, ok = parseAgent(agent)
+	return agent, meta, ok
+}
+
+// watchAgents logs the node behind every identified peer and warns about
+// peers of another experiment.
+func watchAgents(h host.Host, self peerAgent) error {
+	sub, err := h.EventBus().Subscribe(new(lpevent.EvtPeerIdentificationCompleted))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for e := range sub.Out() {
+			evt := e.(lpevent.EvtPeerIdentificationCompleted)
+			a, ok := parseAgent(evt.AgentVersion)
+			if !ok {
+				transportLog.Infof("Node %d identified %s, agent %q", self.Node, evt.Peer, evt.AgentVersion)
+				continue
+			}
+			transportLog.Infof("Node %d identified %s as node %d (%s)", self.Node, evt.Peer, a.Node, a.Role)
+			if a.Experiment != self.Experiment {
+				emitEvent("foreign_experiment", map[string]interface{}{"peer": evt.Peer.String(), "node": a.Node, "experiment": a.Experiment})
+				transportLog.Warnf("Peer %s (node %d) belongs to experiment %q, not %q", evt.Peer, a.Node, a.Experiment, self.Experiment)
+			}
+		}
+	}()
+	return nil
+}
+
+// peerListing is a connected peer in GET /peers; Node is -1 for peers that
+// are not nodes of this testbed.
+type peerListing struct {
+	Peer       string   `json:"peer"`
+	Addrs      []string `json:"addrs"`
+	Agent      string   `json:"agent,omitempty"`
+	Node       int      `json:"node"`
+	Role       string   `json:"role,omitempty"`
+	Experiment string   `json:"experiment,omitempty"`
+}
+
+// listPeers lists the connected peers by node number.
+func listPeers(h host.Host) []peerListing {
+	var out []peerListing
+	for _, p := range h.Network().Peers() {
+		l := peerListing{Peer: p.String(), Node: -1}
+		for _, c := range h.Network().ConnsToPeer(p) {
+			l.Addrs = append(l.Addrs, c.RemoteMultiaddr().String())
+		}
+		var meta peerAgent
+		var ok bool
+		if l.Agent, meta, ok = peerAgentOf(h, p); ok {
+			l.Node, l.Role, l.Experiment = meta.Node, meta.Role, meta.Experiment
+		}
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Node != out[j].Node {
+			return out[i].Node < out[j].Node
+		}
+		return out[i].Peer < out[j].Peer
+	})
+	return out
+}
@@ -80,6 +80,7 @@ def main():
         return
 
     stretches = []
+    received = 0
     for log in logs:
         node = int(re.search(r"node(\d+)\.log", log).group(1))
         if node == source_node:
@@ -88,6 +89,7 @@ def main():
         if not receive_time:
             print(f"Node {node} did not receive the message")
             continue
+        received += 1
         try:
             ping = pings[source_node][node]
         except KeyError:
@@ -97,6 +99,8 @@ def main():
         stretches.append(stretch)
         print(f"Node {node}: stretch={stretch:.2f} (delay={((receive_time - source_publish_time).total_seconds()*1000):.2f} ms, ping={ping} ms)")
 
+    print(f"\nDelivery: {received}/{len(logs) - 1} nodes received the message")
+
     if stretches:
         avg_stretch = sum(stretches) / len(stretches)
         print(f"\nAverage stretch: {avg_stretch:.2f}")
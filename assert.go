@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// assertion is one pass/fail condition on a run, either a minimum delivery
+// coverage in percent or a maximum latency (p50, p90, p99 or max) in ms.
+type assertion struct {
+	name  string
+	limit float64
+}
+
+type assertionResult struct {
+	Assertion string `json:"assertion"`
+	Actual    string `json:"actual"`
+	Passed    bool   `json:"passed"`
+}
+
+// parseAssertions parses a comma-separated list such as
+// "coverage=99.5,p99=800ms". Latency limits are durations or plain
+// milliseconds.
+func parseAssertions(spec string) ([]assertion, error) {
+	var out []assertion
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("assertion %q: expected key=value", part)
+		}
+		a := assertion{name: key}
+		switch key {
+		case "coverage":
+			v, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("assertion %q: %v", part, err)
+			}
+			a.limit = v
+		case "p50", "p90", "p99", "max":
+			ms, err := parseMillis(value)
+			if err != nil {
+				return nil, fmt.Errorf("assertion %q: %v", part, err)
+			}
+			a.limit = ms
+		default:
+			return nil, fmt.Errorf("assertion %q: unknown key %s", part, key)
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+func parseMillis(s string) (float64, error) {
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return float64(d) / float64(time.Millisecond), nil
+}
+
+func (a assertion) check(d deliverySummary) assertionResult {
+	if a.name == "coverage" {
+		actual := d.Coverage * 100
+		return assertionResult{
+			Assertion: fmt.Sprintf("coverage >= %g%%", a.limit),
+			Actual:    fmt.Sprintf("%.2f%%", actual),
+			Passed:    d.Expected > 0 && actual >= a.limit,
+		}
+	}
+	actual := d.latency(a.name)
+	return assertionResult{
+		Assertion: fmt.Sprintf("%s <= %gms", a.name, a.limit),
+		Actual:    fmt.Sprintf("%.1fms", actual),
+		Passed:    d.Delivered > 0 && actual <= a.limit,
+	}
+}
+
+// latency returns the p50, p90, p99 or max latency in ms.
+func (d deliverySummary) latency(name string) float64 {
+	switch name {
+	case "p50":
+		return d.P50Ms
+	case "p90":
+		return d.P90Ms
+	case "p99":
+		return d.P99Ms
+	case "max":
+		return d.MaxMs
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestParseAssertions(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []assertion
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "coverage=99.5", want: []assertion{{"coverage", 99.5}}},
+		{spec: "coverage=99%, p99=800ms", want: []assertion{{"coverage", 99}, {"p99", 800}}},
+		{spec: "p50=1.5s,max=250", want: []assertion{{"p50", 1500}, {"max", 250}}},
+		{spec: "coverage", wantErr: true},
+		{spec: "coverage=all", wantErr: true},
+		{spec: "p90=fast", wantErr: true},
+		{spec: "p95=100ms", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAssertions(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAssertions(%q): error %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseAssertions(%q) = %v, want %v", tt.spec, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseAssertions(%q) = %v, want %v", tt.spec, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestAssertionCheck(t *testing.T) {
+	d := deliverySummary{Expected: 100, Delivered: 99, Coverage: 0.99, P50Ms: 10, P90Ms: 40, P99Ms: 120, MaxMs: 300}
+	tests := []struct {
+		a      assertion
+		d      deliverySummary
+		actual string
+		passed bool
+	}{
+		{assertion{"coverage", 99}, d, "99.00%", true},
+		{assertion{"coverage", 99.5}, d, "99.00%", false},
+		{assertion{"coverage", 0}, deliverySummary{}, "0.00%", false},
+		{assertion{"p50", 10}, d, "10.0ms", true},
+		{assertion{"p90", 30}, d, "40.0ms", false},
+		{assertion{"p99", 200}, d, "120.0ms", true},
+		{assertion{"max", 250}, d, "300.0ms", false},
+		{assertion{"max", 1000}, deliverySummary{Expected: 10}, "0.0ms", false},
+	}
+	for _, tt := range tests {
+		r := tt.a.check(tt.d)
+		if r.Actual != tt.actual || r.Passed != tt.passed {
+			t.Errorf("%s: got actual %s passed %v, want actual %s passed %v",
+				r.Assertion, r.Actual, r.Passed, tt.actual, tt.passed)
+		}
+	}
+}
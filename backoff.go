@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// backoffMonitor mirrors the router's prune backoff bookkeeping so that the
+// GRAFTs it punishes can be surfaced as events. The router itself only
+// applies a behaviour penalty and does not report them.
+type backoffMonitor struct {
+	pruneBackoff   time.Duration
+	floodThreshold time.Duration
+
+	mu     sync.Mutex
+	pruned map[string]map[peer.ID]pruneInfo
+}
+
+type pruneInfo struct {
+	at      time.Time
+	backoff time.Duration
+}
+
+func newBackoffMonitor(params pubsub.GossipSubParams) *backoffMonitor {
+	return &backoffMonitor{
+		pruneBackoff:   params.PruneBackoff,
+		floodThreshold: params.GraftFloodThreshold,
+		pruned:         make(map[string]map[peer.ID]pruneInfo),
+	}
+}
+
+func (m *backoffMonitor) sentPrunes(p peer.ID, prunes []*pb.ControlPrune) {
+	if len(prunes) == 0 {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, prune := range prunes {
+		topic := prune.GetTopicID()
+		backoff := m.pruneBackoff
+		if prune.Backoff != nil {
+			backoff = time.Duration(prune.GetBackoff()) * time.Second
+		}
+		if m.pruned[topic] == nil {
+			m.pruned[topic] = make(map[peer.ID]pruneInfo)
+		}
+		m.pruned[topic][p] = pruneInfo{at: now, backoff: backoff}
+	}
+}
+
+// inspect checks inbound GRAFTs against the backoff we imposed. A GRAFT
+// within the backoff is a violation; one within GraftFloodThreshold of the
+// PRUNE is additionally treated as a flood by the router.
+func (m *backoffMonitor) inspect(p peer.ID, rpc *pubsub.RPC) error {
+	grafts := rpc.GetControl().GetGraft()
+	if len(grafts) == 0 {
+		return nil
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, graft := range grafts {
+		topic := graft.GetTopicID()
+		info, ok := m.pruned[topic][p]
+		if !ok || now.After(info.at.Add(info.backoff)) {
+			continue
+		}
+		since := now.Sub(info.at)
+		fields := map[string]interface{}{
+			"peer":         p.String(),
+			"topic":        topic,
+			"sincePruneMs": float64(since) / float64(time.Millisecond),
+			"backoffMs":    float64(info.backoff) / float64(time.Millisecond),
+		}
+		emitEvent("backoff_violation", fields)
+		if since < m.floodThreshold {
+			emitEvent("graft_flood", fields)
+		}
+	}
+	return nil
+}
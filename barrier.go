@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+const controlTopicName = "gossipsub-control"
+
+// BarrierConfig makes all nodes agree on a common workload start over a
+// control topic. Every node announces itself as ready; once the coordinator
+// (the lowest node) has heard from Nodes nodes, itself included, it
+// broadcasts a start time Lead in the future.
+type BarrierConfig struct {
+	Nodes   int      `json:"nodes"`
+	Lead    duration `json:"lead"`
+	Timeout duration `json:"timeout"`
+}
+
+type barrierMsg struct {
+	Type string    `json:"type"`
+	Node int       `json:"node"`
+	At   time.Time `json:"at,omitempty"`
+}
+
+func publishBarrierMsg(ctx context.Context, topic *pubsub.Topic, m barrierMsg) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if err := publish(ctx, topic, data); err != nil {
+		workloadLog.Warnf("Error publishing barrier %s: %v", m.Type, err)
+	}
+}
+
+// repeat publishes m every interval until done is closed or the deadline
+// passes, since early control messages can be lost while the mesh forms.
+func repeat(ctx context.Context, topic *pubsub.Topic, m barrierMsg, interval time.Duration, done <-chan struct{}, deadline time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		publishBarrierMsg(ctx, topic, m)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				return
+			}
+		}
+	}
+}
+
+func waitBarrier(ctx context.Context, ps *pubsub.PubSub, nodeNum, minNode int, b BarrierConfig) (time.Time, error) {
+	if b.Lead == 0 {
+		b.Lead = duration(2 * time.Second)
+	}
+	if b.Timeout == 0 {
+		b.Timeout = duration(5 * time.Minute)
+	}
+
+	topic, err := ps.Join(controlTopicName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	wait, cancel := context.WithTimeout(ctx, time.Duration(b.Timeout))
+	defer cancel()
+
+	coordinator := nodeNum == minNode
+	done := make(chan struct{})
+	defer close(done)
+	if !coordinator {
+		go repeat(ctx, topic, barrierMsg{Type: "ready", Node: nodeNum}, time.Second, done, time.Time{})
+	}
+
+	workloadLog.Infof("Node %d waiting at start barrier", nodeNum)
+	ready := map[int]bool{nodeNum: true}
+	announced := false
+	for {
+		if coordinator && !announced && len(ready) >= b.Nodes {
+			at := time.Now().Add(time.Duration(b.Lead))
+			workloadLog.Infof("Node %d releasing start barrier with %d nodes, start at %s", nodeNum, len(ready), at.Format(time.RFC3339Nano))
+			go repeat(ctx, topic, barrierMsg{Type: "start", Node: nodeNum, At: at}, 500*time.Millisecond, nil, at)
+			announced = true
+		}
+
+		msg, err := next(wait, sub)
+		if err != nil {
+			sub.Cancel()
+			return time.Time{}, fmt.Errorf("start barrier: %d/%d nodes ready: %w", len(ready), b.Nodes, err)
+		}
+		var m barrierMsg
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			continue
+		}
+		switch m.Type {
+		case "ready":
+			ready[m.Node] = true
+		case "start":
+			workloadLog.Infof("Node %d passed start barrier, start at %s", nodeNum, m.At.Format(time.RFC3339Nano))
+			// Stay subscribed until the start so the announcement keeps
+			// being relayed to nodes that have not seen it yet.
+			time.AfterFunc(time.Until(m.At), sub.Cancel)
+			return m.At, nil
+		}
+	}
+}
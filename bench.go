@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// benchNodes is the size of the standard DoS benchmark topology: a full
+// mesh of local nodes in which node 1 publishes.
+const benchNodes = 20
+
+// benchScenario is one run of a benchmark suite: the base config on a local
+// cluster of nodes, with its workload and adversaries replaced if set.
+type benchScenario struct {
+	name  string
+	nodes int
+	// degree connects every node to that many random others, 0 is a full
+	// mesh.
+	degree      int
+	workload    *WorkloadConfig
+	misbehavior *MisbehaviorConfig
+	listen      []ListenConfig
+}
+
+func nodeRange(from, to int) []int {
+	var nodes []int
+	for n := from; n <= to; n++ {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// dosScenarios is the battery run by `bench dos`. The spamming and
+// flooding scenarios use a fifth of the nodes as adversaries, the sybil
+// scenario half of them.
+func dosScenarios() []benchScenario {
+	attackers := nodeRange(benchNodes*4/5+1, benchNodes)
+	return []benchScenario{
+		{name: "baseline", nodes: benchNodes},
+		{name: "spam", nodes: benchNodes, misbehavior: &MisbehaviorConfig{Nodes: attackers, Spam: &SpamConfig{Rate: 50, Size: 1024}}},
+		{name: "iwant", nodes: benchNodes, misbehavior: &MisbehaviorConfig{Nodes: attackers, IWant: &FloodConfig{Rate: 10, IDs: 500}}},
+		{name: "ihave", nodes: benchNodes, misbehavior: &MisbehaviorConfig{Nodes: attackers, IHave: &FloodConfig{Rate: 10, IDs: 500}}},
+		{name: "sybil", nodes: benchNodes, misbehavior: &MisbehaviorConfig{Nodes: nodeRange(benchNodes/2+1, benchNodes), Blackhole: true}},
+	}
+}
+
+// throughputWorkload publishes size-byte messages at rate msg/s for 30s.
+func throughputWorkload(size int, rate float64) *WorkloadConfig {
+	return &WorkloadConfig{
+		Count:    int(rate * 30),
+		Interval: duration(float64(time.Second) / rate),
+		Size:     size,
+		Drain:    duration(10 * time.Second),
+	}
+}
+
+// throughputScenarios is the fixed set run by `bench throughput`; names
+// must stay stable so results remain comparable between versions.
+func throughputScenarios() []benchScenario {
+	return []benchScenario{
+		{name: "mesh10-1k-100", nodes: 10, workload: throughputWorkload(1<<10, 100)},
+		{name: "mesh10-64k-10", nodes: 10, workload: throughputWorkload(64<<10, 10)},
+		{name: "random30-1k-200", nodes: 30, degree: 6, workload: throughputWorkload(1<<10, 200)},
+		{name: "random50-10k-10", nodes: 50, degree: 6, workload: throughputWorkload(10<<10, 10)},
+	}
+}
+
+// dualStackScenarios is the set run by `bench dualstack`: ten nodes on IPv4
+// only, on IPv6 only, and mixed, where nodes 1-4 listen on both and bridge
+// the IPv4-only nodes 5-7 and the IPv6-only nodes 8-10, which cannot reach
+// each other.
+func dualStackScenarios() []benchScenario {
+	return []benchScenario{
+		{name: "ipv4", nodes: 10},
+		{name: "ipv6", nodes: 10, listen: []ListenConfig{{Addrs: []string{"ip6"}}}},
+		{name: "mixed", nodes: 10, listen: []ListenConfig{
+			{Nodes: nodeRange(1, 4), Addrs: []string{"ip4", "ip6"}},
+			{Nodes: nodeRange(8, 10), Addrs: []string{"ip6"}},
+		}},
+	}
+}
+
+// dualStackResults fails unless every message reached every node in every
+// scenario.
+func dualStackResults(outDir string, scenarios []benchScenario) error {
+	fmt.Printf("%-10s %10s %10s\n", "scenario", "coverage", "p99 ms")
+	var failed []string
+	for _, sc := range scenarios {
+		dir := filepath.Join(outDir, sc.name)
+		reports, err := loadNodeReports(dir)
+		if err != nil {
+			return err
+		}
+		if len(reports) == 0 {
+			return fmt.Errorf("scenario %s: no node reports in %s", sc.name, dir)
+		}
+		d := newRunStats(dir, reports).delivery
+		fmt.Printf("%-10s %9.2f%% %10.1f\n", sc.name, d.Coverage*100, d.P99Ms)
+		if d.Coverage < 1 {
+			failed = append(failed, sc.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("incomplete delivery in %v", failed)
+	}
+	return nil
+}
+
+// runBench runs every scenario of the suite as a local cluster, each in its
+// own directory under outDir, and prints the suite's results.
+func runBench(suite, outDir, configPath string) error {
+	var scenarios []benchScenario
+	var results func(outDir string, scenarios []benchScenario) error
+	switch suite {
+	case "dos":
+		scenarios, results = dosScenarios(), dosScorecard
+	case "throughput":
+		scenarios, results = throughputScenarios(), throughputResults
+	case "dualstack":
+		scenarios, results = dualStackScenarios(), dualStackResults
+	default:
+		return fmt.Errorf("unknown benchmark suite %q", suite)
+	}
+	if outDir == "" {
+		outDir = "bench-" + suite
+	}
+	base, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if base.Workload.Count == 0 {
+		base.Workload.Count = 200
+		base.Workload.Interval = duration(50 * time.Millisecond)
+	}
+	if base.Workload.Drain == 0 {
+		base.Workload.Drain = duration(15 * time.Second)
+	}
+
+	for _, sc := range scenarios {
+		if err := runScenario(sc, base, filepath.Join(outDir, sc.name)); err != nil {
+			return err
+		}
+	}
+	return results(outDir, scenarios)
+}
+
+func runScenario(sc benchScenario, base *Config, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	cfg := *base
+	cfg.Misbehavior = sc.misbehavior
+	if sc.listen != nil {
+		cfg.Listen = sc.listen
+	}
+	if sc.workload != nil {
+		cfg.Workload = *sc.workload
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	cfgPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(cfgPath, data, 0644); err != nil {
+		return err
+	}
+
+	clusterLog.Infof("Running scenario %s", sc.name)
+	cc := &ClusterConfig{
+		Config:     cfgPath,
+		LogDir:     dir,
+		StartDelay: duration(10 * time.Second),
+		Hosts:      []ClusterHost{{Nodes: nodeRange(1, sc.nodes)}},
+		Degree:     sc.degree,
+		Seed:       1,
+	}
+	cc.setDefaults()
+	if err := cc.run(nil); err != nil {
+		return fmt.Errorf("scenario %s: %v", sc.name, err)
+	}
+	return nil
+}
+
+// scorecardEntry is how well the honest nodes fared in one scenario. Score
+// is the coverage in percent, scaled down by how much the p99 latency grew
+// over the baseline.
+type scorecardEntry struct {
+	Scenario    string  `json:"scenario"`
+	Adversaries int     `json:"adversaries"`
+	Coverage    float64 `json:"coverage"`
+	P99Ms       float64 `json:"p99Ms"`
+	BytesPerMsg float64 `json:"bytesPerMsg"`
+	Score       float64 `json:"score"`
+}
+
+func dosScorecard(outDir string, scenarios []benchScenario) error {
+	var card []scorecardEntry
+	var baselineP99 float64
+	for _, sc := range scenarios {
+		e, err := scoreScenario(sc, filepath.Join(outDir, sc.name))
+		if err != nil {
+			return err
+		}
+		if sc.misbehavior == nil {
+			baselineP99 = e.P99Ms
+		}
+		e.Score = e.Coverage * 100
+		if baselineP99 > 0 && e.P99Ms > 0 {
+			e.Score *= math.Min(1, baselineP99/e.P99Ms)
+		}
+		card = append(card, e)
+	}
+
+	fmt.Printf("%-10s %11s %10s %10s %12s %7s\n", "scenario", "adversaries", "coverage", "p99 ms", "bytes/msg", "score")
+	for _, e := range card {
+		fmt.Printf("%-10s %11d %9.2f%% %10.1f %12.0f %7.1f\n",
+			e.Scenario, e.Adversaries, e.Coverage*100, e.P99Ms, e.BytesPerMsg, e.Score)
+	}
+	data, err := json.MarshalIndent(card, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outDir, "scorecard.json"), data, 0644)
+}
+
+// scoreScenario measures delivery among the honest nodes only; what the
+// adversaries received or sent does not count.
+func scoreScenario(sc benchScenario, dir string) (scorecardEntry, error) {
+	reports, err := loadNodeReports(dir)
+	if err != nil {
+		return scorecardEntry{}, err
+	}
+	var honest []nodeReport
+	for _, rep := range reports {
+		if !sc.misbehavior.applies(rep.Node) {
+			honest = append(honest, rep)
+		}
+	}
+	if len(honest) == 0 {
+		return scorecardEntry{}, fmt.Errorf("scenario %s: no honest node reports in %s", sc.name, dir)
+	}
+	rs := newRunStats(dir, honest)
+	return scorecardEntry{
+		Scenario:    sc.name,
+		Adversaries: len(reports) - len(honest),
+		Coverage:    rs.delivery.Coverage,
+		P99Ms:       rs.delivery.P99Ms,
+		BytesPerMsg: rs.bytesPerMsg,
+	}, nil
+}
+
+// throughputEntry is the outcome of one throughput scenario. DeliveredRate
+// is the first deliveries per receiving node and second, between the first
+// publish and the last delivery.
+type throughputEntry struct {
+	Scenario      string  `json:"scenario"`
+	Nodes         int     `json:"nodes"`
+	Degree        int     `json:"degree"`
+	Size          int     `json:"size"`
+	OfferedRate   float64 `json:"offeredRate"`
+	DeliveredRate float64 `json:"deliveredRate"`
+	Coverage      float64 `json:"coverage"`
+	P50Ms         float64 `json:"p50Ms"`
+	P99Ms         float64 `json:"p99Ms"`
+	BytesPerMsg   float64 `json:"bytesPerMsg"`
+	MeanCPUPct    float64 `json:"meanCpuPct"`
+	PeakRSSBytes  int64   `json:"peakRssBytes"`
+}
+
+type throughputReport struct {
+	Machine   machineInfo       `json:"machine"`
+	Scenarios []throughputEntry `json:"scenarios"`
+}
+
+func throughputResults(outDir string, scenarios []benchScenario) error {
+	out := throughputReport{Machine: currentMachine()}
+	for _, sc := range scenarios {
+		dir := filepath.Join(outDir, sc.name)
+		reports, err := loadNodeReports(dir)
+		if err != nil {
+			return err
+		}
+		if len(reports) == 0 {
+			return fmt.Errorf("scenario %s: no node reports in %s", sc.name, dir)
+		}
+		rs := newRunStats(dir, reports)
+		e := throughputEntry{
+			Scenario:      sc.name,
+			Nodes:         len(reports),
+			Degree:        sc.degree,
+			Size:          sc.workload.Size,
+			OfferedRate:   float64(time.Second) / float64(sc.workload.Interval),
+			DeliveredRate: deliveredRate(reports),
+			Coverage:      rs.delivery.Coverage,
+			P50Ms:         rs.delivery.P50Ms,
+			P99Ms:         rs.delivery.P99Ms,
+			BytesPerMsg:   rs.bytesPerMsg,
+		}
+		res := analyzeResources(reports)
+		for _, r := range res {
+			e.MeanCPUPct += r.MeanCPUPct / float64(len(res))
+			e.PeakRSSBytes += r.PeakRSSBytes
+		}
+		out.Scenarios = append(out.Scenarios, e)
+	}
+
+	m := out.Machine
+	fmt.Printf("Machine: %s %s/%s %d CPUs %s %s\n", m.Host, m.OS, m.Arch, m.CPUs, m.Go, m.Revision)
+	fmt.Printf("%-16s %9s %9s %10s %8s %8s %8s %7s %9s\n",
+		"scenario", "offered/s", "deliv/s", "coverage", "p50 ms", "p99 ms", "KiB/msg", "cpu", "rss MiB")
+	for _, e := range out.Scenarios {
+		fmt.Printf("%-16s %9.1f %9.1f %9.2f%% %8.1f %8.1f %8.1f %6.1f%% %9.1f\n",
+			e.Scenario, e.OfferedRate, e.DeliveredRate, e.Coverage*100, e.P50Ms, e.P99Ms,
+			e.BytesPerMsg/(1<<10), e.MeanCPUPct, float64(e.PeakRSSBytes)/(1<<20))
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outDir, "results.json"), data, 0644)
+}
+
+// deliveredRate is the number of first deliveries per receiving node and
+// second between the first publish and the last first delivery.
+func deliveredRate(reports []nodeReport) float64 {
+	published := make(map[messageKey]bool)
+	var first, last int64
+	for _, rep := range reports {
+		for _, p := range rep.Published {
+			published[messageKey{p.Topic, rep.Node, p.Seq}] = true
+			if first == 0 || p.SentAt < first {
+				first = p.SentAt
+			}
+		}
+	}
+	delivered := 0
+	for _, rep := range reports {
+		seen := make(map[messageKey]bool)
+		for _, rr := range rep.Received {
+			k := messageKey{rr.Topic, rr.Publisher, rr.Seq}
+			if rr.Publisher == rep.Node || seen[k] || !published[k] {
+				continue
+			}
+			seen[k] = true
+			delivered++
+			if rr.ReceivedAt > last {
+				last = rr.ReceivedAt
+			}
+		}
+	}
+	if last <= first || len(reports) < 2 {
+		return 0
+	}
+	return float64(delivered) / float64(len(reports)-1) / time.Duration(last-first).Seconds()
+}
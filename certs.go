@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	lpcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// An experiment CA directory holds
+//
+//	ca.pem, ca.key         the CA, created once and kept
+//	node<N>.pem            a certificate for node N's identity key
+//	client.pem, client.key a client certificate for tools such as curl
+//
+// The node certificates carry the identity's own public key, with the peer
+// ID as common name, and so bind a TLS endpoint to the peer ID. Their
+// private key is the identity key in identities/, which is not copied.
+const caValidity = 10 * 365 * 24 * time.Hour
+
+var identityFileRE = regexp.MustCompile(`^node(\d+)\.key$`)
+
+// issueCerts creates or loads the CA in dir and issues a certificate for
+// every identity in identities/ and one for a client, all valid for
+// localhost and hosts.
+func issueCerts(dir string, hosts []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	caCert, caKey, err := loadOrCreateCA(dir)
+	if err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join("identities", "node*.key"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		m := identityFileRE.FindStringSubmatch(filepath.Base(path))
+		if m == nil {
+			continue
+		}
+		priv, err := loadOrCreateIdentity(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		id, err := peer.IDFromPrivateKey(priv)
+		if err != nil {
+			return err
+		}
+		key, err := stdSigner(priv)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		der, err := issueCert(caCert, caKey, key.Public(), id.String(), hosts)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(filepath.Join(dir, "node"+m[1]+".pem"), "CERTIFICATE", der, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("node%s: %s\n", m[1], id)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := issueCert(caCert, caKey, clientKey.Public(), "client", hosts)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, "client.pem"), "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, "client.key"), "PRIVATE KEY", keyDER, 0600)
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+		// Replacing an existing CA would invalidate every certificate it
+		// signed, so only a missing pair is created.
+		pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("CA in %s: %v", dir, err)
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, pair.PrivateKey.(crypto.Signer), nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "gossipsub experiment CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(keyPath, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func issueCert(ca *x509.Certificate, caKey crypto.Signer, pub crypto.PublicKey, name string, hosts []string) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     ca.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return x509.CreateCertificate(rand.Reader, tmpl, ca, pub, caKey)
+}
+
+// stdSigner converts an identity key to a key x509 and crypto/tls accept;
+// secp256k1 identities have none.
+func stdSigner(priv lpcrypto.PrivKey) (crypto.Signer, error) {
+	k, err := lpcrypto.PrivKeyToStdKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	switch k := k.(type) {
+	case *ed25519.PrivateKey:
+		return *k, nil
+	case crypto.Signer:
+		return k, nil
+	}
+	return nil, fmt.Errorf("identity key of type %s cannot sign certificates", priv.Type())
+}
+
+func writePEM(path, typ string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), perm)
+}
+
+// nodeTLSConfig is the server config of node nodeNum's HTTP endpoints: its
+// certificate from dir with its identity key, and only clients with a
+// certificate from the CA in dir.
+func nodeTLSConfig(dir string, nodeNum int, priv lpcrypto.PrivKey) (*tls.Config, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("node%d.pem", nodeNum)))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("node%d.pem: no certificate", nodeNum)
+	}
+	key, err := stdSigner(priv)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Subject.CommonName != id.String() {
+		return nil, fmt.Errorf("node%d.pem is for %s, not %s; run ca again", nodeNum, cert.Subject.CommonName, id)
+	}
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("ca.pem: no certificate")
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{block.Bytes}, PrivateKey: key, Leaf: cert}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
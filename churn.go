@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// ChurnConfig makes the listed nodes unsubscribe from Topics (default: all
+// their topics except lanes) every Interval and subscribe again after Gap,
+// Cycles times (default: until the workload ends).
+type ChurnConfig struct {
+	Nodes    []int    `json:"nodes"`
+	Topics   []string `json:"topics"`
+	Interval duration `json:"interval"`
+	Gap      duration `json:"gap"`
+	Cycles   int      `json:"cycles"`
+}
+
+// churner runs the subscribe/unsubscribe cycles of a node's churning
+// topics.
+type churner struct {
+	// ctx is the node's, which ends every subscription's receive loop.
+	ctx     context.Context
+	cfg     ChurnConfig
+	nodeNum int
+	rec     *recorder
+	// paused skips the cycles while it is set, through PUT /config.
+	paused atomic.Bool
+
+	mu     sync.Mutex
+	topics map[string]*churnTopic
+	gaps   []churnGap
+}
+
+// churnTopic is one churning topic; rejoinedAt is set while it waits for a
+// mesh peer after a gap.
+type churnTopic struct {
+	topic      *pubsub.Topic
+	opts       []pubsub.SubOpt
+	sub        *pubsub.Subscription
+	rejoinedAt time.Time
+}
+
+type churnGap struct {
+	topic       string
+	left, ended time.Time
+}
+
+// newChurner returns nil if the node does not churn.
+func newChurner(ctx context.Context, cfg *ChurnConfig, nodeNum int, rec *recorder) *churner {
+	if cfg == nil {
+		return nil
+	}
+	for _, n := range cfg.Nodes {
+		if n != nodeNum {
+			continue
+		}
+		c := &churner{ctx: ctx, cfg: *cfg, nodeNum: nodeNum, rec: rec, topics: make(map[string]*churnTopic)}
+		if c.cfg.Interval == 0 {
+			c.cfg.Interval = duration(30 * time.Second)
+		}
+		if c.cfg.Gap == 0 {
+			c.cfg.Gap = duration(10 * time.Second)
+		}
+		return c
+	}
+	return nil
+}
+
+func (c *churner) covers(topic string) bool {
+	if c == nil {
+		return false
+	}
+	if len(c.cfg.Topics) == 0 {
+		return true
+	}
+	for _, t := range c.cfg.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// add subscribes to a churning topic and handles its messages.
+func (c *churner) add(topic *pubsub.Topic, opts ...pubsub.SubOpt) error {
+	ct := &churnTopic{topic: topic, opts: opts}
+	c.mu.Lock()
+	c.topics[topic.String()] = ct
+	c.mu.Unlock()
+	return c.subscribe(ct)
+}
+
+func (c *churner) subscribe(ct *churnTopic) error {
+	sub, err := ct.topic.Subscribe(ct.opts...)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	ct.sub = sub
+	c.mu.Unlock()
+	go c.handleMessages(sub)
+	return nil
+}
+
+// handleMessages is handleMessages for a subscription that is cancelled at
+// every gap.
+func (c *churner) handleMessages(sub *pubsub.Subscription) {
+	for {
+		msg, err := next(c.ctx, sub)
+		if err != nil {
+			return
+		}
+		handleMessage(msg, c.nodeNum, c.rec)
+	}
+}
+
+// grafted ends a rejoin once the topic has a mesh peer again.
+func (c *churner) grafted(topic string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	ct := c.topics[topic]
+	if ct == nil || ct.rejoinedAt.IsZero() {
+		c.mu.Unlock()
+		return
+	}
+	took := time.Since(ct.rejoinedAt)
+	ct.rejoinedAt = time.Time{}
+	c.mu.Unlock()
+	stats.inc(metricName("churn_rejoins_total", "topic", topic), 1)
+	stats.inc(metricName("churn_rejoin_seconds_total", "topic", topic), took.Seconds())
+	emitEvent("mesh_rejoined", map[string]interface{}{"topic": topic, "seconds": took.Seconds()})
+}
+
+func (c *churner) leave(ct *churnTopic) time.Time {
+	// Cancel waits for the router's event loop, which may be calling
+	// grafted, so it must not run under c.mu.
+	c.mu.Lock()
+	sub := ct.sub
+	c.mu.Unlock()
+	sub.Cancel()
+	c.mu.Lock()
+	ct.rejoinedAt = time.Time{}
+	c.mu.Unlock()
+	stats.inc(metricName("churn_leaves_total", "topic", ct.topic.String()), 1)
+	emitEvent("topic_left", map[string]interface{}{"topic": ct.topic.String()})
+	return time.Now()
+}
+
+func (c *churner) rejoin(ct *churnTopic, left time.Time) {
+	now := time.Now()
+	c.mu.Lock()
+	ct.rejoinedAt = now
+	c.gaps = append(c.gaps, churnGap{topic: ct.topic.String(), left: left, ended: now})
+	c.mu.Unlock()
+	if err := c.subscribe(ct); err != nil {
+		pubsubLog.Warnf("Error re-subscribing to %s: %v", ct.topic, err)
+		return
+	}
+	emitEvent("topic_rejoined", map[string]interface{}{"topic": ct.topic.String()})
+}
+
+// run cycles every churning topic until end.
+func (c *churner) run(end time.Time) {
+	c.mu.Lock()
+	topics := make([]*churnTopic, 0, len(c.topics))
+	for _, ct := range c.topics {
+		topics = append(topics, ct)
+	}
+	c.mu.Unlock()
+	pubsubLog.Infof("Node %d churning %d topics: %s on, %s off", c.nodeNum, len(topics), time.Duration(c.cfg.Interval), time.Duration(c.cfg.Gap))
+	left := make([]time.Time, len(topics))
+	for cycle := 0; c.cfg.Cycles == 0 || cycle < c.cfg.Cycles; cycle++ {
+		time.Sleep(time.Duration(c.cfg.Interval))
+		if time.Now().Add(time.Duration(c.cfg.Gap)).After(end) {
+			return
+		}
+		if c.paused.Load() {
+			continue
+		}
+		for i, ct := range topics {
+			left[i] = c.leave(ct)
+		}
+		time.Sleep(time.Duration(c.cfg.Gap))
+		for i, ct := range topics {
+			c.rejoin(ct, left[i])
+		}
+	}
+}
+
+// summarize counts, per topic, the messages published while the node was
+// unsubscribed and how many of them it received later anyway, through
+// gossip or from peers still sending to it, or missed entirely. A
+// publisher's messages of a gap are the sequence numbers between the last
+// one the node received before leaving and the first one sent after it
+// rejoined.
+func (c *churner) summarize() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	gaps := append([]churnGap(nil), c.gaps...)
+	c.mu.Unlock()
+	c.rec.mu.Lock()
+	received := append([]receiveRecord(nil), c.rec.received...)
+	c.rec.mu.Unlock()
+
+	type key struct {
+		topic     string
+		publisher int
+	}
+	got := make(map[key]map[uint64]bool)
+	for _, rr := range received {
+		k := key{rr.Topic, rr.Publisher}
+		if got[k] == nil {
+			got[k] = make(map[uint64]bool)
+		}
+		got[k][rr.Seq] = true
+	}
+	for _, g := range gaps {
+		missed, recovered := 0, 0
+		for k, seqs := range got {
+			if k.topic != g.topic {
+				continue
+			}
+			var before, after, highest uint64
+			for _, rr := range received {
+				if rr.Topic != k.topic || rr.Publisher != k.publisher {
+					continue
+				}
+				if rr.ReceivedAt < g.left.UnixNano() && rr.Seq > before {
+					before = rr.Seq
+				}
+				if rr.SentAt >= g.ended.UnixNano() && (after == 0 || rr.Seq < after) {
+					after = rr.Seq
+				}
+				if rr.Seq > highest {
+					highest = rr.Seq
+				}
+			}
+			if after == 0 {
+				after = highest + 1
+			}
+			for seq := before + 1; seq < after; seq++ {
+				if seqs[seq] {
+					recovered++
+				} else {
+					missed++
+				}
+			}
+		}
+		stats.inc(metricName("churn_gap_messages_total", "topic", g.topic), float64(missed+recovered))
+		stats.inc(metricName("churn_messages_recovered_total", "topic", g.topic), float64(recovered))
+		stats.inc(metricName("churn_messages_missed_total", "topic", g.topic), float64(missed))
+	}
+}
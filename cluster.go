@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ClusterConfig describes an experiment spread over several machines. Hosts
+// without an ssh target run their nodes on the coordinator itself.
+type ClusterConfig struct {
+	Binary     string        `json:"binary"`
+	Config     string        `json:"config"`
+	RemoteDir  string        `json:"remoteDir"`
+	LogDir     string        `json:"logDir"`
+	StartDelay duration      `json:"startDelay"`
+	Hosts      []ClusterHost `json:"hosts"`
+	// SnapshotDir makes every node write a state snapshot on shutdown
+	// (relative to RemoteDir on remote hosts); with Restore the nodes start
+	// from the snapshots of the previous run.
+	SnapshotDir string `json:"snapshotDir"`
+	Restore     bool   `json:"restore"`
+	// Pcap makes every node capture its traffic into node<N>.pcap, which
+	// is collected into LogDir like the reports.
+	Pcap bool `json:"pcap"`
+	// Degree connects every node to about that many random other nodes
+	// instead of all of them; the graph only depends on Seed.
+	Degree int   `json:"degree"`
+	Seed   int64 `json:"seed"`
+	// Constraints restrict the Degree graph by the nodes' regions.
+	Constraints *TopologyConstraints `json:"constraints"`
+	// TopologyFile replays the graph of an earlier run's topology.json
+	// instead of generating one.
+	TopologyFile string `json:"topologyFile"`
+	// UnixDir makes the nodes of each host reach each other through Unix
+	// sockets in this directory (relative to RemoteDir on remote hosts).
+	UnixDir string `json:"unixDir"`
+	// Lite starts every node with -lite.
+	Lite bool `json:"lite"`
+	// AutoPorts starts every node with -port auto instead of 4000 plus its
+	// number; the nodes find each other through a registry in LogDir, so
+	// all hosts must be local.
+	AutoPorts bool `json:"autoPorts"`
+	// Results sorts LogDir into the layout of a results directory, see
+	// runFile; it is set by -results-dir.
+	Results bool `json:"-"`
+}
+
+type ClusterHost struct {
+	SSH string `json:"ssh"`
+	IP  string `json:"ip"`
+	// IP6 is the host's IPv6 address, for nodes listening on IPv6.
+	IP6   string `json:"ip6"`
+	Nodes []int  `json:"nodes"`
+}
+
+func (h ClusterHost) local() bool {
+	return h.SSH == ""
+}
+
+// dialAddrs are the addresses node n with ID id is reached on, in each
+// family cfg has it listen on. Local hosts default to the loopback
+// addresses; a remote host needs IP6 for nodes that only listen on IPv6.
+func (h ClusterHost) dialAddrs(cfg *Config, n int, id peer.ID) (dialAddrs, error) {
+	var d dialAddrs
+	ip4, ip6 := cfg.listenFamilies(n)
+	if ip4 {
+		ip := h.IP
+		if ip == "" {
+			ip = "127.0.0.1"
+		}
+		d.ip4 = fmt.Sprintf("/ip4/%s/tcp/%d/p2p/%s", ip, 4000+n, id)
+	}
+	if ip6 {
+		ip := h.IP6
+		if ip == "" && h.local() {
+			ip = "::1"
+		}
+		if ip != "" {
+			d.ip6 = fmt.Sprintf("/ip6/%s/tcp/%d/p2p/%s", ip, 4000+n, id)
+		}
+	}
+	if d.preferred() == "" {
+		return d, fmt.Errorf("node %d only listens on IPv6, but host %s has no ip6", n, h.SSH)
+	}
+	return d, nil
+}
+
+func loadClusterConfig(path string) (*ClusterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, configError(err)
+	}
+	cc := &ClusterConfig{}
+	if err := json.Unmarshal(data, cc); err != nil {
+		return nil, configError(err)
+	}
+	if cc.Hosts == nil {
+		return nil, configError(fmt.Errorf("%s: no hosts", path))
+	}
+	if cc.AutoPorts {
+		if cc.UnixDir != "" {
+			return nil, configError(fmt.Errorf("%s: autoPorts cannot be combined with unixDir", path))
+		}
+		for _, h := range cc.Hosts {
+			if !h.local() {
+				return nil, configError(fmt.Errorf("%s: autoPorts needs local hosts, not %s", path, h.SSH))
+			}
+		}
+	}
+	cc.setDefaults()
+	return cc, nil
+}
+
+func (cc *ClusterConfig) setDefaults() {
+	if cc.Binary == "" {
+		cc.Binary = os.Args[0]
+	}
+	if cc.RemoteDir == "" {
+		cc.RemoteDir = "/tmp/gossipsub"
+	}
+	if cc.LogDir == "" {
+		cc.LogDir = "logs"
+	}
+	if cc.StartDelay == 0 {
+		cc.StartDelay = duration(30 * time.Second)
+	}
+}
+
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+func sshArgs(target string, args ...string) []string {
+	return append([]string{"-o", "BatchMode=yes", target}, args...)
+}
+
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// distribute copies the node binary, the experiment config and the identity
+// keys of the host's nodes into RemoteDir.
+func (cc *ClusterConfig) distribute(h ClusterHost) error {
+	dirs := []string{"mkdir", "-p", cc.RemoteDir + "/identities"}
+	if cc.SnapshotDir != "" {
+		dirs = append(dirs, cc.RemoteDir+"/"+cc.SnapshotDir)
+	}
+	if err := runCommand("ssh", sshArgs(h.SSH, dirs...)...); err != nil {
+		return err
+	}
+	files := []string{cc.Binary}
+	if cc.Config != "" {
+		files = append(files, cc.Config)
+	}
+	args := append(files, h.SSH+":"+cc.RemoteDir+"/")
+	if err := runCommand("scp", args...); err != nil {
+		return err
+	}
+	var keys []string
+	for _, n := range h.Nodes {
+		keys = append(keys, filepath.Join("identities", fmt.Sprintf("node%d.key", n)))
+	}
+	return runCommand("scp", append(keys, h.SSH+":"+cc.RemoteDir+"/identities/")...)
+}
+
+// runCluster runs the experiment of the cluster config at path. With a
+// resultsDir its output goes into a new run directory there, which is
+// archived afterwards whether or not the checks hold. A topologyFile
+// overrides the config's.
+func runCluster(path string, checks []assertion, resultsDir, topologyFile string) error {
+	cc, err := loadClusterConfig(path)
+	if err != nil {
+		return err
+	}
+	if topologyFile != "" {
+		cc.TopologyFile = topologyFile
+	}
+	if resultsDir == "" {
+		return cc.run(checks)
+	}
+	return cc.runResults(path, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), checks, resultsDir)
+}
+
+// replayRun runs the results run in dir again with the copies of its
+// configs and, if it had a random graph, its topology, into a new run
+// directory in resultsDir or next to dir.
+func replayRun(dir string, checks []assertion, resultsDir string) error {
+	path := filepath.Join(dir, "config", "cluster.json")
+	cc, err := loadClusterConfig(path)
+	if err != nil {
+		return fmt.Errorf("%s is not a results run: %v", dir, err)
+	}
+	if cc.Config != "" {
+		cc.Config = filepath.Join(dir, "config", filepath.Base(cc.Config))
+	}
+	topology := filepath.Join(dir, "topology.json")
+	if _, err := os.Stat(topology); err == nil {
+		cc.TopologyFile = topology
+	} else if cc.TopologyFile != "" {
+		return fmt.Errorf("%s: topology file %s was not collected", dir, cc.TopologyFile)
+	}
+	if resultsDir == "" {
+		resultsDir = filepath.Dir(filepath.Clean(dir))
+	}
+	clusterLog.Infof("Replaying %s", dir)
+	return cc.runResults(path, "replay-"+filepath.Base(filepath.Clean(dir)), checks, resultsDir)
+}
+
+// runResults runs the experiment of the cluster config at path into a new
+// run directory called after name in resultsDir and archives it.
+func (cc *ClusterConfig) runResults(path, name string, checks []assertion, resultsDir string) error {
+	if err := cc.newResultsRun(resultsDir, name, path); err != nil {
+		return err
+	}
+	runErr := cc.run(checks)
+	archive, err := archiveRun(cc.LogDir)
+	if err != nil {
+		return err
+	}
+	clusterLog.Infof("Results in %s, archived to %s", cc.LogDir, archive)
+	return runErr
+}
+
+// run distributes the experiment, launches every node with the same absolute
+// start time, waits for them to exit and collects logs and reports into
+// LogDir before building the run report, which must satisfy checks.
+func (cc *ClusterConfig) run(checks []assertion) error {
+	if err := os.MkdirAll(cc.LogDir, 0755); err != nil {
+		return err
+	}
+	if err := writeProvenance(cc.LogDir, cc); err != nil {
+		return err
+	}
+	if err := os.MkdirAll("identities", 0755); err != nil {
+		return err
+	}
+	if cc.SnapshotDir != "" {
+		if err := os.MkdirAll(cc.SnapshotDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	nodeCfg, err := loadConfig(cc.Config)
+	if err != nil {
+		return err
+	}
+	registry := filepath.Join(cc.LogDir, "registry.jsonl")
+	if cc.AutoPorts {
+		if err := os.Remove(registry); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	minNode := -1
+	addrs := make(map[int]string)
+	dial := make(map[int]dialAddrs)
+	for _, h := range cc.Hosts {
+		for _, n := range h.Nodes {
+			priv, err := loadOrCreateIdentity(filepath.Join("identities", fmt.Sprintf("node%d.key", n)))
+			if err != nil {
+				return err
+			}
+			id, err := peer.IDFromPrivateKey(priv)
+			if err != nil {
+				return err
+			}
+			if dial[n], err = h.dialAddrs(nodeCfg, n, id); err != nil {
+				return err
+			}
+			addrs[n] = dial[n].preferred()
+			if minNode < 0 || n < minNode {
+				minNode = n
+			}
+		}
+	}
+
+	for _, h := range cc.Hosts {
+		if h.local() {
+			continue
+		}
+		clusterLog.Infof("Distributing experiment to %s", h.SSH)
+		if err := cc.distribute(h); err != nil {
+			return err
+		}
+	}
+
+	startAt := time.Now().Add(time.Duration(cc.StartDelay))
+	clusterLog.Infof("Experiment starts at %s", startAt.Format(time.RFC3339Nano))
+
+	graph, err := cc.graph(addrs)
+	if err != nil {
+		return err
+	}
+	if graph != nil {
+		if err := cc.writeTopology(cc.LogDir, graph); err != nil {
+			return err
+		}
+	}
+
+	// A node cannot dial a peer that listens on no family it listens on;
+	// the full mesh has every pair twice.
+	peerAddr := func(n, m int) (string, bool) {
+		a, ok := dial[n].to(dial[m])
+		if !ok && (graph != nil || n < m) {
+			clusterLog.Warnf("Nodes %d and %d listen on no common address family, not connecting them", n, m)
+		}
+		return a, ok
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(addrs))
+	for _, h := range cc.Hosts {
+		for _, n := range h.Nodes {
+			neighbours := graph[n]
+			if graph == nil {
+				for m := range addrs {
+					if m != n {
+						neighbours = append(neighbours, m)
+					}
+				}
+			}
+			var peers, peerNodes []string
+			for _, m := range neighbours {
+				if a, ok := peerAddr(n, m); ok {
+					peers = append(peers, a)
+					peerNodes = append(peerNodes, fmt.Sprint(m))
+				}
+			}
+			args := []string{
+				"node", "run",
+				"-node", fmt.Sprint(n),
+				"-lowest-node", fmt.Sprint(minNode),
+				"-start-at", startAt.Format(time.RFC3339Nano),
+				"-experiment", filepath.Base(cc.LogDir),
+			}
+			if cc.AutoPorts {
+				args = append(args, "-port", "auto", "-registry", registry, "-peer-nodes", strings.Join(peerNodes, ","))
+			} else {
+				args = append(args, "-port", fmt.Sprint(4000+n), "-peers", strings.Join(peers, ","))
+			}
+			if cc.UnixDir != "" {
+				args = append(args, "-unix", cc.UnixDir)
+			}
+			if cc.Lite {
+				args = append(args, "-lite")
+			}
+			if cc.SnapshotDir != "" {
+				snapshot := filepath.Join(cc.SnapshotDir, fmt.Sprintf("node%d.snapshot.json", n))
+				args = append(args, "-snapshot", snapshot)
+				if cc.Restore {
+					args = append(args, "-restore", snapshot)
+				}
+			}
+
+			var cmd *exec.Cmd
+			if h.local() {
+				args = append(args, "-report", cc.runFile("report", n))
+				if cc.Pcap {
+					args = append(args, "-pcap", cc.runFile("pcap", n))
+				}
+				if dump := cc.runFile("metrics", n); dump != "" {
+					args = append(args, "-metrics-dump", dump, "-metrics-history", cc.runFile("history", n))
+				}
+				if cc.Config != "" {
+					args = append(args, "-config", cc.Config)
+				}
+				cmd = exec.Command(cc.Binary, args...)
+			} else {
+				args = append(args, "-report", fmt.Sprintf("node%d.json", n))
+				if cc.Pcap {
+					args = append(args, "-pcap", fmt.Sprintf("node%d.pcap", n))
+				}
+				if cc.Results {
+					args = append(args, "-metrics-dump", fmt.Sprintf("node%d.prom", n), "-metrics-history", fmt.Sprintf("node%d.csv", n))
+				}
+				if cc.Config != "" {
+					args = append(args, "-config", filepath.Base(cc.Config))
+				}
+				remote := fmt.Sprintf("cd %s && ./%s %s", shellQuote([]string{cc.RemoteDir}), filepath.Base(cc.Binary), shellQuote(args))
+				cmd = exec.Command("ssh", sshArgs(h.SSH, remote)...)
+			}
+
+			logFile, err := os.Create(cc.runFile("log", n))
+			if err != nil {
+				return err
+			}
+			watcher := &slaWatcher{w: logFile, node: n}
+			cmd.Stdout = watcher
+			cmd.Stderr = watcher
+			if err := cmd.Start(); err != nil {
+				logFile.Close()
+				return err
+			}
+			clusterLog.Infof("Started node %d on %s", n, hostName(h))
+
+			wg.Add(1)
+			go func(n int, h ClusterHost) {
+				defer wg.Done()
+				defer logFile.Close()
+				err := cmd.Wait()
+				if watcher.violations > 0 {
+					clusterLog.Warnf("Node %d on %s missed an SLA in %d windows", n, hostName(h), watcher.violations)
+				}
+				if err != nil {
+					var exitErr *exec.ExitError
+					if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+						err = fmt.Errorf("exited with %d (%s)", exitErr.ExitCode(), exitStatusName(exitErr.ExitCode()))
+					}
+					errs <- fmt.Errorf("node %d on %s: %v", n, hostName(h), err)
+				}
+			}(n, h)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		clusterLog.Warnf("%v", err)
+	}
+
+	for _, h := range cc.Hosts {
+		if h.local() {
+			continue
+		}
+		for _, n := range h.Nodes {
+			src := fmt.Sprintf("%s:%s/node%d.json", h.SSH, cc.RemoteDir, n)
+			if err := runCommand("scp", src, cc.runFile("report", n)); err != nil {
+				clusterLog.Warnf("Error collecting report of node %d: %v", n, err)
+			}
+			if cc.Pcap {
+				src := fmt.Sprintf("%s:%s/node%d.pcap", h.SSH, cc.RemoteDir, n)
+				if err := runCommand("scp", src, cc.runFile("pcap", n)); err != nil {
+					clusterLog.Warnf("Error collecting capture of node %d: %v", n, err)
+				}
+			}
+			if cc.Results {
+				src := fmt.Sprintf("%s:%s/node%d.prom", h.SSH, cc.RemoteDir, n)
+				if err := runCommand("scp", src, cc.runFile("metrics", n)); err != nil {
+					clusterLog.Warnf("Error collecting metrics of node %d: %v", n, err)
+				}
+				src = fmt.Sprintf("%s:%s/node%d.csv", h.SSH, cc.RemoteDir, n)
+				if err := runCommand("scp", src, cc.runFile("history", n)); err != nil {
+					clusterLog.Warnf("Error collecting metrics history of node %d: %v", n, err)
+				}
+			}
+		}
+	}
+
+	return analyzeRun(cc.LogDir, checks)
+}
+
+// randomGraph links every node to up to degree random others and returns
+// the links each node dials, every link being dialed from one end only.
+func randomGraph(addrs map[int]string, degree int, seed int64) map[int][]int {
+	var nodes []int
+	for n := range addrs {
+		nodes = append(nodes, n)
+	}
+	sort.Ints(nodes)
+	rng := rand.New(rand.NewSource(seed))
+	links := make(map[int]map[int]bool)
+	for _, n := range nodes {
+		links[n] = make(map[int]bool)
+	}
+	dials := make(map[int][]int)
+	for _, n := range nodes {
+		for _, m := range rng.Perm(len(nodes)) {
+			if len(links[n]) >= degree {
+				break
+			}
+			c := nodes[m]
+			if c == n || links[n][c] || len(links[c]) >= degree {
+				continue
+			}
+			links[n][c] = true
+			links[c][n] = true
+			dials[n] = append(dials[n], c)
+		}
+	}
+	return dials
+}
+
+func hostName(h ClusterHost) string {
+	if h.local() {
+		return "localhost"
+	}
+	return h.SSH
+}
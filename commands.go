@@ -0,0 +1,587 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// command is a node of the command tree: either a group of subcommands or a
+// leaf whose setup registers its flags and returns what runs it with the
+// positional arguments.
+type command struct {
+	name  string
+	args  string
+	short string
+	setup func(fs *flag.FlagSet) func(args []string) error
+	subs  []*command
+}
+
+// errUsage makes execute print the command's usage and exit with
+// exitUsage.
+var errUsage = errors.New("usage")
+
+func progName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func rootCommand() *command {
+	return &command{
+		subs: []*command{
+			{name: "node", short: "Run nodes", subs: []*command{
+				{name: "run", short: "Run one node, or a range of nodes with -node-range", setup: setupNodeRun},
+				{name: "delays", args: "<node,...>", short: "Print the region delay matrix of the nodes as src,dst,ms lines", setup: setupNodeDelays},
+			}},
+			{name: "keys", short: "Manage identities and certificates", subs: []*command{
+				{name: "generate", short: "Create the identities of nodes 0 to -max-node and print their peer IDs", setup: setupKeysGenerate},
+				{name: "ca", args: "<dir> [host...]", short: "Issue certificates for the identities from an experiment CA", setup: setupKeysCA},
+			}},
+			{name: "cluster", short: "Coordinate multi-host experiments", subs: []*command{
+				{name: "run", args: "<cluster.json>", short: "Run the experiment of a cluster config", setup: setupClusterRun},
+			}},
+			{name: "bench", args: "<suite> [outdir]", short: "Run a benchmark suite (dos, throughput, dualstack) as local clusters", setup: setupBench},
+			{name: "report", short: "Analyse runs", subs: []*command{
+				{name: "analyze", args: "<dir>", short: "Merge a run's node reports into a run report", setup: setupReportAnalyze},
+				{name: "compare", args: "<runA> <runB>", short: "Compare two runs", setup: setupReportCompare},
+				{name: "tradeoff", args: "<sweepdir> [budget]", short: "Relate bandwidth to latency over a d/dlazy sweep", setup: setupReportTradeoff},
+			}},
+			{name: "replay", args: "<run>", short: "Run a collected run again with its configs and topology", setup: setupReplay},
+			{name: "completion", args: "bash|zsh", short: "Print a shell completion script", setup: setupCompletion},
+		},
+	}
+}
+
+// execute runs the command that args select and returns the exit code.
+func execute(root *command, args []string) int {
+	if len(args) > 0 && args[0] == "help" {
+		c, path := root.find(args[1:])
+		c.usage(os.Stdout, path)
+		return 0
+	}
+	if len(args) > 0 && args[0] == "__complete" {
+		root.complete(os.Stdout, args[1:])
+		return 0
+	}
+	c, path := root.find(args)
+	rest := args[len(path):]
+	if c.setup == nil {
+		if len(rest) > 0 && !isHelpFlag(rest[0]) {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", strings.Join(append(path, rest[0]), " "))
+			c.usage(os.Stderr, path)
+			return 2
+		}
+		c.usage(os.Stderr, path)
+		if len(rest) > 0 {
+			return 0
+		}
+		return 2
+	}
+
+	fs := flag.NewFlagSet(strings.Join(path, " "), flag.ContinueOnError)
+	fs.Usage = func() { c.usage(os.Stderr, path) }
+	run := c.setup(fs)
+	positional, err := parseInterspersed(fs, rest)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	statusCommand = strings.Join(path, " ")
+	if err != nil {
+		return printStatus(errUsage)
+	}
+	err = run(positional)
+	if err == errUsage {
+		c.usage(os.Stderr, path)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return printStatus(err)
+}
+
+func isHelpFlag(s string) bool {
+	return s == "-h" || s == "-help" || s == "--help"
+}
+
+// find walks args down the tree as far as they name subcommands.
+func (c *command) find(args []string) (*command, []string) {
+	var path []string
+	for _, a := range args {
+		next := c.sub(a)
+		if next == nil {
+			break
+		}
+		c = next
+		path = append(path, a)
+	}
+	return c, path
+}
+
+func (c *command) sub(name string) *command {
+	for _, s := range c.subs {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// parseInterspersed parses flags given before, between and after the
+// positional arguments, which flag.FlagSet stops at.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		if args[0] == "--" {
+			return append(positional, args[1:]...), nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func (c *command) usage(w io.Writer, path []string) {
+	name := strings.Join(append([]string{progName()}, path...), " ")
+	if c.setup != nil {
+		fmt.Fprintf(w, "usage: %s\n", strings.TrimSpace(name+" [flags] "+c.args))
+		if c.short != "" {
+			fmt.Fprintf(w, "\n%s.\n", c.short)
+		}
+		fs := flag.NewFlagSet(name, flag.ContinueOnError)
+		c.setup(fs)
+		if hasFlags(fs) {
+			fmt.Fprintln(w, "\nflags:")
+			fs.SetOutput(w)
+			fs.PrintDefaults()
+		}
+		return
+	}
+	fmt.Fprintf(w, "usage: %s <command> [flags] [args]\n\ncommands:\n", name)
+	var lines [][2]string
+	c.walk(nil, func(p []string, leaf *command) {
+		lines = append(lines, [2]string{strings.Join(p, " ") + " " + leaf.args, leaf.short})
+	})
+	width := 0
+	for _, l := range lines {
+		width = max(width, len(l[0]))
+	}
+	for _, l := range lines {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, l[0], l[1])
+	}
+	if len(path) == 0 {
+		fmt.Fprintf(w, "\nRun '%s help <command>' for a command's flags.\n", progName())
+	}
+}
+
+// walk calls fn with every leaf below c and its path from c.
+func (c *command) walk(path []string, fn func(path []string, leaf *command)) {
+	for _, s := range c.subs {
+		p := append(append([]string(nil), path...), s.name)
+		if s.setup != nil {
+			fn(p, s)
+		} else {
+			s.walk(p, fn)
+		}
+	}
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	n := 0
+	fs.VisitAll(func(*flag.Flag) { n++ })
+	return n > 0
+}
+
+// complete prints the words that can follow args: the subcommands of a
+// group, or the flags of a leaf unless the last word is a flag that takes a
+// value, which the shell completes as a file name instead.
+func (c *command) complete(w io.Writer, args []string) {
+	if len(args) > 0 && args[0] == "help" {
+		args = args[1:]
+	}
+	c, path := c.find(args)
+	if c.setup == nil {
+		for _, s := range c.subs {
+			fmt.Fprintln(w, s.name)
+		}
+		if len(path) == 0 {
+			fmt.Fprintln(w, "help")
+		}
+		return
+	}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	c.setup(fs)
+	if rest := args[len(path):]; len(rest) > 0 {
+		last := strings.TrimLeft(rest[len(rest)-1], "-")
+		if f := fs.Lookup(last); f != nil && !isBoolFlag(f) && !strings.Contains(last, "=") {
+			return
+		}
+	}
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, "-"+f.Name) })
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintln(w, n)
+	}
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+const bashCompletion = `# %[1]s completion for bash; for zsh, run "autoload -U +X bashcompinit && bashcompinit" first.
+_%[2]s_complete() {
+	local words
+	words=$("${COMP_WORDS[0]}" __complete "${COMP_WORDS[@]:1:COMP_CWORD-1}" 2>/dev/null)
+	COMPREPLY=($(compgen -W "$words" -- "${COMP_WORDS[COMP_CWORD]}"))
+}
+complete -o default -F _%[2]s_complete %[1]s
+`
+
+func setupCompletion(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		prog := progName()
+		fn := strings.Map(func(r rune) rune {
+			if r == '-' || r == '.' {
+				return '_'
+			}
+			return r
+		}, prog)
+		switch args[0] {
+		case "bash":
+			fmt.Printf(bashCompletion, prog, fn)
+		case "zsh":
+			fmt.Println("autoload -U +X bashcompinit && bashcompinit")
+			fmt.Printf(bashCompletion, prog, fn)
+		default:
+			return errUsage
+		}
+		return nil
+	}
+}
+
+// nodeFlags are the flags of node run.
+type nodeFlags struct {
+	port, node, lowestNode                   *int
+	peers, configPath, controlAddr, tlsCerts *string
+	reportPath, metricsDump, startAt         *string
+	metricsHistory, registry, peerNodes      *string
+	snapshotPath, restorePath, pcapPath      *string
+	unixDir, peerstoreDir, nodeRange         *string
+	experiment                               *string
+	lite                                     *bool
+	connectTimeout, publishTimeout           *time.Duration
+	nextTimeout, metricsInterval             *time.Duration
+}
+
+func addNodeFlags(fs *flag.FlagSet) *nodeFlags {
+	port := new(int)
+	fs.Var((*portValue)(port), "port", "Port to listen on, or auto for a free one")
+	return &nodeFlags{
+		port:         port,
+		node:         fs.Int("node", 0, "Node number"),
+		lowestNode:   fs.Int("lowest-node", 0, "Lowest node number of the experiment, which publishes by default and coordinates the start barrier"),
+		peers:        fs.String("peers", "", "Comma-separated list of peer addresses to connect to"),
+		registry:     fs.String("registry", "", "Append the node's port and addresses to this registry file once it listens"),
+		peerNodes:    fs.String("peer-nodes", "", "Comma-separated list of nodes to look up in the -registry and connect to"),
+		configPath:   fs.String("config", "", "Path to JSON experiment config"),
+		controlAddr:  fs.String("control", "", "Listen address for the HTTP control API (disabled if empty)"),
+		tlsCerts:     fs.String("tls-certs", "", "Serve the control API over HTTPS with this node's certificate from this experiment CA directory, for clients with a certificate from the CA"),
+		reportPath:   fs.String("report", "", "Write a JSON node report to this path on shutdown"),
+		metricsDump:  fs.String("metrics-dump", "", "Write the final metrics in Prometheus text format to this path on shutdown"),
+		startAt:      fs.String("start-at", "", "Absolute RFC3339 time at which the workload starts (overrides workload.startDelay)"),
+		snapshotPath: fs.String("snapshot", "", "Write a state snapshot to this path on shutdown and on POST /snapshot"),
+		restorePath:  fs.String("restore", "", "Restore connections, topics and seen messages from this snapshot"),
+		pcapPath:     fs.String("pcap", "", "Capture the traffic on the listen port with tcpdump into this pcap file"),
+		lite:         fs.Bool("lite", false, "Run a trimmed-down host for hundreds of nodes on one machine"),
+		unixDir:      fs.String("unix", "", "Also listen on a Unix socket in this directory and reach peers on this machine through theirs"),
+		peerstoreDir: fs.String("peerstore", "", "Keep the peerstore in a LevelDB datastore in this directory and reconnect to its peers on start"),
+		nodeRange:    fs.String("node-range", "", "Run the nodes of this range, e.g. 10-19, in one process with -report, -metrics-dump and -metrics-history as directories"),
+		experiment:   fs.String("experiment", "", "Experiment ID announced in the identify agent version (overrides the config's experiment)"),
+
+		connectTimeout:  fs.Duration("connect-timeout", timeouts.connect, "Give up dialing a peer or opening a stream to it after this long (0: never)"),
+		publishTimeout:  fs.Duration("publish-timeout", timeouts.publish, "Give up publishing a message after this long (0: never)"),
+		nextTimeout:     fs.Duration("next-timeout", timeouts.next, "Count a subscription as idle after this long without a message (0: never)"),
+		metricsHistory:  fs.String("metrics-history", "", "Sample the metrics every -metrics-interval and write them as CSV to this path on shutdown"),
+		metricsInterval: fs.Duration("metrics-interval", time.Second, "How often -metrics-history samples the metrics"),
+	}
+}
+
+// run runs the node, or the range of nodes, and only returns on errors.
+func (f *nodeFlags) run() error {
+	cfg, err := loadConfig(*f.configPath)
+	if err != nil {
+		return err
+	}
+	if err := levels.apply(cfg.Logging); err != nil {
+		return configError(err)
+	}
+	timeouts.connect, timeouts.publish, timeouts.next = *f.connectTimeout, *f.publishTimeout, *f.nextTimeout
+	if *f.metricsHistory != "" && *f.metricsInterval <= 0 {
+		return configError(fmt.Errorf("-metrics-interval must be positive"))
+	}
+	peerNodes, err := parseNodeList(*f.peerNodes)
+	if err != nil {
+		return configError(err)
+	}
+	if *f.restorePath != "" && cfg.validated() {
+		return configError(fmt.Errorf("-restore cannot be combined with topic validators"))
+	}
+	if *f.restorePath != "" && cfg.Misbehavior.applies(*f.node) && cfg.Misbehavior.validates() {
+		return configError(fmt.Errorf("-restore cannot be combined with misbehavior blackhole or tamper"))
+	}
+	if len(peerNodes) > 0 && *f.registry == "" {
+		return configError(fmt.Errorf("-peer-nodes needs a -registry"))
+	}
+	if *f.unixDir != "" && *f.port == 0 {
+		return configError(fmt.Errorf("-unix needs a fixed -port"))
+	}
+	if *f.nodeRange != "" {
+		runNodeRange(*f.nodeRange, nodeOptions{
+			port:            *f.port,
+			minNode:         *f.lowestNode,
+			peers:           *f.peers,
+			registry:        *f.registry,
+			peerNodes:       peerNodes,
+			configPath:      *f.configPath,
+			reportPath:      *f.reportPath,
+			metricsDump:     *f.metricsDump,
+			metricsHistory:  *f.metricsHistory,
+			metricsInterval: *f.metricsInterval,
+			startAt:         *f.startAt,
+			lite:            *f.lite,
+			unixDir:         *f.unixDir,
+			experiment:      *f.experiment,
+		}, *f.controlAddr != "" || *f.snapshotPath != "" || *f.restorePath != "" || *f.pcapPath != "" || *f.peerstoreDir != "")
+		return nil
+	}
+	runNode(cfg, nodeOptions{
+		port:            *f.port,
+		node:            *f.node,
+		minNode:         *f.lowestNode,
+		peers:           *f.peers,
+		registry:        *f.registry,
+		peerNodes:       peerNodes,
+		configPath:      *f.configPath,
+		controlAddr:     *f.controlAddr,
+		tlsCerts:        *f.tlsCerts,
+		reportPath:      *f.reportPath,
+		metricsDump:     *f.metricsDump,
+		metricsHistory:  *f.metricsHistory,
+		metricsInterval: *f.metricsInterval,
+		startAt:         *f.startAt,
+		snapshotPath:    *f.snapshotPath,
+		restorePath:     *f.restorePath,
+		pcapPath:        *f.pcapPath,
+		lite:            *f.lite,
+		unixDir:         *f.unixDir,
+		peerstoreDir:    *f.peerstoreDir,
+		experiment:      *f.experiment,
+		process:         true,
+		exit:            func(host.Host) { exit(nil) },
+	})
+	return nil
+}
+
+func setupNodeRun(fs *flag.FlagSet) func([]string) error {
+	f := addNodeFlags(fs)
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		return f.run()
+	}
+}
+
+func setupNodeDelays(fs *flag.FlagSet) func([]string) error {
+	configPath := fs.String("config", "", "Path to JSON experiment config with a regions block")
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		return printDelays(cfg, args[0])
+	}
+}
+
+func setupKeysGenerate(fs *flag.FlagSet) func([]string) error {
+	maxNode := fs.Int("max-node", 0, "Highest node number to create an identity for")
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		return generateKeys(*maxNode)
+	}
+}
+
+func setupKeysCA(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) < 1 {
+			return errUsage
+		}
+		return issueCerts(args[0], args[1:])
+	}
+}
+
+// addAssertFlag registers -assert for the commands that build a run report.
+func addAssertFlag(fs *flag.FlagSet) func() ([]assertion, error) {
+	spec := fs.String("assert", "", "Fail unless the run meets these limits, e.g. coverage=99.5,p99=800ms")
+	return func() ([]assertion, error) {
+		checks, err := parseAssertions(*spec)
+		return checks, configError(err)
+	}
+}
+
+func setupClusterRun(fs *flag.FlagSet) func([]string) error {
+	checks := addAssertFlag(fs)
+	resultsDir := fs.String("results-dir", "", "Collect the run into a new directory here and archive it as .tar.gz")
+	topologyFile := fs.String("topology-file", "", "Dial the graph of this topology.json from an earlier run instead of generating one")
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		c, err := checks()
+		if err != nil {
+			return err
+		}
+		return runCluster(args[0], c, *resultsDir, *topologyFile)
+	}
+}
+
+func setupBench(fs *flag.FlagSet) func([]string) error {
+	configPath := fs.String("config", "", "Base experiment config of every scenario")
+	return func(args []string) error {
+		if len(args) < 1 || len(args) > 2 {
+			return errUsage
+		}
+		outDir := ""
+		if len(args) == 2 {
+			outDir = args[1]
+		}
+		return runBench(args[0], outDir, *configPath)
+	}
+}
+
+func setupReportAnalyze(fs *flag.FlagSet) func([]string) error {
+	checks := addAssertFlag(fs)
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		c, err := checks()
+		if err != nil {
+			return err
+		}
+		return analyzeRun(args[0], c)
+	}
+}
+
+func setupReportCompare(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		return compareRuns(args[0], args[1])
+	}
+}
+
+func setupReportTradeoff(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) < 1 || len(args) > 2 {
+			return errUsage
+		}
+		spec := ""
+		if len(args) == 2 {
+			spec = args[1]
+		}
+		budget, err := parseAssertions(spec)
+		if err != nil {
+			return err
+		}
+		return analyzeTradeoff(args[0], budget)
+	}
+}
+
+func setupReplay(fs *flag.FlagSet) func([]string) error {
+	checks := addAssertFlag(fs)
+	resultsDir := fs.String("results-dir", "", "Collect the replay into a new directory here (default: next to the run)")
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		c, err := checks()
+		if err != nil {
+			return err
+		}
+		return replayRun(args[0], c, *resultsDir)
+	}
+}
+
+// legacyMain runs the flat flag set that predates the subcommands, which
+// older scripts still use.
+func legacyMain() {
+	fs := flag.CommandLine
+	f := addNodeFlags(fs)
+	fs.IntVar(f.lowestNode, "minnode", 0, "Deprecated: -lowest-node")
+	generate := fs.Bool("generate", false, "Deprecated: keys generate")
+	analyzeDir := fs.String("analyze", "", "Deprecated: report analyze")
+	clusterPath := fs.String("cluster", "", "Deprecated: cluster run")
+	resultsDir := fs.String("results-dir", "", "Deprecated: cluster run -results-dir")
+	topologyPath := fs.String("topology-file", "", "Deprecated: cluster run -topology-file")
+	assertSpec := fs.String("assert", "", "Deprecated: report analyze -assert, cluster run -assert")
+	delayNodes := fs.String("delays", "", "Deprecated: node delays")
+	fs.Usage = func() {
+		rootCommand().usage(os.Stderr, nil)
+	}
+	fs.Parse(os.Args[1:])
+	nodeLog.Warnf("Flags without a command are deprecated; run '%s help'", progName())
+
+	var args []string
+	switch {
+	case fs.NArg() > 0:
+		// compare, tradeoff, ca and bench took -config before them.
+		args = fs.Args()
+		if args[0] == "ca" {
+			args = append([]string{"keys"}, args...)
+		} else if args[0] == "compare" || args[0] == "tradeoff" {
+			args = append([]string{"report"}, args...)
+		} else if args[0] == "bench" {
+			args = append([]string{"bench", "-config", *f.configPath}, args[1:]...)
+		}
+	case *generate:
+		args = []string{"keys", "generate", "-max-node", strconv.Itoa(*f.node)}
+	case *analyzeDir != "":
+		args = []string{"report", "analyze", "-assert", *assertSpec, *analyzeDir}
+	case *clusterPath != "":
+		args = []string{"cluster", "run", "-assert", *assertSpec, "-results-dir", *resultsDir, "-topology-file", *topologyPath, *clusterPath}
+	case *delayNodes != "":
+		args = []string{"node", "delays", "-config", *f.configPath, *delayNodes}
+	default:
+		statusCommand = "node run"
+		if err := f.run(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(printStatus(err))
+		}
+		return
+	}
+	os.Exit(execute(rootCommand(), args))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// runStats are the figures of one run that compareRuns puts side by side.
+type runStats struct {
+	dir       string
+	delivery  deliverySummary
+	latencies []float64
+	// duplication is the number of duplicate receptions per delivered
+	// message, bytesPerMsg the pubsub RPC bytes sent per delivered message.
+	duplication float64
+	sentBytes   float64
+	bytesPerMsg float64
+}
+
+func loadRunStats(dir string) (*runStats, error) {
+	reports, err := loadNodeReports(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(reports) == 0 {
+		return nil, fmt.Errorf("no node reports found in %s", dir)
+	}
+	return newRunStats(dir, reports), nil
+}
+
+func newRunStats(dir string, reports []nodeReport) *runStats {
+	rs := &runStats{dir: dir, delivery: analyzeDelivery(reports)}
+	_, rs.latencies = firstDeliveries(reports)
+	sort.Float64s(rs.latencies)
+
+	var delivered, duplicates float64
+	for _, rep := range reports {
+		delivered += sumMetric(rep.Metrics, "messages_delivered_total")
+		duplicates += sumMetric(rep.Metrics, "messages_duplicate_total")
+		rs.sentBytes += sumMetric(rep.Metrics, "rpc_sent_bytes_total")
+	}
+	if delivered > 0 {
+		rs.duplication = duplicates / delivered
+		rs.bytesPerMsg = rs.sentBytes / delivered
+	}
+	return rs
+}
+
+// sumMetric adds up a metric over all its label combinations.
+func sumMetric(m map[string]float64, name string) float64 {
+	var sum float64
+	for k, v := range m {
+		if k == name || strings.HasPrefix(k, name+"{") {
+			sum += v
+		}
+	}
+	return sum
+}
+
+// mannWhitneyP is the two-sided p-value of the Mann-Whitney U test under
+// the normal approximation, telling whether two latency samples plausibly
+// come from the same distribution. Both samples must be sorted.
+func mannWhitneyP(a, b []float64) float64 {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+	// Rank the merged samples, giving ties their average rank.
+	var rankSumA float64
+	i, j := 0, 0
+	rank := 1.0
+	for i < len(a) || j < len(b) {
+		var v float64
+		if j >= len(b) || (i < len(a) && a[i] <= b[j]) {
+			v = a[i]
+		} else {
+			v = b[j]
+		}
+		ca, cb := 0, 0
+		for i < len(a) && a[i] == v {
+			i++
+			ca++
+		}
+		for j < len(b) && b[j] == v {
+			j++
+			cb++
+		}
+		t := float64(ca + cb)
+		rankSumA += float64(ca) * (rank + (t-1)/2)
+		rank += t
+	}
+	u := rankSumA - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	sd := math.Sqrt(n1 * n2 * (n1 + n2 + 1) / 12)
+	if sd == 0 {
+		return 1
+	}
+	z := (u - mean) / sd
+	return math.Erfc(math.Abs(z) / math.Sqrt2)
+}
+
+// proportionP is the two-sided p-value of the two-proportion z-test.
+func proportionP(x1, n1, x2, n2 int) float64 {
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+	p1, p2 := float64(x1)/float64(n1), float64(x2)/float64(n2)
+	p := float64(x1+x2) / float64(n1+n2)
+	sd := math.Sqrt(p * (1 - p) * (1/float64(n1) + 1/float64(n2)))
+	if sd == 0 {
+		return 1
+	}
+	z := (p1 - p2) / sd
+	return math.Erfc(math.Abs(z) / math.Sqrt2)
+}
+
+// significance turns a p-value into the hint printed next to a change.
+func significance(p float64) string {
+	switch {
+	case p < 0.01:
+		return "significant"
+	case p < 0.05:
+		return "likely"
+	default:
+		return "noise?"
+	}
+}
+
+// compareRuns prints how the run in dirB differs from the run in dirA,
+// marking each change as an improvement or a regression. Coverage and
+// latency changes carry a hint from a statistical test; the other figures
+// are flagged as possible noise below a 5% relative change.
+func compareRuns(dirA, dirB string) error {
+	a, err := loadRunStats(dirA)
+	if err != nil {
+		return err
+	}
+	b, err := loadRunStats(dirB)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Comparing %s (A) with %s (B)\n", a.dir, b.dir)
+	fmt.Printf("%-22s %12s %12s %10s  %s\n", "metric", "A", "B", "change", "verdict")
+
+	row := func(name string, va, vb float64, lowerIsBetter bool, hint string) {
+		change := "n/a"
+		if va != 0 {
+			change = fmt.Sprintf("%+.1f%%", (vb-va)/va*100)
+		}
+		verdict := "unchanged"
+		if vb != va {
+			if (vb < va) == lowerIsBetter {
+				verdict = "improvement"
+			} else {
+				verdict = "regression"
+			}
+		}
+		if hint == "" && va != 0 && math.Abs(vb-va)/math.Abs(va) < 0.05 {
+			hint = "noise?"
+		}
+		if hint != "" && verdict != "unchanged" {
+			verdict += " (" + hint + ")"
+		}
+		fmt.Printf("%-22s %12.2f %12.2f %10s  %s\n", name, va, vb, change, verdict)
+	}
+
+	cov := significance(proportionP(a.delivery.Delivered, a.delivery.Expected, b.delivery.Delivered, b.delivery.Expected))
+	row("coverage %", a.delivery.Coverage*100, b.delivery.Coverage*100, false, cov)
+	lat := significance(mannWhitneyP(a.latencies, b.latencies))
+	row("latency p50 ms", a.delivery.P50Ms, b.delivery.P50Ms, true, lat)
+	row("latency p90 ms", a.delivery.P90Ms, b.delivery.P90Ms, true, lat)
+	row("latency p99 ms", a.delivery.P99Ms, b.delivery.P99Ms, true, lat)
+	row("latency max ms", a.delivery.MaxMs, b.delivery.MaxMs, true, "")
+	row("duplicates/msg", a.duplication, b.duplication, true, "")
+	row("sent bytes/msg", a.bytesPerMsg, b.bytesPerMsg, true, "")
+	row("sent MiB total", a.sentBytes/(1<<20), b.sentBytes/(1<<20), true, "")
+	fmt.Printf("Latency distributions: Mann-Whitney p=%.4f over %d and %d deliveries\n",
+		mannWhitneyP(a.latencies, b.latencies), len(a.latencies), len(b.latencies))
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config is the optional JSON experiment configuration passed with -config.
+type Config struct {
+	Blacklist        BlacklistConfig        `json:"blacklist"`
+	GossipSub        GossipSubConfig        `json:"gossipsub"`
+	Validation       ValidationConfig       `json:"validation"`
+	PeerRecords      PeerRecordConfig       `json:"peerRecords"`
+	Inspector        *InspectorConfig       `json:"inspector"`
+	Protocols        []ProtocolConfig       `json:"protocols"`
+	Listen           []ListenConfig         `json:"listen"`
+	Roles            []RoleConfig           `json:"roles"`
+	ScoreThresholds  *ScoreThresholdsConfig `json:"scoreThresholds"`
+	Lanes            []LaneConfig           `json:"lanes"`
+	Topics           []TopicConfig          `json:"topics"`
+	Workload         WorkloadConfig         `json:"workload"`
+	Barrier          *BarrierConfig         `json:"barrier"`
+	Churn            *ChurnConfig           `json:"churn"`
+	History          *HistoryConfig         `json:"history"`
+	Store            *StoreConfig           `json:"store"`
+	Sampling         *SamplingConfig        `json:"sampling"`
+	Ready            *ReadyConfig           `json:"ready"`
+	Misbehavior      *MisbehaviorConfig     `json:"misbehavior"`
+	ScorePruning     *ScorePruningConfig    `json:"scorePruning"`
+	Labels           []NodeLabelConfig      `json:"labels"`
+	Regions          *RegionConfig          `json:"regions"`
+	Logging          LoggingConfig          `json:"logging"`
+	ResourceInterval duration               `json:"resourceInterval"`
+	// Experiment identifies the experiment in the nodes' identify agent
+	// version.
+	Experiment string `json:"experiment"`
+}
+
+type BlacklistConfig struct {
+	Peers   []string `json:"peers"`
+	Subnets []string `json:"subnets"`
+}
+
+// loadConfig reads the experiment config at path; its errors are config
+// errors.
+func loadConfig(path string) (*Config, error) {
+	cfg, err := readConfig(path)
+	return cfg, configError(err)
+}
+
+func readConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.GossipSub.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if cfg.Inspector != nil {
+		if err := cfg.Inspector.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if cfg.Store != nil {
+		if err := cfg.Store.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if cfg.Ready != nil {
+		if err := cfg.Ready.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if cfg.Sampling != nil {
+		if err := cfg.Sampling.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if cfg.ScoreThresholds != nil {
+		if err := cfg.ScoreThresholds.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if cfg.ScorePruning != nil {
+		if err := cfg.ScorePruning.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if !cfg.scored() {
+			return nil, fmt.Errorf("%s: scorePruning needs a topic with a score block", path)
+		}
+	}
+	if m := cfg.Misbehavior; m != nil && m.Tamper != nil && m.Blackhole {
+		return nil, fmt.Errorf("%s: misbehavior tamper relays what blackhole drops", path)
+	}
+	if cfg.Misbehavior.validates() && cfg.validated() {
+		return nil, fmt.Errorf("%s: misbehavior blackhole and tamper cannot be combined with topic validators", path)
+	}
+	for _, tc := range cfg.topics() {
+		if tc.SLA == nil {
+			continue
+		}
+		if err := tc.SLA.validate(tc.Name); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, p := range cfg.Protocols {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, l := range cfg.Listen {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, r := range cfg.Roles {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if cfg.Workload.Size < 0 {
+		return nil, fmt.Errorf("%s: workload: negative size %d", path, cfg.Workload.Size)
+	}
+	if cfg.Workload.Payload != nil {
+		if err := cfg.Workload.Payload.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if cfg.Workload.Timing != nil {
+		if err := cfg.Workload.Timing.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if cfg.Workload.Profile != nil {
+		if err := cfg.Workload.Profile.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if cfg.Workload.Adaptive != nil {
+		if cfg.Workload.Profile != nil || cfg.Workload.Timing != nil {
+			return nil, fmt.Errorf("%s: workload adaptive replaces profile and timing", path)
+		}
+		if err := cfg.Workload.Adaptive.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// duration accepts Go duration strings ("500ms", "1m") in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
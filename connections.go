@@ -0,0 +1,200 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	lpevent "github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// connEvent is one entry of a node's connection timeline: "connected",
+// "limited" or "disconnected" when its connectedness to a peer changes,
+// "identified" or "identify_failed" when identify with it ends.
+type connEvent struct {
+	Time  int64  `json:"time"`
+	Peer  string `json:"peer"`
+	Event string `json:"event"`
+	Error string `json:"error,omitempty"`
+}
+
+func (r *recorder) addConnEvent(e connEvent) {
+	r.mu.Lock()
+	r.connections = append(r.connections, e)
+	r.mu.Unlock()
+}
+
+// watchConnections records the connection timeline from the host's event
+// bus.
+func watchConnections(h host.Host, rec *recorder) error {
+	sub, err := h.EventBus().Subscribe([]interface{}{
+		new(lpevent.EvtPeerConnectednessChanged),
+		new(lpevent.EvtPeerIdentificationCompleted),
+		new(lpevent.EvtPeerIdentificationFailed),
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for e := range sub.Out() {
+			ce := connEvent{Time: time.Now().UnixNano()}
+			switch evt := e.(type) {
+			case lpevent.EvtPeerConnectednessChanged:
+				ce.Peer = evt.Peer.String()
+				switch evt.Connectedness {
+				case network.Connected:
+					ce.Event = "connected"
+				case network.Limited:
+					ce.Event = "limited"
+				default:
+					ce.Event = "disconnected"
+				}
+			case lpevent.EvtPeerIdentificationCompleted:
+				ce.Peer, ce.Event = evt.Peer.String(), "identified"
+			case lpevent.EvtPeerIdentificationFailed:
+				ce.Peer, ce.Event = evt.Peer.String(), "identify_failed"
+				if evt.Reason != nil {
+					ce.Error = evt.Reason.Error()
+				}
+			}
+			rec.addConnEvent(ce)
+			stats.inc(metricName("connection_events_total", "event", ce.Event), 1)
+		}
+	}()
+	return nil
+}
+
+// connectionSummary relates a node's delivery gaps to its connection
+// timeline. DisconnectedMs is the time some peer it had been connected to
+// was away, IsolatedMs the time it had no peer at all after its first
+// connection. Missed counts the messages published by others that never
+// reached it and MissedDisconnected those of them sent while a peer was
+// away.
+type connectionSummary struct {
+	Node               int     `json:"node"`
+	Disconnects        int     `json:"disconnects"`
+	DisconnectedMs     float64 `json:"disconnectedMs"`
+	IsolatedMs         float64 `json:"isolatedMs"`
+	Missed             int     `json:"missed"`
+	MissedDisconnected int     `json:"missedDisconnected"`
+}
+
+type timeWindow struct{ from, to int64 }
+
+func (w timeWindow) contains(t int64) bool {
+	return t >= w.from && t < w.to
+}
+
+// connectionWindows turns a timeline into the windows in which some peer
+// was away and no peer was connected, ending open ones at end.
+func connectionWindows(events []connEvent, end int64) (away, isolated []timeWindow, disconnects int) {
+	up := make(map[string]bool)
+	downSince := make(map[string]int64)
+	connected := 0
+	var everConnected bool
+	var isolatedSince int64
+	for _, e := range events {
+		switch e.Event {
+		case "connected", "limited":
+			if up[e.Peer] {
+				continue
+			}
+			up[e.Peer] = true
+			if since, ok := downSince[e.Peer]; ok {
+				away = append(away, timeWindow{since, e.Time})
+				delete(downSince, e.Peer)
+			}
+			if connected == 0 && everConnected {
+				isolated = append(isolated, timeWindow{isolatedSince, e.Time})
+			}
+			connected++
+			everConnected = true
+		case "disconnected":
+			if !up[e.Peer] {
+				continue
+			}
+			up[e.Peer] = false
+			downSince[e.Peer] = e.Time
+			disconnects++
+			connected--
+			if connected == 0 {
+				isolatedSince = e.Time
+			}
+		}
+	}
+	for _, since := range downSince {
+		away = append(away, timeWindow{since, end})
+	}
+	if connected == 0 && everConnected {
+		isolated = append(isolated, timeWindow{isolatedSince, end})
+	}
+	return away, isolated, disconnects
+}
+
+// windowsMs is the length of the union of windows in milliseconds.
+func windowsMs(ws []timeWindow) float64 {
+	sort.Slice(ws, func(i, j int) bool { return ws[i].from < ws[j].from })
+	var total, reach int64
+	for _, w := range ws {
+		if w.from > reach {
+			reach = w.from
+		}
+		if w.to > reach {
+			total += w.to - reach
+			reach = w.to
+		}
+	}
+	return float64(total) / 1e6
+}
+
+func analyzeConnections(reports []nodeReport) []connectionSummary {
+	type sent struct {
+		key    messageKey
+		sentAt int64
+	}
+	var published []sent
+	for _, rep := range reports {
+		for _, p := range rep.Published {
+			published = append(published, sent{messageKey{p.Topic, rep.Node, p.Seq}, p.SentAt})
+		}
+	}
+	var out []connectionSummary
+	for _, rep := range reports {
+		if len(rep.Connections) == 0 {
+			continue
+		}
+		end := rep.Connections[len(rep.Connections)-1].Time
+		for _, rr := range rep.Received {
+			if rr.ReceivedAt > end {
+				end = rr.ReceivedAt
+			}
+		}
+		away, isolated, disconnects := connectionWindows(rep.Connections, end)
+		sum := connectionSummary{
+			Node:           rep.Node,
+			Disconnects:    disconnects,
+			DisconnectedMs: windowsMs(away),
+			IsolatedMs:     windowsMs(isolated),
+		}
+		got := make(map[messageKey]bool)
+		for _, rr := range rep.Received {
+			got[messageKey{rr.Topic, rr.Publisher, rr.Seq}] = true
+		}
+		for _, p := range published {
+			if p.key.publisher == rep.Node || got[p.key] {
+				continue
+			}
+			sum.Missed++
+			for _, w := range away {
+				if w.contains(p.sentAt) {
+					sum.MissedDisconnected++
+					break
+				}
+			}
+		}
+		out = append(out, sum)
+	}
+	return out
+}
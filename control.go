@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// controlServer is the HTTP API used by experiments to drive a running node.
+type controlServer struct {
+	mux *http.ServeMux
+}
+
+func newControlServer() *controlServer {
+	return &controlServer{mux: http.NewServeMux()}
+}
+
+// serve listens on addr, over HTTPS if tlsConfig is set, and serves the
+// API in the background.
+func (c *controlServer) serve(addr string, tlsConfig *tls.Config) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("control API: %v", err)
+	}
+	srv := &http.Server{Handler: c.mux, TLSConfig: tlsConfig}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil {
+			controlLog.Warnf("Control API stopped: %v", err)
+		}
+	}()
+	if tlsConfig != nil {
+		controlLog.Infof("Control API listening on %s with TLS", addr)
+		return nil
+	}
+	controlLog.Infof("Control API listening on %s", addr)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (c *controlServer) registerBlacklist(b *blacklist) {
+	c.mux.HandleFunc("GET /blacklist", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, b.list())
+	})
+	c.mux.HandleFunc("POST /blacklist/peer", func(w http.ResponseWriter, r *http.Request) {
+		if err := b.blockPeer(r.URL.Query().Get("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, b.list())
+	})
+	c.mux.HandleFunc("DELETE /blacklist/peer", func(w http.ResponseWriter, r *http.Request) {
+		if err := b.unblockPeer(r.URL.Query().Get("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, b.list())
+	})
+	c.mux.HandleFunc("POST /blacklist/subnet", func(w http.ResponseWriter, r *http.Request) {
+		if err := b.blockSubnet(r.URL.Query().Get("cidr")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, b.list())
+	})
+	c.mux.HandleFunc("DELETE /blacklist/subnet", func(w http.ResponseWriter, r *http.Request) {
+		if err := b.unblockSubnet(r.URL.Query().Get("cidr")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, b.list())
+	})
+}
+
+// registerLogging exposes the log levels; PUT /log?level=debug changes the
+// default and PUT /log?component=pubsub&level=debug a single component.
+func (c *controlServer) registerLogging() {
+	c.mux.HandleFunc("GET /log", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, levels.config())
+	})
+	c.mux.HandleFunc("PUT /log", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if err := levels.set(q.Get("component"), q.Get("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		controlLog.Infof("Log level of %q set to %s", q.Get("component"), q.Get("level"))
+		writeJSON(w, levels.config())
+	})
+	c.mux.HandleFunc("PUT /log/libp2p", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if err := libp2pLevels.set(q.Get("subsystem"), q.Get("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		controlLog.Infof("libp2p log level of %q set to %s", q.Get("subsystem"), q.Get("level"))
+		writeJSON(w, levels.config())
+	})
+}
+
+// registerSnapshot serves the node's current state; POST writes it to
+// ?path=, or to the -snapshot path if none is given.
+func (c *controlServer) registerSnapshot(s *snapshotter, defaultPath string) {
+	c.mux.HandleFunc("GET /snapshot", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.take())
+	})
+	c.mux.HandleFunc("POST /snapshot", func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			path = defaultPath
+		}
+		if path == "" {
+			http.Error(w, "no snapshot path", http.StatusBadRequest)
+			return
+		}
+		if err := s.write(path); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]string{"path": path})
+	})
+}
+
+// registerPeers lists the connected peers with the node metadata of their
+// identify agent version.
+func (c *controlServer) registerPeers(h host.Host) {
+	c.mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, listPeers(h))
+	})
+}
+
+func (c *controlServer) registerMetrics() {
+	c.mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stats.writePrometheus(w)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// processStart is when the node process started, the origin of its
+// convergence times.
+var processStart = time.Now()
+
+// meshFullRecord is when a topic's mesh first held D peers, or all the
+// topic's peers if there are fewer.
+type meshFullRecord struct {
+	Topic string `json:"topic"`
+	At    int64  `json:"at"`
+	Size  int    `json:"size"`
+}
+
+// convergenceMonitor follows the node's meshes from the tracer's GRAFTs and
+// PRUNEs until every subscribed topic's mesh is full.
+type convergenceMonitor struct {
+	d int
+
+	mu   sync.Mutex
+	mesh map[string]map[peer.ID]bool
+	full []meshFullRecord
+	done chan struct{}
+}
+
+func newConvergenceMonitor(d int) *convergenceMonitor {
+	return &convergenceMonitor{d: d, mesh: make(map[string]map[peer.ID]bool), done: make(chan struct{})}
+}
+
+func (m *convergenceMonitor) graft(p peer.ID, topic string) {
+	m.mu.Lock()
+	if m.mesh[topic] == nil {
+		m.mesh[topic] = make(map[peer.ID]bool)
+	}
+	m.mesh[topic][p] = true
+	m.mu.Unlock()
+}
+
+func (m *convergenceMonitor) prune(p peer.ID, topic string) {
+	m.mu.Lock()
+	delete(m.mesh[topic], p)
+	m.mu.Unlock()
+}
+
+// run polls the topics' peers, which the router cannot be asked for from
+// within its tracer, until every mesh is full.
+func (m *convergenceMonitor) run(ps *pubsub.PubSub, nodeNum int, topics []string) {
+	if len(topics) == 0 {
+		return
+	}
+	pending := append([]string(nil), topics...)
+	for len(pending) > 0 {
+		var rest []string
+		for _, t := range pending {
+			peers := len(ps.ListPeers(t))
+			m.mu.Lock()
+			size := len(m.mesh[t])
+			m.mu.Unlock()
+			if peers == 0 || size < min(m.d, peers) {
+				rest = append(rest, t)
+				continue
+			}
+			took := time.Since(processStart)
+			m.mu.Lock()
+			m.full = append(m.full, meshFullRecord{Topic: t, At: time.Now().UnixNano(), Size: size})
+			m.mu.Unlock()
+			stats.set(metricName("mesh_full_seconds", "topic", t), took.Seconds())
+			emitEvent("mesh_full", map[string]interface{}{"topic": t, "size": size, "seconds": took.Seconds()})
+			pubsubLog.Infof("Node %d mesh on %s full with %d peers %s after start", nodeNum, t, size, took.Round(time.Millisecond))
+		}
+		pending = rest
+		if len(pending) > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	close(m.done)
+}
+
+// waitFull returns when every mesh is full, or at deadline if that comes
+// first.
+func (m *convergenceMonitor) waitFull(deadline time.Time) time.Time {
+	select {
+	case <-m.done:
+		return time.Now()
+	case <-time.After(time.Until(deadline)):
+		return deadline
+	}
+}
+
+func (m *convergenceMonitor) records() []meshFullRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]meshFullRecord(nil), m.full...)
+}
+
+// nodeConvergence is how long a node took from process start until all its
+// meshes were full and until it received its first message; zero if it
+// never did.
+type nodeConvergence struct {
+	Node            int     `json:"node"`
+	MeshFullMs      float64 `json:"meshFullMs,omitempty"`
+	FirstDeliveryMs float64 `json:"firstDeliveryMs,omitempty"`
+}
+
+// convergenceSummary aggregates the nodes' convergence. AllDeliveredMs is
+// the time from the first process start until the first message had reached
+// every node but its publisher.
+type convergenceSummary struct {
+	Nodes          []nodeConvergence `json:"nodes"`
+	MeshFullNodes  int               `json:"meshFullNodes"`
+	MeshFullP50Ms  float64           `json:"meshFullP50Ms"`
+	MeshFullMaxMs  float64           `json:"meshFullMaxMs"`
+	AllDeliveredMs float64           `json:"allDeliveredMs,omitempty"`
+}
+
+func analyzeConvergence(reports []nodeReport) *convergenceSummary {
+	var sum convergenceSummary
+	var firstStart int64 = math.MaxInt64
+	var meshFull []float64
+	for _, rep := range reports {
+		if rep.StartedAt == 0 {
+			continue
+		}
+		if rep.StartedAt < firstStart {
+			firstStart = rep.StartedAt
+		}
+		nc := nodeConvergence{Node: rep.Node}
+		for _, f := range rep.MeshFull {
+			if ms := float64(f.At-rep.StartedAt) / 1e6; ms > nc.MeshFullMs {
+				nc.MeshFullMs = ms
+			}
+		}
+		if nc.MeshFullMs > 0 {
+			meshFull = append(meshFull, nc.MeshFullMs)
+		}
+		for _, rr := range rep.Received {
+			ms := float64(rr.ReceivedAt-rep.StartedAt) / 1e6
+			if nc.FirstDeliveryMs == 0 || ms < nc.FirstDeliveryMs {
+				nc.FirstDeliveryMs = ms
+			}
+		}
+		sum.Nodes = append(sum.Nodes, nc)
+	}
+	if len(sum.Nodes) == 0 {
+		return nil
+	}
+	sort.Float64s(meshFull)
+	sum.MeshFullNodes = len(meshFull)
+	sum.MeshFullP50Ms = percentile(meshFull, 50)
+	sum.MeshFullMaxMs = percentile(meshFull, 100)
+
+	// A message reached everyone at its latest first delivery, if every
+	// node that delivers messages got it.
+	type arrival struct {
+		nodes  int
+		latest int64
+	}
+	arrivals := make(map[messageKey]*arrival)
+	for _, rep := range reports {
+		seen := make(map[messageKey]bool)
+		for _, rr := range rep.Received {
+			k := messageKey{rr.Topic, rr.Publisher, rr.Seq}
+			if seen[k] || rr.Publisher == rep.Node {
+				continue
+			}
+			seen[k] = true
+			a := arrivals[k]
+			if a == nil {
+				a = &arrival{}
+				arrivals[k] = a
+			}
+			a.nodes++
+			if rr.ReceivedAt > a.latest {
+				a.latest = rr.ReceivedAt
+			}
+		}
+	}
+	var first int64
+	receivers := expectedDeliveries(reports)
+	for k, a := range arrivals {
+		if a.nodes == receivers(k.publisher) && (first == 0 || a.latest < first) {
+			first = a.latest
+		}
+	}
+	if first > 0 {
+		sum.AllDeliveredMs = float64(first-firstStart) / 1e6
+	}
+	return &sum
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// TestDualStackGossip runs nodes 1-2 on both loopback families, bridging the
+// IPv4-only nodes 3-4 and the IPv6-only nodes 5-6, and checks that messages
+// published on either side reach every other node.
+func TestDualStackGossip(t *testing.T) {
+	const nodes = 6
+	cfg := &Config{Listen: []ListenConfig{
+		{Nodes: nodeRange(1, 2), Addrs: []string{"/ip4/127.0.0.1/tcp/{port}", "/ip6/::1/tcp/{port}"}},
+		{Nodes: nodeRange(3, 4), Addrs: []string{"/ip4/127.0.0.1/tcp/{port}"}},
+		{Nodes: nodeRange(5, 6), Addrs: []string{"/ip6/::1/tcp/{port}"}},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	hosts := make(map[int]host.Host)
+	subs := make(map[int]*pubsub.Subscription)
+	topics := make(map[int]*pubsub.Topic)
+	for n := 1; n <= nodes; n++ {
+		h, err := libp2p.New(libp2p.ListenAddrStrings(cfg.listenAddrs(n, 0)...))
+		if err != nil {
+			t.Fatalf("node %d: %v", n, err)
+		}
+		defer h.Close()
+		hosts[n] = h
+		ps, err := pubsub.NewGossipSub(ctx, h, pubsub.GOSSIPSUB)
+		if err != nil {
+			t.Fatalf("node %d: %v", n, err)
+		}
+		if topics[n], err = ps.Join(topicName); err != nil {
+			t.Fatalf("node %d: %v", n, err)
+		}
+		if subs[n], err = topics[n].Subscribe(); err != nil {
+			t.Fatalf("node %d: %v", n, err)
+		}
+	}
+
+	// Every node dials the bridges on the family it shares with them.
+	for n := 2; n <= nodes; n++ {
+		for b := 1; b <= 2 && b < n; b++ {
+			family := ma.P_IP6
+			if ip4, _ := cfg.listenFamilies(n); ip4 {
+				family = ma.P_IP4
+			}
+			pi := peer.AddrInfo{ID: hosts[b].ID()}
+			for _, a := range hosts[b].Addrs() {
+				if a.Protocols()[0].Code == family {
+					pi.Addrs = append(pi.Addrs, a)
+				}
+			}
+			if err := hosts[n].Connect(ctx, pi); err != nil {
+				t.Fatalf("node %d to bridge %d: %v", n, b, err)
+			}
+		}
+	}
+	for n := 3; n <= 4; n++ {
+		for m := 5; m <= 6; m++ {
+			if len(hosts[n].Network().ConnsToPeer(hosts[m].ID())) > 0 {
+				t.Fatalf("IPv4-only node %d is connected to IPv6-only node %d", n, m)
+			}
+		}
+	}
+
+	// Let the meshes form before publishing.
+	time.Sleep(2 * time.Second)
+	publishers := []int{3, 5}
+	for _, p := range publishers {
+		data := encodeMessage(msgHeader{Publisher: p, Seq: 1, SentAt: time.Now()}, []byte(fmt.Sprintf("from node %d", p)))
+		if err := topics[p].Publish(ctx, data); err != nil {
+			t.Fatalf("node %d publishing: %v", p, err)
+		}
+	}
+
+	for n := 1; n <= nodes; n++ {
+		got := make(map[int]bool)
+		for len(got) < len(publishers) {
+			msg, err := subs[n].Next(ctx)
+			if err != nil {
+				t.Fatalf("node %d received from %v only: %v", n, got, err)
+			}
+			hdr, _, err := decodeMessage(msg.Data)
+			if err != nil {
+				t.Fatalf("node %d: %v", n, err)
+			}
+			got[hdr.Publisher] = true
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// event is a structured occurrence worth correlating with deliveries, such
+// as a protocol violation. Events are logged as they happen and included in
+// the node report.
+type event struct {
+	Time   int64                  `json:"time"`
+	Type   string                 `json:"type"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+type eventLog struct {
+	mu     sync.Mutex
+	events []event
+}
+
+var events = &eventLog{}
+
+func emitEvent(typ string, fields map[string]interface{}) {
+	e := event{Time: time.Now().UnixNano(), Type: typ, Fields: fields}
+	events.mu.Lock()
+	events.events = append(events.events, e)
+	events.mu.Unlock()
+	stats.inc(metricName("events_total", "type", typ), 1)
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	eventsLog.Infof("EVENT %s", data)
+}
+
+func (l *eventLog) snapshot() []event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]event(nil), l.events...)
+}
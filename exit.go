@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Exit codes, so that the cluster coordinator and CI can tell why a command
+// failed. Errors without a class exit with exitFailure.
+const (
+	exitOK        = 0
+	exitFailure   = 1
+	exitUsage     = 2
+	exitConfig    = 3 // a flag, config file or input it names is invalid
+	exitBind      = 4 // the node could not listen on its addresses
+	exitBootstrap = 5 // the node reached none of its peers
+	exitAssertion = 6 // the run report failed an -assert limit
+)
+
+var exitStatusNames = map[int]string{
+	exitOK:        "ok",
+	exitFailure:   "error",
+	exitUsage:     "usage",
+	exitConfig:    "config",
+	exitBind:      "bind",
+	exitBootstrap: "bootstrap",
+	exitAssertion: "assertion",
+}
+
+// exitError is an error with the exit code it ends the command with.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func classify(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return err
+	}
+	return &exitError{code, err}
+}
+
+func configError(err error) error    { return classify(exitConfig, err) }
+func bindError(err error) error      { return classify(exitBind, err) }
+func bootstrapError(err error) error { return classify(exitBootstrap, err) }
+func assertionError(err error) error { return classify(exitAssertion, err) }
+
+// exitCode is the code a command that returned err exits with.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if err == errUsage {
+		return exitUsage
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitFailure
+}
+
+// exitStatus is the line a command prints on stderr when it ends, e.g.
+// STATUS {"command":"node run","status":"bind","code":4,"error":"..."}.
+type exitStatus struct {
+	Command string `json:"command"`
+	Status  string `json:"status"`
+	Code    int    `json:"code"`
+	Error   string `json:"error,omitempty"`
+}
+
+// statusCommand is the command the process runs, set by execute.
+var statusCommand string
+
+// printStatus prints the final status of a command that returned err and
+// returns its exit code.
+func printStatus(err error) int {
+	code := exitCode(err)
+	s := exitStatus{Command: statusCommand, Status: exitStatusNames[code], Code: code}
+	if err != nil && err != errUsage {
+		s.Error = err.Error()
+	}
+	data, _ := json.Marshal(s)
+	outputMu.Lock()
+	fmt.Fprintf(os.Stderr, "STATUS %s\n", data)
+	outputMu.Unlock()
+	return code
+}
+
+// exit ends the process with the status of err. Nodes use it where they
+// cannot return an error to execute: on failures while setting up, and
+// with nil once their workload is over.
+func exit(err error) {
+	if err != nil {
+		nodeLog.Errorf("%v", err)
+	}
+	os.Exit(printStatus(err))
+}
+
+// exitStatusName names the exit code of a node for the coordinator.
+func exitStatusName(code int) string {
+	if name, ok := exitStatusNames[code]; ok {
+		return name
+	}
+	return "unknown"
+}
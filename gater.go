@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/conngater"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// blacklist wraps the connection gater so that blocking a peer or subnet also
+// drops any connection that is already open, forcing the mesh to adapt.
+type blacklist struct {
+	gater *conngater.BasicConnectionGater
+	h     host.Host
+}
+
+func newBlacklist() (*blacklist, error) {
+	g, err := conngater.NewBasicConnectionGater(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &blacklist{gater: g}, nil
+}
+
+func (b *blacklist) apply(cfg BlacklistConfig) error {
+	for _, s := range cfg.Peers {
+		if err := b.blockPeer(s); err != nil {
+			return err
+		}
+	}
+	for _, s := range cfg.Subnets {
+		if err := b.blockSubnet(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *blacklist) blockPeer(s string) error {
+	p, err := peer.Decode(s)
+	if err != nil {
+		return err
+	}
+	if err := b.gater.BlockPeer(p); err != nil {
+		return err
+	}
+	if b.h != nil {
+		b.h.Network().ClosePeer(p)
+	}
+	transportLog.Infof("Blocked peer %s", p)
+	return nil
+}
+
+func (b *blacklist) unblockPeer(s string) error {
+	p, err := peer.Decode(s)
+	if err != nil {
+		return err
+	}
+	if err := b.gater.UnblockPeer(p); err != nil {
+		return err
+	}
+	transportLog.Infof("Unblocked peer %s", p)
+	return nil
+}
+
+func (b *blacklist) blockSubnet(s string) error {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return err
+	}
+	if err := b.gater.BlockSubnet(ipnet); err != nil {
+		return err
+	}
+	if b.h != nil {
+		for _, c := range b.h.Network().Conns() {
+			ip, err := manet.ToIP(c.RemoteMultiaddr())
+			if err == nil && ipnet.Contains(ip) {
+				c.Close()
+			}
+		}
+	}
+	transportLog.Infof("Blocked subnet %s", ipnet)
+	return nil
+}
+
+func (b *blacklist) unblockSubnet(s string) error {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return err
+	}
+	if err := b.gater.UnblockSubnet(ipnet); err != nil {
+		return err
+	}
+	transportLog.Infof("Unblocked subnet %s", ipnet)
+	return nil
+}
+
+func (b *blacklist) list() BlacklistConfig {
+	var out BlacklistConfig
+	for _, p := range b.gater.ListBlockedPeers() {
+		out.Peers = append(out.Peers, p.String())
+	}
+	for _, n := range b.gater.ListBlockedSubnets() {
+		out.Subnets = append(out.Subnets, n.String())
+	}
+	return out
+}
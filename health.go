@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ReadyConfig sets when GET /readyz reports a node ready. MinPeers is the
+// number of connected peers it needs, by default the number of -peers it
+// dials.
+type ReadyConfig struct {
+	MinPeers int `json:"minPeers"`
+}
+
+func (c *ReadyConfig) validate() error {
+	if c.MinPeers < 0 {
+		return fmt.Errorf("ready: minPeers must not be negative")
+	}
+	return nil
+}
+
+// minPeers is MinPeers, or the number of addresses in peers other than
+// self's plus the peerNodes the node looks up in its registry.
+func (c *ReadyConfig) minPeers(peers string, peerNodes int, self peer.ID) int {
+	if c != nil && c.MinPeers > 0 {
+		return c.MinPeers
+	}
+	n := peerNodes
+	for _, addr := range strings.Split(peers, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" && !strings.HasSuffix(addr, "/p2p/"+self.String()) {
+			n++
+		}
+	}
+	return n
+}
+
+// readiness tracks the steps of a node's start-up that GET /readyz checks.
+type readiness struct {
+	h        host.Host
+	minPeers int
+	joined   atomic.Bool
+}
+
+type readyStatus struct {
+	Ready     bool `json:"ready"`
+	Listening bool `json:"listening"`
+	Joined    bool `json:"joined"`
+	Peers     int  `json:"peers"`
+	MinPeers  int  `json:"minPeers"`
+}
+
+func (r *readiness) status() readyStatus {
+	s := readyStatus{
+		Listening: len(r.h.Network().ListenAddresses()) > 0,
+		Joined:    r.joined.Load(),
+		Peers:     len(r.h.Network().Peers()),
+		MinPeers:  r.minPeers,
+	}
+	s.Ready = s.Listening && s.Joined && s.Peers >= s.MinPeers
+	return s
+}
+
+// registerHealth serves GET /healthz, which answers as long as the node
+// runs, and GET /readyz, which fails with 503 until the host listens, the
+// topics are joined and enough peers are connected.
+func (c *controlServer) registerHealth(r *readiness) {
+	c.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, map[string]bool{"alive": true})
+	})
+	c.mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, req *http.Request) {
+		s := r.status()
+		code := http.StatusOK
+		if !s.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(s)
+	})
+}
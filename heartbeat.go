@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// heartbeatMonitor attributes the mesh maintenance and gossip a node sends
+// to gossipsub heartbeats. The router exposes no heartbeat hook, so the
+// monitor ticks at the router's heartbeat interval and counts the GRAFTs,
+// PRUNEs and IHAVEs the raw tracer sees sent between two ticks.
+type heartbeatMonitor struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	tick   int
+	counts heartbeatCounts
+}
+
+type heartbeatCounts struct {
+	grafts    int
+	prunes    int
+	ihaveRPCs int
+	ihaveIDs  int
+}
+
+func newHeartbeatMonitor(interval time.Duration) *heartbeatMonitor {
+	return &heartbeatMonitor{interval: interval}
+}
+
+// sent counts the control messages of an RPC sent to a peer.
+func (m *heartbeatMonitor) sent(rpc *pubsub.RPC) {
+	if m == nil {
+		return
+	}
+	ctl := rpc.GetControl()
+	if ctl == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts.grafts += len(ctl.GetGraft())
+	m.counts.prunes += len(ctl.GetPrune())
+	if ihave := ctl.GetIhave(); len(ihave) > 0 {
+		m.counts.ihaveRPCs++
+		for _, ih := range ihave {
+			m.counts.ihaveIDs += len(ih.GetMessageIDs())
+		}
+	}
+}
+
+// run emits a heartbeat event with the control messages sent during each
+// heartbeat interval until ctx is done.
+func (m *heartbeatMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		m.tick++
+		tick, c := m.tick, m.counts
+		m.counts = heartbeatCounts{}
+		m.mu.Unlock()
+
+		stats.inc("heartbeats_total", 1)
+		emitEvent("heartbeat", map[string]interface{}{
+			"tick":      tick,
+			"grafts":    c.grafts,
+			"prunes":    c.prunes,
+			"ihaveRpcs": c.ihaveRPCs,
+			"ihaveIds":  c.ihaveIDs,
+		})
+	}
+}
+
+// heartbeatSummary condenses one node's heartbeat events for the run
+// report.
+type heartbeatSummary struct {
+	Node       int `json:"node"`
+	Heartbeats int `json:"heartbeats"`
+	Grafts     int `json:"grafts"`
+	Prunes     int `json:"prunes"`
+	IHaveIDs   int `json:"ihaveIds"`
+}
+
+func analyzeHeartbeats(reports []nodeReport) []heartbeatSummary {
+	var out []heartbeatSummary
+	for _, rep := range reports {
+		sum := heartbeatSummary{Node: rep.Node}
+		for _, e := range rep.Events {
+			if e.Type != "heartbeat" {
+				continue
+			}
+			grafts, _ := e.Fields["grafts"].(float64)
+			prunes, _ := e.Fields["prunes"].(float64)
+			ids, _ := e.Fields["ihaveIds"].(float64)
+			sum.Heartbeats++
+			sum.Grafts += int(grafts)
+			sum.Prunes += int(prunes)
+			sum.IHaveIDs += int(ids)
+		}
+		if sum.Heartbeats > 0 {
+			out = append(out, sum)
+		}
+	}
+	return out
+}
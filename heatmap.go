@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// latencyCell is the median delivery latency from one publisher to one
+// receiver over every message and topic in the run.
+type latencyCell struct {
+	Publisher int     `json:"publisher"`
+	Receiver  int     `json:"receiver"`
+	Messages  int     `json:"messages"`
+	MedianMs  float64 `json:"medianMs"`
+}
+
+func median(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+func latencyMs(rr receiveRecord) float64 {
+	return float64(rr.ReceivedAt-rr.SentAt) / float64(time.Millisecond)
+}
+
+func analyzeLatencyMatrix(reports []nodeReport) []latencyCell {
+	type key struct{ pub, recv int }
+	samples := make(map[key][]float64)
+	for _, rep := range reports {
+		for _, rr := range rep.Received {
+			if rr.Publisher == rep.Node {
+				continue
+			}
+			k := key{rr.Publisher, rep.Node}
+			samples[k] = append(samples[k], latencyMs(rr))
+		}
+	}
+	cells := make([]latencyCell, 0, len(samples))
+	for k, v := range samples {
+		cells = append(cells, latencyCell{Publisher: k.pub, Receiver: k.recv, Messages: len(v), MedianMs: median(v)})
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Publisher != cells[j].Publisher {
+			return cells[i].Publisher < cells[j].Publisher
+		}
+		return cells[i].Receiver < cells[j].Receiver
+	})
+	return cells
+}
+
+// heatmapAxes returns the publishers (rows) and all nodes (columns).
+func heatmapAxes(reports []nodeReport, cells []latencyCell) (rows, cols []int) {
+	seen := make(map[int]bool)
+	for _, c := range cells {
+		if !seen[c.Publisher] {
+			seen[c.Publisher] = true
+			rows = append(rows, c.Publisher)
+		}
+	}
+	sort.Ints(rows)
+	for _, rep := range reports {
+		cols = append(cols, rep.Node)
+	}
+	return rows, cols
+}
+
+// writeHeatmapCSV writes a publisher x receiver matrix of median latencies in
+// milliseconds. Empty cells mean no message from that publisher arrived.
+func writeHeatmapCSV(path string, rows, cols []int, cells []latencyCell) error {
+	lookup := make(map[[2]int]float64)
+	for _, c := range cells {
+		lookup[[2]int{c.Publisher, c.Receiver}] = c.MedianMs
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	header := []string{"publisher"}
+	for _, c := range cols {
+		header = append(header, strconv.Itoa(c))
+	}
+	w.Write(header)
+	for _, r := range rows {
+		line := []string{strconv.Itoa(r)}
+		for _, c := range cols {
+			if v, ok := lookup[[2]int{r, c}]; ok {
+				line = append(line, strconv.FormatFloat(v, 'f', 3, 64))
+			} else {
+				line = append(line, "")
+			}
+		}
+		w.Write(line)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+const (
+	heatCell   = 12
+	heatMargin = 24
+)
+
+// writeHeatmapPNG renders the matrix with green for the fastest and red for
+// the slowest pair; grey cells never received anything from that publisher.
+// Rows are publishers and columns receivers, both in ascending node order and
+// labelled along the top and left edges.
+func writeHeatmapPNG(path string, rows, cols []int, cells []latencyCell) error {
+	lookup := make(map[[2]int]float64)
+	lo, hi := 0.0, 0.0
+	for i, c := range cells {
+		lookup[[2]int{c.Publisher, c.Receiver}] = c.MedianMs
+		if i == 0 || c.MedianMs < lo {
+			lo = c.MedianMs
+		}
+		if i == 0 || c.MedianMs > hi {
+			hi = c.MedianMs
+		}
+	}
+
+	width := heatMargin + len(cols)*heatCell
+	height := heatMargin + len(rows)*heatCell
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fill(img, img.Bounds(), color.RGBA{255, 255, 255, 255})
+
+	for ci, c := range cols {
+		drawNumber(img, heatMargin+ci*heatCell+1, 2, c)
+	}
+	for ri, r := range rows {
+		drawNumber(img, 2, heatMargin+ri*heatCell+3, r)
+		for ci, c := range cols {
+			col := color.RGBA{200, 200, 200, 255}
+			if v, ok := lookup[[2]int{r, c}]; ok {
+				col = heatColor(v, lo, hi)
+			}
+			x0, y0 := heatMargin+ci*heatCell, heatMargin+ri*heatCell
+			fill(img, image.Rect(x0, y0, x0+heatCell-1, y0+heatCell-1), col)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, img)
+}
+
+func heatColor(v, lo, hi float64) color.RGBA {
+	t := 0.0
+	if hi > lo {
+		t = (v - lo) / (hi - lo)
+	}
+	return color.RGBA{uint8(255 * t), uint8(255 * (1 - t)), 0, 255}
+}
+
+func fill(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+// digits is a 3x5 bitmap font, one row per entry, most significant bit left.
+var digits = [10][5]uint8{
+	{7, 5, 5, 5, 7}, {2, 6, 2, 2, 7}, {7, 1, 7, 4, 7}, {7, 1, 7, 1, 7}, {5, 5, 7, 1, 1},
+	{7, 4, 7, 1, 7}, {7, 4, 7, 5, 7}, {7, 1, 1, 1, 1}, {7, 5, 7, 5, 7}, {7, 5, 7, 1, 7},
+}
+
+func drawNumber(img *image.RGBA, x, y, n int) {
+	black := color.RGBA{0, 0, 0, 255}
+	for i, ch := range fmt.Sprint(n) {
+		d := digits[ch-'0']
+		for row := 0; row < 5; row++ {
+			for bit := 0; bit < 3; bit++ {
+				if d[row]&(4>>bit) != 0 {
+					img.SetRGBA(x+i*4+bit, y+row, black)
+				}
+			}
+		}
+	}
+}
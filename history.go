@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// historyProtocol serves the last messages of a topic over a stream of its
+// own, outside gossipsub: the requester writes a historyRequest and the
+// server answers with a historyResponse, both as JSON.
+const historyProtocol = protocol.ID("/gossipsub-test/history/1.0.0")
+
+// HistoryConfig makes every node keep the last Keep messages (default 100)
+// of each topic for history requests, and the listed Nodes ask a neighbour
+// for the last Count messages (default Keep) of each of their topics once
+// connected, trying the next neighbour if one does not answer within
+// Timeout (default 5s).
+type HistoryConfig struct {
+	Keep    int      `json:"keep"`
+	Nodes   []int    `json:"nodes"`
+	Count   int      `json:"count"`
+	Timeout duration `json:"timeout"`
+}
+
+func (c *HistoryConfig) requests(nodeNum int) bool {
+	if c == nil {
+		return false
+	}
+	for _, n := range c.Nodes {
+		if n == nodeNum {
+			return true
+		}
+	}
+	return false
+}
+
+type historyRequest struct {
+	Topic string `json:"topic"`
+	Count int    `json:"count"`
+}
+
+type historyResponse struct {
+	Messages [][]byte `json:"messages"`
+}
+
+// historyStore keeps the latest delivered messages of every topic.
+type historyStore struct {
+	keep int
+
+	mu     sync.Mutex
+	topics map[string][][]byte
+}
+
+func newHistoryStore(cfg *HistoryConfig) *historyStore {
+	if cfg == nil {
+		return nil
+	}
+	keep := cfg.Keep
+	if keep <= 0 {
+		keep = 100
+	}
+	return &historyStore{keep: keep, topics: make(map[string][][]byte)}
+}
+
+func (s *historyStore) add(msg *pubsub.Message) {
+	if s == nil {
+		return
+	}
+	topic := msg.GetTopic()
+	s.mu.Lock()
+	msgs := append(s.topics[topic], msg.Data)
+	if len(msgs) > s.keep {
+		msgs = msgs[len(msgs)-s.keep:]
+	}
+	s.topics[topic] = msgs
+	s.mu.Unlock()
+}
+
+func (s *historyStore) last(topic string, n int) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := s.topics[topic]
+	if n > 0 && n < len(msgs) {
+		msgs = msgs[len(msgs)-n:]
+	}
+	return append([][]byte(nil), msgs...)
+}
+
+func (s *historyStore) serve(h host.Host) {
+	h.SetStreamHandler(historyProtocol, func(st network.Stream) {
+		defer st.Close()
+		st.SetDeadline(time.Now().Add(10 * time.Second))
+		var req historyRequest
+		if err := json.NewDecoder(st).Decode(&req); err != nil {
+			pubsubLog.Warnf("Error reading history request from %s: %v", st.Conn().RemotePeer(), err)
+			st.Reset()
+			return
+		}
+		resp := historyResponse{Messages: s.last(req.Topic, req.Count)}
+		if err := json.NewEncoder(st).Encode(resp); err != nil {
+			pubsubLog.Warnf("Error answering history request from %s: %v", st.Conn().RemotePeer(), err)
+			st.Reset()
+			return
+		}
+		stats.inc(metricName("history_requests_served_total", "topic", req.Topic), 1)
+	})
+}
+
+// historyFetch is one answered history request. New counts the messages
+// the node had not received through gossip.
+type historyFetch struct {
+	Topic    string  `json:"topic"`
+	Peer     string  `json:"peer"`
+	Messages int     `json:"messages"`
+	New      int     `json:"new"`
+	Ms       float64 `json:"ms"`
+}
+
+func (r *recorder) addHistory(f historyFetch) {
+	r.mu.Lock()
+	r.history = append(r.history, f)
+	r.mu.Unlock()
+}
+
+func (r *recorder) hasDelivered(k messageKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.delivered[k]
+}
+
+// fetchHistory catches the node up on every topic from the first neighbour
+// that answers.
+func fetchHistory(ctx context.Context, h host.Host, topics []string, nodeNum int, cfg HistoryConfig, rec *recorder) {
+	if cfg.Count <= 0 {
+		cfg.Count = cfg.Keep
+	}
+	if cfg.Count <= 0 {
+		cfg.Count = 100
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = duration(5 * time.Second)
+	}
+	for _, topic := range topics {
+		fetched := false
+		for _, p := range h.Network().Peers() {
+			f, err := requestHistory(ctx, h, p, topic, cfg, rec)
+			if err != nil {
+				pubsubLog.Warnf("Error fetching history of %s from %s: %v", topic, p, err)
+				continue
+			}
+			rec.addHistory(f)
+			stats.inc(metricName("history_fetches_total", "topic", topic), 1)
+			stats.inc(metricName("history_messages_total", "topic", topic), float64(f.Messages))
+			stats.inc(metricName("history_new_messages_total", "topic", topic), float64(f.New))
+			stats.set(metricName("history_catchup_seconds", "topic", topic), f.Ms/1000)
+			emitEvent("history_fetched", map[string]interface{}{
+				"topic": topic, "peer": f.Peer, "messages": f.Messages, "new": f.New, "ms": f.Ms,
+			})
+			pubsubLog.Infof("Node %d fetched %d messages (%d new) of %s from %s in %.1fms", nodeNum, f.Messages, f.New, topic, p, f.Ms)
+			fetched = true
+			break
+		}
+		if !fetched {
+			stats.inc(metricName("history_failures_total", "topic", topic), 1)
+		}
+	}
+}
+
+func requestHistory(ctx context.Context, h host.Host, p peer.ID, topic string, cfg HistoryConfig, rec *recorder) (historyFetch, error) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Timeout))
+	defer cancel()
+	st, err := h.NewStream(ctx, p, historyProtocol)
+	if err != nil {
+		return historyFetch{}, err
+	}
+	defer st.Close()
+	st.SetDeadline(start.Add(time.Duration(cfg.Timeout)))
+	if err := json.NewEncoder(st).Encode(historyRequest{Topic: topic, Count: cfg.Count}); err != nil {
+		st.Reset()
+		return historyFetch{}, err
+	}
+	var resp historyResponse
+	if err := json.NewDecoder(st).Decode(&resp); err != nil {
+		st.Reset()
+		return historyFetch{}, fmt.Errorf("reading response: %w", err)
+	}
+	f := historyFetch{Topic: topic, Peer: p.String(), Messages: len(resp.Messages), Ms: float64(time.Since(start)) / float64(time.Millisecond)}
+	for _, data := range resp.Messages {
+		hdr, _, err := decodeMessage(data)
+		if err != nil {
+			continue
+		}
+		if !rec.hasDelivered(messageKey{topic, hdr.Publisher, hdr.Seq}) {
+			f.New++
+		}
+		pubsubLog.Infof("Recovered message from history of %s on %s: publisher=%d seq=%d", p, topic, hdr.Publisher, hdr.Seq)
+	}
+	return f, nil
+}
+
+// historySummary aggregates the history fetches of a run.
+type historySummary struct {
+	Fetches  int     `json:"fetches"`
+	Messages int     `json:"messages"`
+	New      int     `json:"new"`
+	MeanMs   float64 `json:"meanMs"`
+	MaxMs    float64 `json:"maxMs"`
+}
+
+func analyzeHistory(reports []nodeReport) *historySummary {
+	var sum historySummary
+	var total float64
+	for _, rep := range reports {
+		for _, f := range rep.History {
+			sum.Fetches++
+			sum.Messages += f.Messages
+			sum.New += f.New
+			total += f.Ms
+			if f.Ms > sum.MaxMs {
+				sum.MaxMs = f.Ms
+			}
+		}
+	}
+	if sum.Fetches == 0 {
+		return nil
+	}
+	sum.MeanMs = total / float64(sum.Fetches)
+	return &sum
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// rpcInspectors chains the inbound RPC inspectors of the node, since pubsub
+// accepts only one. The first error rejects the RPC.
+type rpcInspectors []func(peer.ID, *pubsub.RPC) error
+
+func (ins rpcInspectors) inspect(p peer.ID, rpc *pubsub.RPC) error {
+	for _, f := range ins {
+		if err := f(p, rpc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rpcInspectorHook, if set before the router starts, sees every inbound RPC
+// ahead of the node's own inspectors and may log it, change it in place or
+// reject it by returning an error, for protocol experiments that do not
+// warrant a change to go-libp2p-pubsub.
+var rpcInspectorHook func(from peer.ID, rpc *pubsub.RPC) error
+
+// InspectorConfig applies Rules to the inbound RPCs of the listed nodes, or
+// of every node if Nodes is empty.
+type InspectorConfig struct {
+	Nodes []int           `json:"nodes"`
+	Rules []InspectorRule `json:"rules"`
+}
+
+// InspectorRule matches the parts of an RPC of Kind ("subscribe",
+// "publish", "graft", "prune", "ihave", "iwant" or "idontwant"; any if
+// empty) on Topic (any if empty; IWANT and IDONTWANT have none) and, with
+// Probability (default 1), applies Action:
+//
+//   - "log" logs the part
+//   - "drop" removes the part from the RPC
+//   - "reject" drops the whole RPC
+//   - "corrupt" flips a byte of a published message's data
+type InspectorRule struct {
+	Kind        string  `json:"kind"`
+	Topic       string  `json:"topic"`
+	Action      string  `json:"action"`
+	Probability float64 `json:"probability"`
+}
+
+func (c *InspectorConfig) validate() error {
+	for i, r := range c.Rules {
+		switch r.Kind {
+		case "", "subscribe", "publish", "graft", "prune", "ihave", "iwant", "idontwant":
+		default:
+			return fmt.Errorf("inspector rule %d: unknown kind %q", i, r.Kind)
+		}
+		switch r.Action {
+		case "log", "drop", "reject", "corrupt":
+		default:
+			return fmt.Errorf("inspector rule %d: unknown action %q", i, r.Action)
+		}
+		if r.Probability < 0 || r.Probability > 1 {
+			return fmt.Errorf("inspector rule %d: probability must be between 0 and 1", i)
+		}
+	}
+	return nil
+}
+
+func (c *InspectorConfig) applies(nodeNum int) bool {
+	if c == nil {
+		return false
+	}
+	if len(c.Nodes) == 0 {
+		return true
+	}
+	for _, n := range c.Nodes {
+		if n == nodeNum {
+			return true
+		}
+	}
+	return false
+}
+
+func (r InspectorRule) matches(kind, topic string) bool {
+	if r.Kind != "" && r.Kind != kind {
+		return false
+	}
+	if r.Topic != "" && r.Topic != topic {
+		return false
+	}
+	return r.Probability == 0 || rand.Float64() < r.Probability
+}
+
+// ruleInspector applies the configured rules to every part of an RPC.
+type ruleInspector struct {
+	rules []InspectorRule
+}
+
+func (ri ruleInspector) inspect(from peer.ID, rpc *pubsub.RPC) error {
+	var rejected error
+	keep := func(kind, topic string, msg *pb.Message) bool {
+		kept := true
+		for _, r := range ri.rules {
+			if !r.matches(kind, topic) {
+				continue
+			}
+			stats.inc(metricName("rpc_inspections_total", "kind", kind, "action", r.Action), 1)
+			switch r.Action {
+			case "log":
+				pubsubLog.Infof("Inspected %s from %s on %q", kind, from, topic)
+			case "drop":
+				kept = false
+			case "reject":
+				rejected = fmt.Errorf("%s on %q rejected by inspector", kind, topic)
+			case "corrupt":
+				if msg != nil && len(msg.Data) > 0 {
+					msg.Data[rand.Intn(len(msg.Data))] ^= 0xff
+				}
+			}
+		}
+		return kept
+	}
+	rpc.Subscriptions = filterParts(rpc.Subscriptions, func(s *pb.RPC_SubOpts) bool {
+		return keep("subscribe", s.GetTopicid(), nil)
+	})
+	rpc.Publish = filterParts(rpc.Publish, func(m *pb.Message) bool {
+		return keep("publish", m.GetTopic(), m)
+	})
+	if ctl := rpc.Control; ctl != nil {
+		ctl.Graft = filterParts(ctl.Graft, func(g *pb.ControlGraft) bool {
+			return keep("graft", g.GetTopicID(), nil)
+		})
+		ctl.Prune = filterParts(ctl.Prune, func(p *pb.ControlPrune) bool {
+			return keep("prune", p.GetTopicID(), nil)
+		})
+		ctl.Ihave = filterParts(ctl.Ihave, func(ih *pb.ControlIHave) bool {
+			return keep("ihave", ih.GetTopicID(), nil)
+		})
+		ctl.Iwant = filterParts(ctl.Iwant, func(*pb.ControlIWant) bool {
+			return keep("iwant", "", nil)
+		})
+		ctl.Idontwant = filterParts(ctl.Idontwant, func(*pb.ControlIDontWant) bool {
+			return keep("idontwant", "", nil)
+		})
+	}
+	return rejected
+}
+
+// filterParts keeps the parts of an RPC for which keep returns true, in
+// place.
+func filterParts[T any](parts []T, keep func(T) bool) []T {
+	kept := parts[:0]
+	for _, p := range parts {
+		if keep(p) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
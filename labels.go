@@ -0,0 +1,177 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// NodeLabelConfig attaches labels such as region=eu or role=edge to a set of
+// nodes. A node in several entries gets the union of their labels, later
+// entries overriding earlier ones; region assignments in the regions block
+// and, if some node is pinned to a protocol version, every node's version
+// come last.
+type NodeLabelConfig struct {
+	Nodes  []int             `json:"nodes"`
+	Labels map[string]string `json:"labels"`
+}
+
+func (c *Config) labelsFor(nodeNum int) map[string]string {
+	var labels map[string]string
+	for _, l := range c.Labels {
+		for _, n := range l.Nodes {
+			if n != nodeNum {
+				continue
+			}
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			for k, v := range l.Labels {
+				labels[k] = v
+			}
+		}
+	}
+	if c.Regions != nil {
+		for region, nodes := range c.Regions.Nodes {
+			for _, n := range nodes {
+				if n != nodeNum {
+					continue
+				}
+				if labels == nil {
+					labels = make(map[string]string)
+				}
+				labels[c.Regions.label()] = region
+			}
+		}
+	}
+	if len(c.Protocols) > 0 {
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[protocolLabel] = c.protocolVersion(nodeNum)
+	}
+	return labels
+}
+
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + labels[k]
+	}
+	return strings.Join(parts, ",")
+}
+
+// labelReport aggregates the run by the values of one label: the summed
+// node metrics of each group and the latency between every pair of groups,
+// e.g. from region=eu publishers to region=us receivers.
+type labelReport struct {
+	Label   string         `json:"label"`
+	Groups  []labelGroup   `json:"groups"`
+	Latency []groupLatency `json:"latency"`
+}
+
+type labelGroup struct {
+	Value   string             `json:"value"`
+	Nodes   []int              `json:"nodes"`
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+type groupLatency struct {
+	From     string  `json:"from"`
+	To       string  `json:"to"`
+	Messages int     `json:"messages"`
+	MedianMs float64 `json:"medianMs"`
+	P99Ms    float64 `json:"p99Ms"`
+}
+
+// unlabelled is the group of nodes that lack a label other nodes have.
+const unlabelled = "-"
+
+func analyzeGroups(reports []nodeReport) []labelReport {
+	keys := make(map[string]bool)
+	for _, rep := range reports {
+		for k := range rep.Labels {
+			keys[k] = true
+		}
+	}
+	var out []labelReport
+	for _, key := range sortedKeys(keys) {
+		valueOf := make(map[int]string)
+		groups := make(map[string]*labelGroup)
+		for _, rep := range reports {
+			v, ok := rep.Labels[key]
+			if !ok {
+				v = unlabelled
+			}
+			valueOf[rep.Node] = v
+			g, ok := groups[v]
+			if !ok {
+				g = &labelGroup{Value: v, Metrics: make(map[string]float64)}
+				groups[v] = g
+			}
+			g.Nodes = append(g.Nodes, rep.Node)
+			for m, x := range rep.Metrics {
+				g.Metrics[m] += x
+			}
+		}
+
+		type pair struct{ from, to string }
+		samples := make(map[pair][]float64)
+		for _, rep := range reports {
+			seen := make(map[messageKey]bool)
+			for _, rr := range rep.Received {
+				k := messageKey{rr.Topic, rr.Publisher, rr.Seq}
+				if rr.Publisher == rep.Node || seen[k] {
+					continue
+				}
+				seen[k] = true
+				from, ok := valueOf[rr.Publisher]
+				if !ok {
+					from = unlabelled
+				}
+				p := pair{from, valueOf[rep.Node]}
+				samples[p] = append(samples[p], latencyMs(rr))
+			}
+		}
+
+		lr := labelReport{Label: key}
+		values := make(map[string]bool)
+		for v := range groups {
+			values[v] = true
+		}
+		for _, v := range sortedKeys(values) {
+			lr.Groups = append(lr.Groups, *groups[v])
+		}
+		for p, v := range samples {
+			sort.Float64s(v)
+			lr.Latency = append(lr.Latency, groupLatency{
+				From:     p.from,
+				To:       p.to,
+				Messages: len(v),
+				MedianMs: median(v),
+				P99Ms:    percentile(v, 99),
+			})
+		}
+		sort.Slice(lr.Latency, func(i, j int) bool {
+			if lr.Latency[i].From != lr.Latency[j].From {
+				return lr.Latency[i].From < lr.Latency[j].From
+			}
+			return lr.Latency[i].To < lr.Latency[j].To
+		})
+		out = append(out, lr)
+	}
+	return out
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
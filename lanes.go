@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// LaneConfig maps a priority class to its own topic, so each class can have
+// its own buffer and score parameters. Lanes are listed from the highest
+// priority to the lowest.
+type LaneConfig struct {
+	Class string      `json:"class"`
+	Topic TopicConfig `json:"topic"`
+}
+
+// laneSet publishes by class and merges the lanes' subscriptions into one
+// receive queue that always hands out the highest-priority message first.
+type laneSet struct {
+	classes []string
+	topics  map[string]*pubsub.Topic
+	queues  []chan *pubsub.Message
+	notify  chan struct{}
+}
+
+func newLaneSet(lanes []LaneConfig) *laneSet {
+	l := &laneSet{topics: make(map[string]*pubsub.Topic), notify: make(chan struct{}, 1)}
+	for _, lane := range lanes {
+		size := lane.Topic.BufferSize
+		if size <= 0 {
+			size = 1024
+		}
+		l.classes = append(l.classes, lane.Class)
+		l.queues = append(l.queues, make(chan *pubsub.Message, size))
+	}
+	return l
+}
+
+func (l *laneSet) index(class string) int {
+	for i, c := range l.classes {
+		if c == class {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *laneSet) join(class string, topic *pubsub.Topic) {
+	l.topics[class] = topic
+}
+
+// subscribe feeds a lane's subscription into its queue. A full queue blocks
+// that lane only, leaving pubsub to drop its messages as it would for a slow
+// reader.
+func (l *laneSet) subscribe(ctx context.Context, class string, sub *pubsub.Subscription) {
+	q := l.queues[l.index(class)]
+	go func() {
+		for {
+			msg, err := next(ctx, sub)
+			if err != nil {
+				return
+			}
+			q <- msg
+			stats.set(metricName("lane_queue_depth", "class", class), float64(len(q)))
+			select {
+			case l.notify <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// next returns the oldest message of the highest-priority non-empty lane,
+// waiting until there is one.
+func (l *laneSet) next() (string, *pubsub.Message) {
+	for {
+		for i, q := range l.queues {
+			select {
+			case msg := <-q:
+				stats.set(metricName("lane_queue_depth", "class", l.classes[i]), float64(len(q)))
+				return l.classes[i], msg
+			default:
+			}
+		}
+		<-l.notify
+	}
+}
+
+func (l *laneSet) handleMessages(nodeNum int, rec *recorder) {
+	for {
+		class, msg := l.next()
+		stats.inc(metricName("lane_messages_total", "class", class), 1)
+		handleMessage(msg, nodeNum, rec)
+	}
+}
+
+// mix returns the publish targets for a workload that spreads its messages
+// over the lanes by weight, e.g. {"high": 1, "low": 9} sends every tenth
+// message on the high lane.
+func (l *laneSet) mix(weights map[string]int) (func(seq uint64) []*pubsub.Topic, error) {
+	var slots []*pubsub.Topic
+	classes := make([]string, 0, len(weights))
+	for c := range weights {
+		classes = append(classes, c)
+	}
+	sort.Slice(classes, func(i, j int) bool { return l.index(classes[i]) < l.index(classes[j]) })
+	for _, c := range classes {
+		topic, ok := l.topics[c]
+		if !ok {
+			return nil, fmt.Errorf("workload lane mix: unknown lane %q", c)
+		}
+		for n := 0; n < weights[c]; n++ {
+			slots = append(slots, topic)
+		}
+	}
+	if len(slots) == 0 {
+		return nil, fmt.Errorf("workload lane mix: no positive weights")
+	}
+	return func(seq uint64) []*pubsub.Topic {
+		return []*pubsub.Topic{slots[(seq-1)%uint64(len(slots))]}
+	}, nil
+}
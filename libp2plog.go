@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+	"go.uber.org/zap/zapcore"
+)
+
+// libp2pCore receives the entries of go-libp2p's own loggers (ipfs/go-log)
+// and writes them as `libp2p` lines of the node log. go-log already filters
+// them by subsystem level, so the component levels do not apply.
+type libp2pCore struct {
+	fields []zapcore.Field
+}
+
+func (c *libp2pCore) Enabled(zapcore.Level) bool { return true }
+
+func (c *libp2pCore) With(fields []zapcore.Field) zapcore.Core {
+	return &libp2pCore{fields: append(append([]zapcore.Field(nil), c.fields...), fields...)}
+}
+
+func (c *libp2pCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return ce.AddCore(ent, c)
+}
+
+func (c *libp2pCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range append(append(make([]zapcore.Field, 0, len(c.fields)+len(fields)), c.fields...), fields...) {
+		f.AddTo(enc)
+	}
+	keys := make([]string, 0, len(enc.Fields))
+	for k := range enc.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(ent.LoggerName)
+	b.WriteString(": ")
+	b.WriteString(ent.Message)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, enc.Fields[k])
+	}
+	writeLine(ent.Time, zapLevel(ent.Level), "libp2p", b.String())
+	return nil
+}
+
+func (c *libp2pCore) Sync() error { return nil }
+
+func zapLevel(l zapcore.Level) logLevel {
+	switch {
+	case l <= zapcore.DebugLevel:
+		return levelDebug
+	case l == zapcore.InfoLevel:
+		return levelInfo
+	case l == zapcore.WarnLevel:
+		return levelWarn
+	default:
+		return levelError
+	}
+}
+
+// subsystemLevels remembers the go-log levels set through the config or the
+// control API, which go-log itself does not expose.
+type subsystemLevels struct {
+	mu     sync.Mutex
+	levels map[string]string
+}
+
+var libp2pLevels = &subsystemLevels{levels: make(map[string]string)}
+
+// set changes the level of a go-libp2p logging subsystem such as "swarm2"
+// or "pubsub"; "*" changes all of them.
+func (s *subsystemLevels) set(subsystem, level string) error {
+	if err := logging.SetLogLevel(subsystem, level); err != nil {
+		return fmt.Errorf("libp2p subsystem %q: %v", subsystem, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if subsystem == "*" {
+		s.levels = make(map[string]string)
+	}
+	s.levels[subsystem] = strings.ToLower(level)
+	return nil
+}
+
+func (s *subsystemLevels) snapshot() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]string, len(s.levels))
+	for k, v := range s.levels {
+		m[k] = v
+	}
+	return m
+}
+
+var captureOnce sync.Once
+
+// captureLibp2pLogs redirects go-log into the node log and applies the
+// configured subsystem levels, "*" first so that single subsystems can
+// override it.
+func captureLibp2pLogs(cfg map[string]string) error {
+	captureOnce.Do(func() {
+		logging.SetPrimaryCore(&libp2pCore{})
+	})
+	if lvl, ok := cfg["*"]; ok {
+		if err := libp2pLevels.set("*", lvl); err != nil {
+			return err
+		}
+	}
+	for sub, lvl := range cfg {
+		if sub == "*" {
+			continue
+		}
+		if err := libp2pLevels.set(sub, lvl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ListenConfig makes the listed Nodes, or all nodes if none are listed,
+// listen on Addrs instead of /ip4/0.0.0.0/tcp/<port>. An address is a
+// multiaddr in which {port} stands for the node's port, or "ip4" or "ip6"
+// for every interface of that family; the last entry listing a node wins.
+type ListenConfig struct {
+	Nodes []int    `json:"nodes"`
+	Addrs []string `json:"addrs"`
+}
+
+var listenShorthands = map[string]string{
+	"ip4": "/ip4/0.0.0.0/tcp/{port}",
+	"ip6": "/ip6/::/tcp/{port}",
+}
+
+func (c ListenConfig) validate() error {
+	if len(c.Addrs) == 0 {
+		return fmt.Errorf("listen: no addrs")
+	}
+	for _, a := range c.Addrs {
+		if _, err := listenAddr(a, 4000); err != nil {
+			return fmt.Errorf("listen: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c ListenConfig) applies(nodeNum int) bool {
+	if len(c.Nodes) == 0 {
+		return true
+	}
+	for _, n := range c.Nodes {
+		if n == nodeNum {
+			return true
+		}
+	}
+	return false
+}
+
+// listenAddr expands a listen address for the node on port. It must start
+// with an IPv4 or IPv6 address.
+func listenAddr(a string, port int) (ma.Multiaddr, error) {
+	if s, ok := listenShorthands[a]; ok {
+		a = s
+	}
+	m, err := ma.NewMultiaddr(strings.ReplaceAll(a, "{port}", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", a, err)
+	}
+	if code := m.Protocols()[0].Code; code != ma.P_IP4 && code != ma.P_IP6 {
+		return nil, fmt.Errorf("%s: not an ip4 or ip6 address", a)
+	}
+	return m, nil
+}
+
+// listenAddrs is where node nodeNum listens on port.
+func (c *Config) listenAddrs(nodeNum, port int) []string {
+	addrs := []string{"ip4"}
+	for _, l := range c.Listen {
+		if l.applies(nodeNum) {
+			addrs = l.Addrs
+		}
+	}
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		// The addresses were checked by validate.
+		m, _ := listenAddr(a, port)
+		out = append(out, m.String())
+	}
+	return out
+}
+
+// listenFamilies reports whether node nodeNum listens on IPv4 and IPv6.
+func (c *Config) listenFamilies(nodeNum int) (ip4, ip6 bool) {
+	for _, a := range c.listenAddrs(nodeNum, 4000) {
+		m, _ := ma.NewMultiaddr(a)
+		switch m.Protocols()[0].Code {
+		case ma.P_IP4:
+			ip4 = true
+		case ma.P_IP6:
+			ip6 = true
+		}
+	}
+	return ip4, ip6
+}
+
+// dialAddrs are the addresses the cluster gives out for a node, one per
+// family it listens on.
+type dialAddrs struct {
+	ip4, ip6 string
+}
+
+// preferred is the address the node is known by, IPv4 if it has one.
+func (d dialAddrs) preferred() string {
+	if d.ip4 != "" {
+		return d.ip4
+	}
+	return d.ip6
+}
+
+// to is the address a node with the families of d dials peer on, IPv4
+// first, and false if they share no family.
+func (d dialAddrs) to(peer dialAddrs) (string, bool) {
+	if d.ip4 != "" && peer.ip4 != "" {
+		return peer.ip4, true
+	}
+	if d.ip6 != "" && peer.ip6 != "" {
+		return peer.ip6, true
+	}
+	return "", false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/network"
+	lpyamux "github.com/libp2p/go-libp2p/p2p/muxer/yamux"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+)
+
+// liteStreamWindow caps yamux's per-stream receive window, 16MiB by
+// default, which dominates a node's memory once it has many peers.
+const liteStreamWindow = 256 << 10
+
+// liteHostOptions trims a host for running hundreds of nodes on one
+// machine: TCP only, Noise only, a yamux with small windows, and no relay,
+// ping, identify address discovery, metrics, resource or connection
+// manager.
+func liteHostOptions() []libp2p.Option {
+	mux := *lpyamux.DefaultTransport
+	mux.MaxStreamWindowSize = liteStreamWindow
+	return []libp2p.Option{
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Security(noise.ID, noise.New),
+		libp2p.Muxer(lpyamux.ID, &mux),
+		libp2p.DisableRelay(),
+		libp2p.Ping(false),
+		libp2p.DisableIdentifyAddressDiscovery(),
+		libp2p.DisableMetrics(),
+		libp2p.ResourceManager(&network.NullResourceManager{}),
+		libp2p.ConnectionManager(&connmgr.NullConnMgr{}),
+	}
+}
+
+// litePubsubOptions shrinks pubsub's per-peer and validation queues; config
+// options added after them still win.
+func litePubsubOptions() []pubsub.Option {
+	return []pubsub.Option{
+		pubsub.WithPeerOutboundQueueSize(8),
+		pubsub.WithValidateQueueSize(8),
+		pubsub.WithValidateWorkers(1),
+	}
+}
+
+// enterLite runs the whole process on one scheduler thread, so a node's
+// goroutines share a single event loop instead of one thread per CPU, and
+// collects garbage earlier to keep the heap small.
+func enterLite() {
+	runtime.GOMAXPROCS(1)
+	debug.SetGCPercent(25)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// LoggingConfig sets the default level and per-component overrides, e.g.
+// {"level": "info", "components": {"pubsub": "debug"}}.
+type LoggingConfig struct {
+	Level      string            `json:"level"`
+	Components map[string]string `json:"components"`
+	Libp2p     map[string]string `json:"libp2p,omitempty"`
+}
+
+type logLevels struct {
+	mu         sync.RWMutex
+	def        logLevel
+	components map[string]logLevel
+}
+
+var levels = &logLevels{def: levelInfo, components: make(map[string]logLevel)}
+
+func (l *logLevels) enabled(component string, lvl logLevel) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	min, ok := l.components[component]
+	if !ok {
+		min = l.def
+	}
+	return lvl >= min
+}
+
+// set changes the level of one component, or the default if component is
+// empty.
+func (l *logLevels) set(component, level string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if component == "" {
+		l.def = lvl
+	} else {
+		l.components[component] = lvl
+	}
+	return nil
+}
+
+func (l *logLevels) apply(cfg LoggingConfig) error {
+	if cfg.Level != "" {
+		if err := l.set("", cfg.Level); err != nil {
+			return err
+		}
+	}
+	for c, lvl := range cfg.Components {
+		if err := l.set(c, lvl); err != nil {
+			return err
+		}
+	}
+	return captureLibp2pLogs(cfg.Libp2p)
+}
+
+func (l *logLevels) config() LoggingConfig {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	cfg := LoggingConfig{Level: strings.ToLower(l.def.String()), Components: make(map[string]string)}
+	for c, lvl := range l.components {
+		cfg.Components[c] = strings.ToLower(lvl.String())
+	}
+	cfg.Libp2p = libp2pLevels.snapshot()
+	return cfg
+}
+
+// logger writes timestamped lines for one component of the node.
+type logger struct {
+	component string
+}
+
+var (
+	nodeLog      = &logger{"node"}
+	transportLog = &logger{"transport"}
+	pubsubLog    = &logger{"pubsub"}
+	workloadLog  = &logger{"workload"}
+	controlLog   = &logger{"control"}
+	clusterLog   = &logger{"cluster"}
+	eventsLog    = &logger{"events"}
+)
+
+var outputMu sync.Mutex
+
+func (l *logger) logf(lvl logLevel, format string, a ...interface{}) {
+	if !levels.enabled(l.component, lvl) {
+		return
+	}
+	writeLine(time.Now(), lvl, l.component, fmt.Sprintf(format, a...))
+}
+
+func writeLine(t time.Time, lvl logLevel, component, msg string) {
+	line := fmt.Sprintf("[%s] %-5s %s: %s\n", t.Format(time.RFC3339Nano), lvl, component, msg)
+	outputMu.Lock()
+	os.Stdout.WriteString(line)
+	outputMu.Unlock()
+}
+
+func (l *logger) Debugf(format string, a ...interface{}) { l.logf(levelDebug, format, a...) }
+func (l *logger) Infof(format string, a ...interface{})  { l.logf(levelInfo, format, a...) }
+func (l *logger) Warnf(format string, a ...interface{})  { l.logf(levelWarn, format, a...) }
+func (l *logger) Errorf(format string, a ...interface{}) { l.logf(levelError, format, a...) }
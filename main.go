@@ -3,14 +3,15 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"flag"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/libp2p/go-libp2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
@@ -21,44 +22,75 @@ import (
 
 const topicName = "gossipsub-test"
 
-func logWithTime(format string, a ...interface{}) {
-	timestamp := time.Now().Format(time.RFC3339Nano)
-	line := fmt.Sprintf("[%s] %s", timestamp, fmt.Sprintf(format, a...))
-	fmt.Print(line) 
-}
-
-
-
-func handleMessages(sub *pubsub.Subscription, nodeNum int) {
+func handleMessages(ctx context.Context, sub *pubsub.Subscription, nodeNum int, rec *recorder) {
 	for {
-		msg, err := sub.Next(context.Background())
+		msg, err := next(ctx, sub)
 		if err != nil {
-			log.Fatal(err)
+			if ctx.Err() != nil {
+				return
+			}
+			exit(err)
 		}
-		logWithTime("Received message from %s: %s\n", msg.ReceivedFrom, string(msg.Data))
+		handleMessage(msg, nodeNum, rec)
 	}
 }
 
-func generateKeys(nodeNum *int) {
+func handleMessage(msg *pubsub.Message, nodeNum int, rec *recorder) {
+	now := time.Now()
+	topic := msg.GetTopic()
+	stats.inc(metricName("messages_received_total", "topic", topic), 1)
+	rec.store.write(msg)
+	hdr, payload, err := decodeMessage(msg.Data)
+	if err != nil {
+		pubsubLog.Warnf("Received malformed message from %s on %s: %v", msg.ReceivedFrom, topic, err)
+		return
+	}
+	first := rec.addReceived(receiveRecord{
+		Topic:      topic,
+		Publisher:  hdr.Publisher,
+		Seq:        hdr.Seq,
+		SentAt:     hdr.SentAt.UnixNano(),
+		ReceivedAt: now.UnixNano(),
+		From:       msg.ReceivedFrom.String(),
+	})
+	if first {
+		rec.acks.add(hdr, topic, now)
+		rec.sla.add(hdr, topic, now)
+	} else {
+		stats.inc(metricName("messages_redelivered_total", "topic", topic), 1)
+	}
+	text := string(payload)
+	if len(payload) > 64 || !utf8.Valid(payload) {
+		text = fmt.Sprintf("(%d bytes)", len(payload))
+	}
+	logf := pubsubLog.Infof
+	if rec.unsampled {
+		logf = pubsubLog.Debugf
+	}
+	logf("Received message from %s on %s: publisher=%d seq=%d %s", msg.ReceivedFrom, topic, hdr.Publisher, hdr.Seq, text)
+}
+
+func generateKeys(maxNode int) error {
 	identityDir := "identities"
 	if err := os.MkdirAll(identityDir, 0755); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	for i := 0; i <= *nodeNum; i++ {
-		var priv crypto.PrivKey
-		var err error
+	for i := 0; i <= maxNode; i++ {
 		path := filepath.Join(identityDir, fmt.Sprintf("node%d.key", i))
-
-		priv, err = loadOrCreateIdentity(path)
+		priv, err := loadOrCreateIdentity(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
 
 		peerID, err := peer.IDFromPrivateKey(priv)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		fmt.Printf("%d:%s\n", i, peerID)
 	}
+	return nil
 }
 
 func loadOrCreateIdentity(path string) (crypto.PrivKey, error) {
@@ -81,103 +113,549 @@ func loadOrCreateIdentity(path string) (crypto.PrivKey, error) {
 }
 
 func main() {
-	port := flag.Int("port", 0, "Port to listen on")
-	peers := flag.String("peers", "", "Comma-separated list of peer addresses to connect to")
-	nodeNum := flag.Int("node", 0, "Node number")
-	minNum := flag.Int("minnode", 0, "Min node number")
-	generate := flag.Bool("generate", false, "Generate new keys and print peer IDs")
-	flag.Parse()
-
-	if *generate {
-		generateKeys(nodeNum)
+	args := os.Args[1:]
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") && !isHelpFlag(args[0]) {
+		legacyMain()
 		return
 	}
+	os.Exit(execute(rootCommand(), args))
+}
+
+// runNode runs one node until its workload is over.
+func runNode(cfg *Config, o nodeOptions) {
+	// ctx ends with the node, before it exits.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var err error
+	var snap *nodeSnapshot
+	if o.restorePath != "" {
+		snap, err = loadSnapshot(o.restorePath)
+		if err != nil {
+			exit(configError(err))
+		}
+		if len(cfg.Topics) == 0 && len(cfg.Lanes) == 0 {
+			cfg.Topics = cfg.topics()
+		}
+		cfg.Topics = append(cfg.Topics, snap.missingTopics(cfg.topics())...)
+	}
 
 	identityDir := "identities"
 	if err := os.MkdirAll(identityDir, 0755); err != nil {
-		log.Fatal(err)
+		exit(err)
 	}
 
-	identityFile := filepath.Join(identityDir, fmt.Sprintf("node%d.key", *nodeNum))
+	identityFile := filepath.Join(identityDir, fmt.Sprintf("node%d.key", o.node))
 	privKey, err := loadOrCreateIdentity(identityFile)
 	if err != nil {
-		log.Fatal(err)
+		exit(err)
+	}
+
+	bl, err := newBlacklist()
+	if err != nil {
+		exit(err)
+	}
+
+	workload := cfg.Workload.withDefaults()
+	role := cfg.roleOf(o.node)
+	publisher := publishesAs(role, workload.publishes(o.node, o.node == o.minNode))
+	experiment := cfg.Experiment
+	if o.experiment != "" {
+		experiment = o.experiment
 	}
+	agent := newPeerAgent(o.node, nodeRole(cfg, o.node, publisher), experiment)
 
-	h, err := libp2p.New(
-		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", *port)),
+	hostOpts := []libp2p.Option{
+		libp2p.ListenAddrStrings(cfg.listenAddrs(o.node, o.port)...),
 		libp2p.Identity(privKey),
-	)
+		libp2p.ConnectionGater(bl.gater),
+		libp2p.UserAgent(agent.String()),
+	}
+	if o.unixDir != "" {
+		addr, err := unixListenAddr(o.unixDir, o.port)
+		if err != nil {
+			exit(err)
+		}
+		hostOpts = append(hostOpts, libp2p.ListenAddrStrings(addr), libp2p.Transport(newUnixTransport))
+		if !o.lite {
+			hostOpts = append(hostOpts, libp2p.DefaultTransports)
+		}
+	}
+	if o.lite {
+		enterLite()
+		hostOpts = append(hostOpts, liteHostOptions()...)
+	}
+	var closePeerstore func() error
+	if o.peerstoreDir != "" {
+		pstore, store, err := openPeerstore(ctx, o.peerstoreDir)
+		if err != nil {
+			exit(err)
+		}
+		closePeerstore = store.Close
+		hostOpts = append(hostOpts, libp2p.Peerstore(pstore))
+	}
+
+	h, err := libp2p.New(hostOpts...)
 	if err != nil {
-		log.Fatal(err)
+		exit(bindError(err))
 	}
 	defer h.Close()
 
-	logWithTime("Node %d ID: %s\n", *nodeNum, h.ID())
+	port := listenPort(h)
+	stopCapture := func() {}
+	if o.pcapPath != "" {
+		stopCapture, err = startCapture(o.pcapPath, port)
+		if err != nil {
+			exit(err)
+		}
+	}
+	if o.registry != "" {
+		if err := register(o.registry, h, o.node); err != nil {
+			exit(err)
+		}
+		nodeLog.Infof("Node %d registered port %d in %s", o.node, port, o.registry)
+	}
+	var peerNodes []int
+	for _, n := range o.peerNodes {
+		if n != o.node {
+			peerNodes = append(peerNodes, n)
+		}
+	}
+
+	bl.h = h
+	if err := bl.apply(cfg.Blacklist); err != nil {
+		exit(configError(err))
+	}
+	if snap != nil {
+		if err := bl.apply(snap.Blacklist); err != nil {
+			exit(err)
+		}
+	}
+
+	nodeLog.Infof("Node %d ID: %s", o.node, h.ID())
 	for _, addr := range h.Addrs() {
 		fullAddr := fmt.Sprintf("%s/p2p/%s", addr, h.ID())
-		logWithTime("Node %d Full address: %s\n", *nodeNum, fullAddr)
+		nodeLog.Infof("Node %d Full address: %s", o.node, fullAddr)
 	}
 
-	ps, err := pubsub.NewGossipSub(context.Background(), h, pubsub.GOSSIPSUB)
-	if err != nil {
-		log.Fatal(err)
+	start := time.Now().Add(time.Duration(workload.StartDelay))
+	if o.startAt != "" {
+		start, err = time.Parse(time.RFC3339Nano, o.startAt)
+		if err != nil {
+			exit(configError(err))
+		}
 	}
 
-	topic, err := ps.Join(topicName)
-	if err != nil {
-		log.Fatal(err)
+	rec := &recorder{labels: cfg.labelsFor(o.node), gossipsub: &cfg.GossipSub, profile: "default", role: role, process: o.process}
+	if o.lite {
+		rec.profile = "lite"
+	}
+	if len(rec.labels) > 0 {
+		nodeLog.Infof("Node %d labels: %s", o.node, formatLabels(rec.labels))
+	}
+
+	if cfg.Store.applies(o.node) {
+		if rec.store, err = openMessageStore(*cfg.Store, o.node); err != nil {
+			exit(err)
+		}
+	}
+	// Lanes split the sequence numbers between their topics, and an
+	// adaptive workload has no fixed length.
+	var lastSeq uint64
+	if workload.LaneMix == nil {
+		lastSeq = uint64(len(workload.schedule()))
+	}
+	if rec.sla = newSLAMonitor(cfg.topics(), o.node, lastSeq); rec.sla != nil {
+		go rec.sla.run(ctx)
 	}
-	defer topic.Close()
 
-	sub, err := topic.Subscribe()
+	tr := newTracer(h)
+	tr.rec = rec
+	tr.outbound = newOutboundMonitor()
+	rec.outbound = tr.outbound
+	churn := newChurner(ctx, cfg.Churn, o.node, rec)
+	tr.churn = churn
+	// Churn gaps are found from the node's receive records.
+	if !cfg.Sampling.samples(o.node, publisher || churn != nil) {
+		rec.unsampled = true
+		nodeLog.Infof("Node %d not sampled, counting deliveries only", o.node)
+	}
+	tr.conv = newConvergenceMonitor(cfg.GossipSub.params().D)
+	rec.conv = tr.conv
+	tr.history = newHistoryStore(cfg.History)
+	if tr.history != nil {
+		tr.history.serve(h)
+	}
+	backoff := newBackoffMonitor(cfg.GossipSub.params())
+	tr.backoff = backoff
+	tr.seen = newSeenSet(cfg.GossipSub.seenTTL())
+	if cfg.GossipSub.HeartbeatEvents {
+		if !o.process {
+			exit(configError(errors.New("heartbeatEvents cannot be told apart between the nodes of a -node-range")))
+		}
+		tr.heartbeat = newHeartbeatMonitor(cfg.GossipSub.params().HeartbeatInterval)
+		go tr.heartbeat.run(ctx)
+	}
+	if err := watchIdentify(h, cfg.PeerRecords.Require); err != nil {
+		exit(err)
+	}
+	if err := watchConnections(h, rec); err != nil {
+		exit(err)
+	}
+	if err := watchAgents(h, agent); err != nil {
+		exit(err)
+	}
+	var inspectors rpcInspectors
+	if cfg.Inspector.applies(o.node) {
+		inspectors = append(inspectors, ruleInspector{rules: cfg.Inspector.Rules}.inspect)
+	}
+	if rpcInspectorHook != nil {
+		inspectors = append(inspectors, rpcInspectorHook)
+	}
+	inspectors = append(inspectors, backoff.inspect, pxGuard{require: cfg.PeerRecords.Require}.inspect)
+	if cfg.Misbehavior.applies(o.node) && cfg.Misbehavior.Regraft != nil {
+		pubsubLog.Infof("Node %d misbehaving: re-grafting after prunes", o.node)
+		inspectors = append(inspectors, newRegrafter(ctx, h, *cfg.Misbehavior.Regraft).inspect)
+	}
+	var psOpts []pubsub.Option
+	if o.lite {
+		psOpts = litePubsubOptions()
+	}
+	psOpts = append(psOpts, pubsubOptions(cfg)...)
+	if version := cfg.protocolVersion(o.node); version != latestProtocol {
+		pubsubLog.Infof("Node %d speaking gossipsub %s only", o.node, version)
+		psOpts = append(psOpts, protocolOptions(version)...)
+	}
+	var pruner *scorePruner
+	if cfg.ScorePruning.applies(o.node) {
+		pruner = newScorePruner(h, *cfg.ScorePruning, o.node, rec)
+		psOpts = append(psOpts, pruner.option())
+	}
+	psOpts = append(psOpts,
+		pubsub.WithRawTracer(tr),
+		pubsub.WithAppSpecificRpcInspector(inspectors.inspect),
+	)
+	ps, err := pubsub.NewGossipSub(ctx, outboundHost{h, tr.outbound}, pubsub.GOSSIPSUB, psOpts...)
 	if err != nil {
-		log.Fatal(err)
+		exit(err)
+	}
+
+	var topicNames []string
+	for _, tc := range cfg.topics() {
+		topicNames = append(topicNames, tc.Name)
+	}
+	live := newLiveConfig()
+	live.adaptive = workload.Adaptive != nil
+	live.churn = churn
+	if role != roleObserver {
+		if err := registerValidators(ps, cfg.topics(), live); err != nil {
+			exit(configError(err))
+		}
+	}
+	adversary := cfg.Misbehavior.applies(o.node)
+	if adversary && cfg.Misbehavior.Blackhole {
+		if err := blackhole(ps, topicNames, o.node); err != nil {
+			exit(configError(err))
+		}
+	}
+	if adversary && cfg.Misbehavior.Tamper != nil {
+		if err := tamper(ctx, h, ps, topicNames, o.node, *cfg.Misbehavior.Tamper, rec); err != nil {
+			exit(configError(err))
+		}
 	}
-	defer sub.Cancel()
+	if snap != nil {
+		if err := snap.restoreSeen(ps, topicNames, cfg.GossipSub.seenTTL()); err != nil {
+			exit(configError(err))
+		}
+	}
+	snapper := &snapshotter{h: h, ps: ps, bl: bl, seen: tr.seen, node: o.node, topics: topicNames}
 
-	go handleMessages(sub, *nodeNum)
+	resourceInterval := time.Duration(cfg.ResourceInterval)
+	if resourceInterval == 0 {
+		resourceInterval = time.Second
+	}
+	if o.process {
+		go runResourceSampler(resourceInterval, rec)
+	}
+	var history *metricHistory
+	if o.metricsHistory != "" {
+		history = &metricHistory{}
+		go history.run(ctx, o.metricsInterval)
+	}
+	ready := &readiness{h: h, minPeers: cfg.Ready.minPeers(o.peers, len(peerNodes), h.ID())}
+	if o.controlAddr != "" {
+		ctl := newControlServer()
+		ctl.registerBlacklist(bl)
+		ctl.registerMetrics()
+		ctl.registerPeers(h)
+		ctl.registerLogging()
+		ctl.registerSnapshot(snapper, o.snapshotPath)
+		ctl.registerHealth(ready)
+		ctl.registerConfig(live)
+		var tlsConfig *tls.Config
+		if o.tlsCerts != "" {
+			if tlsConfig, err = nodeTLSConfig(o.tlsCerts, o.node, privKey); err != nil {
+				exit(configError(err))
+			}
+		}
+		if err := ctl.serve(o.controlAddr, tlsConfig); err != nil {
+			exit(bindError(err))
+		}
+	}
 
-	if *peers != "" {
+	var topics []*pubsub.Topic
+	var subscribed []string
+	lanes := newLaneSet(cfg.Lanes)
+	for _, tc := range cfg.topics() {
+		topic, err := ps.Join(tc.Name)
+		if err != nil {
+			exit(err)
+		}
+		defer topic.Close()
+		if tc.Score != nil {
+			if err := topic.SetScoreParams(tc.Score.params()); err != nil {
+				exit(configError(fmt.Errorf("topic %s: %v", tc.Name, err)))
+			}
+		}
+		topics = append(topics, topic)
+		class, isLane := cfg.laneOf(tc.Name)
+		if isLane {
+			lanes.join(class, topic)
+		}
+
+		if publisher && workload.PublishOnly || !subscribes(role) {
+			continue
+		}
+		subscribed = append(subscribed, tc.Name)
+		var subOpts []pubsub.SubOpt
+		if tc.BufferSize > 0 {
+			subOpts = append(subOpts, pubsub.WithBufferSize(tc.BufferSize))
+		}
+		if !isLane && role != roleRelay && churn.covers(tc.Name) {
+			if err := churn.add(topic, subOpts...); err != nil {
+				exit(err)
+			}
+			continue
+		}
+		sub, err := topic.Subscribe(subOpts...)
+		if err != nil {
+			exit(err)
+		}
+		defer sub.Cancel()
+
+		if role == roleRelay {
+			go relayMessages(ctx, sub)
+			continue
+		}
+		if isLane {
+			lanes.subscribe(ctx, class, sub)
+			continue
+		}
+		go handleMessages(ctx, sub, o.node, rec)
+	}
+	if len(cfg.Lanes) > 0 {
+		go lanes.handleMessages(o.node, rec)
+	}
+	go tr.conv.run(ps, o.node, subscribed)
+	ready.joined.Store(true)
+
+	if a := workload.Adaptive; a != nil {
+		ackTopic, err := ps.Join(ackTopicName)
+		if err != nil {
+			exit(err)
+		}
+		ackSub, err := ackTopic.Subscribe()
+		if err != nil {
+			exit(err)
+		}
+		rec.acks = newAcker(ackTopic, o.node)
+		go rec.acks.run(ctx, time.Duration(a.withDefaults().AckInterval))
+		if publisher {
+			rec.adaptive = newAdaptiveController(a.withDefaults(), o.node)
+			go rec.adaptive.watch(ctx, ackSub)
+		} else {
+			// Keep relaying the other receivers' acks.
+			go func() {
+				for {
+					if _, err := next(ctx, ackSub); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	targets := func(uint64) []*pubsub.Topic { return topics }
+	if len(workload.LaneMix) > 0 {
+		targets, err = lanes.mix(workload.LaneMix)
+		if err != nil {
+			exit(configError(err))
+		}
+	}
+
+	dialed := 0
+	if !workload.WaitMesh && (o.peers != "" || len(peerNodes) > 0) {
 		time.Sleep(1 * time.Second) // Let the network stabilize
-		for _, addr := range strings.Split(*peers, ",") {
+	}
+	if len(peerNodes) > 0 {
+		found, missing, err := lookupPeers(ctx, o.registry, peerNodes)
+		if err != nil {
+			exit(configError(err))
+		}
+		if len(missing) > 0 {
+			transportLog.Warnf("Nodes %v did not register in %s within %v", missing, o.registry, registryWait)
+		}
+		dialed += len(missing)
+		for _, pi := range found {
+			dialed++
+			if err := connect(ctx, h, pi); err != nil {
+				transportLog.Warnf("Error connecting to peer %s: %v", pi.ID, err)
+				continue
+			}
+			transportLog.Infof("Node %d connected to peer: %s", o.node, pi.ID)
+		}
+	}
+	if o.peers != "" {
+		for _, addr := range strings.Split(o.peers, ",") {
 			addr = strings.TrimSpace(addr)
 			if addr == "" {
 				continue
 			}
 			maddr, err := multiaddr.NewMultiaddr(addr)
 			if err != nil {
-				logWithTime("Error parsing peer address %s: %v\n", addr, err)
+				transportLog.Warnf("Error parsing peer address %s: %v", addr, err)
 				continue
 			}
 			peerInfo, err := peer.AddrInfoFromP2pAddr(maddr)
 			if err != nil {
-				logWithTime("Error extracting peer info from %s: %v\n", addr, err)
+				transportLog.Warnf("Error extracting peer info from %s: %v", addr, err)
 				continue
 			}
-			if err := h.Connect(context.Background(), *peerInfo); err != nil {
-				logWithTime("Error connecting to peer %s: %v\n", addr, err)
+			if peerInfo.ID == h.ID() {
 				continue
 			}
-			logWithTime("Node %d connected to peer: %s\n", *nodeNum, peerInfo.ID)
+			if o.unixDir != "" {
+				preferUnix(o.unixDir, peerInfo)
+			}
+			dialed++
+			if err := connect(ctx, h, *peerInfo); err != nil {
+				transportLog.Warnf("Error connecting to peer %s: %v", addr, err)
+				continue
+			}
+			transportLog.Infof("Node %d connected to peer: %s", o.node, peerInfo.ID)
 		}
 	}
 
-	if *port == 4000+*minNum {
-		time.Sleep(60 * time.Second)
-		err = topic.Publish(context.Background(), []byte("Hello world!"))
+	if o.peerstoreDir != "" {
+		reconnectKnownPeers(ctx, h, o.node)
+	}
+	if snap != nil {
+		snap.restoreConnections(ctx, h, o.node)
+	}
+	// A node that reached none of its -peers, and that no peer reached in
+	// the meantime, would run the experiment on its own.
+	if dialed > 0 && len(h.Network().Peers()) == 0 {
+		exit(bootstrapError(fmt.Errorf("node %d connected to none of its %d peers", o.node, dialed)))
+	}
+	if pruner != nil {
+		go pruner.run(ctx)
+	}
+
+	if cfg.History.requests(o.node) {
+		go fetchHistory(ctx, h, subscribed, o.node, *cfg.History, rec)
+	}
+
+	if cfg.Barrier != nil && o.startAt == "" {
+		start, err = waitBarrier(ctx, ps, o.node, o.minNode, *cfg.Barrier)
 		if err != nil {
-			log.Fatal(err)
+			workloadLog.Warnf("Node %d starting without barrier: %v", o.node, err)
+			start = time.Now()
 		}
-		logWithTime("Node %d published message to topic\n", *nodeNum)
-		time.Sleep(5 * time.Second) // Allow time for message to propagate
-		logWithTime("Node %d shutting down\n", *nodeNum)
-		os.Exit(0)
 	}
 
+	shutdown := func() {
+		if o.settle != nil {
+			o.settle()
+		}
+		stopCapture()
+		if err := rec.store.close(); err != nil {
+			nodeLog.Warnf("Error closing message store: %v", err)
+		}
+		churn.summarize()
+		rec.sla.flush()
+		if o.process {
+			logMetrics(o.node)
+		}
+		if o.metricsDump != "" {
+			if err := dumpMetrics(o.metricsDump); err != nil {
+				nodeLog.Warnf("Error writing metrics %s: %v", o.metricsDump, err)
+			}
+		}
+		if history != nil {
+			if err := history.write(o.metricsHistory, o.node); err != nil {
+				nodeLog.Warnf("Error writing metrics history %s: %v", o.metricsHistory, err)
+			}
+		}
+		if o.reportPath != "" {
+			if err := rec.writeReport(o.reportPath, o.node, h.ID().String()); err != nil {
+				nodeLog.Warnf("Error writing report %s: %v", o.reportPath, err)
+			}
+		}
+		if o.snapshotPath != "" {
+			if err := snapper.write(o.snapshotPath); err != nil {
+				nodeLog.Warnf("Error writing snapshot %s: %v", o.snapshotPath, err)
+			}
+		}
+		if closePeerstore != nil {
+			if err := closePeerstore(); err != nil {
+				nodeLog.Warnf("Error closing peerstore: %v", err)
+			}
+		}
+		nodeLog.Infof("Node %d shutting down", o.node)
+		cancel()
+		o.exit(h)
+	}
+
+	if adversary {
+		// Attacks run alongside the workload.
+		m, end := cfg.Misbehavior, workload.end(start)
+		time.AfterFunc(time.Until(start), func() {
+			if m.Spam != nil {
+				go runSpammer(ctx, topics, o.node, *m.Spam, end)
+			}
+			if m.IWant != nil {
+				go runIWantFlood(ctx, h, tr.seen, o.node, *m.IWant, end)
+			}
+			if m.IHave != nil {
+				go runIHaveFlood(ctx, h, topicNames, o.node, *m.IHave, end)
+			}
+			if m.ForgePX != nil {
+				go runForgedPX(ctx, h, topicNames, o.node, *m.ForgePX, end)
+			}
+		})
+	}
+
+	if churn != nil {
+		end := workload.end(start)
+		time.AfterFunc(time.Until(start), func() { churn.run(end) })
+	}
+
+	if publisher {
+		publishAt := start
+		if workload.WaitMesh {
+			time.Sleep(time.Until(start))
+			publishAt = tr.conv.waitFull(start.Add(time.Duration(workload.MeshTimeout)))
+		}
+		runPublisher(ctx, targets, o.node, workload, publishAt, live, rec)
+		if workload.WaitMesh || len(workload.Publishers) > 1 || len(cfg.Roles) > 0 {
+			// Keep relaying for the other publishers
+			time.Sleep(time.Until(workload.end(start)))
+		} else {
+			time.Sleep(5 * time.Second) // Allow time for message to propagate
+		}
+		shutdown()
+	}
 
 	// Wait for all messages to be processed before shutting down
-	time.Sleep(120 * time.Second)
-	logWithTime("Node %d shutting down\n", *nodeNum)
-	os.Exit(0)
+	time.Sleep(time.Until(workload.end(start)))
+	shutdown()
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+// Every published payload starts with a fixed header so that receivers can
+// tell who sent it, in which order, and when.
+const headerSize = 4 + 8 + 8
+
+type msgHeader struct {
+	Publisher int
+	Seq       uint64
+	SentAt    time.Time
+}
+
+func encodeMessage(h msgHeader, payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(h.Publisher))
+	binary.BigEndian.PutUint64(buf[4:12], h.Seq)
+	binary.BigEndian.PutUint64(buf[12:20], uint64(h.SentAt.UnixNano()))
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+// headerMessageID identifies a message by its topic and header instead of
+// the sender's pubsub sequence number, so that re-sending the same payload
+// produces the same message ID.
+func headerMessageID(m *pb.Message) string {
+	h, _, err := decodeMessage(m.GetData())
+	if err != nil {
+		return pubsub.DefaultMsgIdFn(m)
+	}
+	return fmt.Sprintf("%s/%d/%d", m.GetTopic(), h.Publisher, h.Seq)
+}
+
+func decodeMessage(data []byte) (msgHeader, []byte, error) {
+	if len(data) < headerSize {
+		return msgHeader{}, nil, errors.New("message shorter than header")
+	}
+	h := msgHeader{
+		Publisher: int(binary.BigEndian.Uint32(data[0:4])),
+		Seq:       binary.BigEndian.Uint64(data[4:12]),
+		SentAt:    time.Unix(0, int64(binary.BigEndian.Uint64(data[12:20]))),
+	}
+	return h, data[headerSize:], nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// metrics is a minimal registry of named values. Labels are encoded in the
+// name in Prometheus form, e.g. `messages_received_total{topic="a"}`.
+type metrics struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var stats = &metrics{values: make(map[string]float64)}
+
+func metricName(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	s := name + "{"
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprintf("%s=%q", labels[i], labels[i+1])
+	}
+	return s + "}"
+}
+
+func (m *metrics) inc(name string, delta float64) {
+	m.mu.Lock()
+	m.values[name] += delta
+	m.mu.Unlock()
+}
+
+func (m *metrics) set(name string, v float64) {
+	m.mu.Lock()
+	m.values[name] = v
+	m.mu.Unlock()
+}
+
+func (m *metrics) snapshot() map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]float64, len(m.values))
+	for k, v := range m.values {
+		out[k] = v
+	}
+	return out
+}
+
+func (m *metrics) writePrometheus(w io.Writer) {
+	snap := m.snapshot()
+	names := make([]string, 0, len(snap))
+	for k := range snap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(w, "%s %g\n", k, snap[k])
+	}
+}
+
+// dumpMetrics writes the final metric values to path in Prometheus text
+// format.
+func dumpMetrics(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	stats.writePrometheus(f)
+	return f.Close()
+}
+
+// logMetrics writes the final metric values to the node log so that runs
+// without a control API still keep them.
+func logMetrics(nodeNum int) {
+	data, err := json.Marshal(stats.snapshot())
+	if err != nil {
+		return
+	}
+	nodeLog.Infof("Node %d metrics: %s", nodeNum, data)
+}
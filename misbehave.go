@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// MisbehaviorConfig turns the listed nodes into adversaries used to check
+// that honest nodes' protections work.
+type MisbehaviorConfig struct {
+	Nodes   []int          `json:"nodes"`
+	Regraft *RegraftConfig `json:"regraft"`
+	Spam    *SpamConfig    `json:"spam"`
+	// IWant asks every peer again and again for recently seen messages,
+	// IHave advertises messages that do not exist.
+	IWant *FloodConfig `json:"iwant"`
+	IHave *FloodConfig `json:"ihave"`
+	// Blackhole makes a node stay in the mesh but never forward anything.
+	Blackhole bool           `json:"blackhole"`
+	ForgePX   *ForgePXConfig `json:"forgePX"`
+	Tamper    *TamperConfig  `json:"tamper"`
+}
+
+// SpamConfig makes a node publish Rate messages per second of Size random
+// bytes on every topic.
+type SpamConfig struct {
+	Rate float64 `json:"rate"`
+	Size int     `json:"size"`
+}
+
+// FloodConfig makes a node send every connected peer Rate control RPCs per
+// second listing IDs message IDs each.
+type FloodConfig struct {
+	Rate float64 `json:"rate"`
+	IDs  int     `json:"ids"`
+}
+
+// RegraftConfig makes a node answer every PRUNE with a GRAFT after Delay,
+// ignoring the requested backoff, up to Max times per peer and topic.
+type RegraftConfig struct {
+	Delay duration `json:"delay"`
+	Max   int      `json:"max"`
+}
+
+func (m *MisbehaviorConfig) applies(nodeNum int) bool {
+	if m == nil {
+		return false
+	}
+	for _, n := range m.Nodes {
+		if n == nodeNum {
+			return true
+		}
+	}
+	return false
+}
+
+// validates reports whether the misbehaviour takes the topic validators.
+func (m *MisbehaviorConfig) validates() bool {
+	return m != nil && (m.Blackhole || m.Tamper != nil)
+}
+
+// sendRawRPC writes a single hand-crafted RPC on a fresh pubsub stream,
+// bypassing the router's own protocol rules.
+func sendRawRPC(ctx context.Context, h host.Host, p peer.ID, rpc *pb.RPC) error {
+	s, err := openRawStream(ctx, h, p)
+	if err != nil {
+		return err
+	}
+	if err := writeRawRPC(s, rpc); err != nil {
+		s.Reset()
+		return err
+	}
+	return s.Close()
+}
+
+func openRawStream(ctx context.Context, h host.Host, p peer.ID) (network.Stream, error) {
+	return newStream(ctx, h, p, pubsub.GossipSubID_v12, pubsub.GossipSubID_v11, pubsub.GossipSubID_v10)
+}
+
+func writeRawRPC(s network.Stream, rpc *pb.RPC) error {
+	data, err := rpc.Marshal()
+	if err != nil {
+		return err
+	}
+	buf := binary.AppendUvarint(nil, uint64(len(data)))
+	_, err = s.Write(append(buf, data...))
+	return err
+}
+
+type regrafter struct {
+	ctx context.Context
+	h   host.Host
+	cfg RegraftConfig
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func newRegrafter(ctx context.Context, h host.Host, cfg RegraftConfig) *regrafter {
+	if cfg.Max == 0 {
+		cfg.Max = 5
+	}
+	return &regrafter{ctx: ctx, h: h, cfg: cfg, attempts: make(map[string]int)}
+}
+
+func (r *regrafter) inspect(p peer.ID, rpc *pubsub.RPC) error {
+	for _, prune := range rpc.GetControl().GetPrune() {
+		topic := prune.GetTopicID()
+		key := p.String() + "/" + topic
+		r.mu.Lock()
+		n := r.attempts[key]
+		if n < r.cfg.Max {
+			r.attempts[key] = n + 1
+		}
+		r.mu.Unlock()
+		if n >= r.cfg.Max {
+			continue
+		}
+		time.AfterFunc(time.Duration(r.cfg.Delay), func() {
+			graft := &pb.RPC{Control: &pb.ControlMessage{Graft: []*pb.ControlGraft{{TopicID: &topic}}}}
+			if err := sendRawRPC(r.ctx, r.h, p, graft); err != nil {
+				pubsubLog.Warnf("Error re-grafting %s on %s: %v", p, topic, err)
+				return
+			}
+			pubsubLog.Infof("Re-grafted %s on %s %s after prune (attempt %d)", p, topic, time.Duration(r.cfg.Delay), n+1)
+		})
+	}
+	return nil
+}
+
+// runSpammer publishes random payloads, which honest nodes cannot decode,
+// on every topic until end.
+func runSpammer(ctx context.Context, topics []*pubsub.Topic, nodeNum int, cfg SpamConfig, end time.Time) {
+	if cfg.Rate <= 0 {
+		cfg.Rate = 100
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = 1024
+	}
+	pubsubLog.Infof("Node %d misbehaving: spamming %.0f msg/s of %d bytes", nodeNum, cfg.Rate, cfg.Size)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if now.After(end) || ctx.Err() != nil {
+			return
+		}
+		data := make([]byte, cfg.Size)
+		rand.Read(data)
+		for _, t := range topics {
+			if err := publish(ctx, t, data); err != nil {
+				pubsubLog.Debugf("Error spamming %s: %v", t.String(), err)
+			}
+		}
+		stats.inc("spam_published_total", float64(len(topics)))
+	}
+}
+
+// flooder sends hand-crafted control RPCs to every connected peer, keeping
+// one raw stream per peer open between floods.
+type flooder struct {
+	ctx     context.Context
+	h       host.Host
+	streams map[peer.ID]network.Stream
+}
+
+func newFlooder(ctx context.Context, h host.Host) *flooder {
+	return &flooder{ctx: ctx, h: h, streams: make(map[peer.ID]network.Stream)}
+}
+
+func (f *flooder) send(p peer.ID, rpc *pb.RPC) error {
+	s, ok := f.streams[p]
+	if !ok {
+		var err error
+		if s, err = openRawStream(f.ctx, f.h, p); err != nil {
+			return err
+		}
+		f.streams[p] = s
+	}
+	if err := writeRawRPC(s, rpc); err != nil {
+		s.Reset()
+		delete(f.streams, p)
+		return err
+	}
+	return nil
+}
+
+// run calls build for every tick until end and sends the result to all
+// connected peers, counting what was sent under metric.
+func (f *flooder) run(cfg FloodConfig, end time.Time, metric string, build func() *pb.RPC) {
+	if cfg.Rate <= 0 {
+		cfg.Rate = 10
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if now.After(end) || f.ctx.Err() != nil {
+			break
+		}
+		rpc := build()
+		for _, p := range f.h.Network().Peers() {
+			if err := f.send(p, rpc); err != nil {
+				pubsubLog.Debugf("Error flooding %s: %v", p, err)
+				continue
+			}
+			stats.inc(metric, 1)
+		}
+	}
+	for _, s := range f.streams {
+		s.Close()
+	}
+}
+
+// runIWantFlood requests the most recently seen messages from every peer,
+// topped up with random IDs, so peers keep retransmitting or looking up
+// messages for us.
+func runIWantFlood(ctx context.Context, h host.Host, seen *seenSet, nodeNum int, cfg FloodConfig, end time.Time) {
+	if cfg.IDs <= 0 {
+		cfg.IDs = 100
+	}
+	pubsubLog.Infof("Node %d misbehaving: flooding IWANTs for %d messages", nodeNum, cfg.IDs)
+	newFlooder(ctx, h).run(cfg, end, "iwant_flood_rpcs_total", func() *pb.RPC {
+		ids := seen.recent(cfg.IDs)
+		for len(ids) < cfg.IDs {
+			ids = append(ids, randomMessageID())
+		}
+		return &pb.RPC{Control: &pb.ControlMessage{Iwant: []*pb.ControlIWant{{MessageIDs: ids}}}}
+	})
+}
+
+// runIHaveFlood advertises random message IDs on every topic, none of which
+// can be served when peers ask for them.
+func runIHaveFlood(ctx context.Context, h host.Host, topics []string, nodeNum int, cfg FloodConfig, end time.Time) {
+	if cfg.IDs <= 0 {
+		cfg.IDs = 100
+	}
+	pubsubLog.Infof("Node %d misbehaving: flooding IHAVEs of %d fake messages", nodeNum, cfg.IDs)
+	newFlooder(ctx, h).run(cfg, end, "ihave_flood_rpcs_total", func() *pb.RPC {
+		ctl := &pb.ControlMessage{}
+		for _, t := range topics {
+			ids := make([]string, cfg.IDs)
+			for i := range ids {
+				ids[i] = randomMessageID()
+			}
+			ctl.Ihave = append(ctl.Ihave, &pb.ControlIHave{TopicID: &t, MessageIDs: ids})
+		}
+		return &pb.RPC{Control: ctl}
+	})
+}
+
+func randomMessageID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return string(id)
+}
+
+// blackhole makes the node ignore every message on the topics, so it neither
+// delivers nor forwards them while staying subscribed.
+func blackhole(ps *pubsub.PubSub, topics []string, nodeNum int) error {
+	pubsubLog.Infof("Node %d misbehaving: dropping all messages", nodeNum)
+	for _, t := range topics {
+		err := ps.RegisterTopicValidator(t, func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+			stats.inc("blackholed_messages_total", 1)
+			return pubsub.ValidationIgnore
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// nodeOptions are the command-line settings of one node.
+type nodeOptions struct {
+	port            int
+	node            int
+	minNode         int
+	peers           string
+	registry        string
+	peerNodes       []int
+	configPath      string
+	controlAddr     string
+	tlsCerts        string
+	reportPath      string
+	metricsDump     string
+	metricsHistory  string
+	metricsInterval time.Duration
+	startAt         string
+	snapshotPath    string
+	restorePath     string
+	pcapPath        string
+	lite            bool
+	unixDir         string
+	peerstoreDir    string
+	experiment      string
+
+	// process is set on the node that logs and reports the process-wide
+	// metrics, events and resources.
+	process bool
+	// settle, if set, runs before the node writes its report.
+	settle func()
+	// exit ends the node once its report is written.
+	exit func(h host.Host)
+}
+
+// parseNodeRange parses "A-B" with A <= B.
+func parseNodeRange(spec string) (from, to int, err error) {
+	a, b, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("node range %q: want A-B", spec)
+	}
+	if from, err = strconv.Atoi(strings.TrimSpace(a)); err != nil {
+		return 0, 0, fmt.Errorf("node range %q: %v", spec, err)
+	}
+	if to, err = strconv.Atoi(strings.TrimSpace(b)); err != nil {
+		return 0, 0, fmt.Errorf("node range %q: %v", spec, err)
+	}
+	if from > to {
+		return 0, 0, fmt.Errorf("node range %q: %d > %d", spec, from, to)
+	}
+	return from, to, nil
+}
+
+// runNodeRange runs the nodes of spec in this process, each with its own
+// host, the first one on base.port and the others on the ports after it; if
+// base.port is 0 (-port auto), every node picks a free port of its own. They
+// share logging, metrics and events, which the first node reports once the
+// others are done; reportPath, metricsDump and metricsHistory name
+// directories that get one node<N>.json per node, a node<first>.prom and a
+// node<first>.csv. perNode says whether a flag that needs a process of its
+// own was given.
+func runNodeRange(spec string, base nodeOptions, perNode bool) {
+	from, to, err := parseNodeRange(spec)
+	if err != nil {
+		exit(configError(err))
+	}
+	if perNode {
+		exit(configError(errors.New("-control, -snapshot, -restore, -pcap and -peerstore need a process per node and cannot be used with -node-range")))
+	}
+	for _, dir := range []string{base.reportPath, base.metricsDump, base.metricsHistory} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			exit(err)
+		}
+	}
+	nodeLog.Infof("Running nodes %d to %d in one process", from, to)
+
+	var others sync.WaitGroup
+	others.Add(to - from)
+	for n := from; n <= to; n++ {
+		cfg, err := loadConfig(base.configPath)
+		if err != nil {
+			exit(err)
+		}
+		o := base
+		o.node = n
+		if base.port != 0 {
+			o.port = base.port + n - from
+		}
+		if base.reportPath != "" {
+			o.reportPath = filepath.Join(base.reportPath, fmt.Sprintf("node%d.json", n))
+		}
+		o.process = n == from
+		if o.process {
+			if base.metricsDump != "" {
+				o.metricsDump = filepath.Join(base.metricsDump, fmt.Sprintf("node%d.prom", n))
+			}
+			if base.metricsHistory != "" {
+				o.metricsHistory = filepath.Join(base.metricsHistory, fmt.Sprintf("node%d.csv", n))
+			}
+			o.settle = others.Wait
+			o.exit = func(host.Host) { exit(nil) }
+		} else {
+			o.metricsDump = ""
+			o.metricsHistory = ""
+			o.exit = func(h host.Host) {
+				h.Close()
+				others.Done()
+				select {}
+			}
+		}
+		go runNode(cfg, o)
+	}
+	select {}
+}
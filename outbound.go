@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// outboundMonitor follows the router's per-peer outbound queues, which
+// go-libp2p-pubsub does not expose: the tracer's SendRPC is a push onto a
+// peer's queue and DropRPC a push the full queue refused, and the router's
+// sending goroutine writes every RPC it pops from the queue to the peer's
+// stream in a single Write, which the host handed to the router counts.
+type outboundMonitor struct {
+	mu    sync.Mutex
+	peers map[peer.ID]*outboundPeer
+}
+
+type outboundPeer struct {
+	Peer    string `json:"peer"`
+	Sent    int    `json:"sent"`
+	Written int    `json:"written"`
+	Dropped int    `json:"dropped"`
+	Peak    int    `json:"peakQueue"`
+	// dropping is set from a drop until the queue moves again, so a run
+	// of drops is emitted as one event.
+	dropping bool
+	// discarded counts the RPCs left in the queue when the peer went away.
+	discarded int
+}
+
+func newOutboundMonitor() *outboundMonitor {
+	return &outboundMonitor{peers: make(map[peer.ID]*outboundPeer)}
+}
+
+func (m *outboundMonitor) peer(p peer.ID) *outboundPeer {
+	op := m.peers[p]
+	if op == nil {
+		op = &outboundPeer{Peer: p.String()}
+		m.peers[p] = op
+	}
+	return op
+}
+
+func (op *outboundPeer) queued() int {
+	return max(op.Sent-op.Written-op.discarded, 0)
+}
+
+func (m *outboundMonitor) sent(p peer.ID) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	op := m.peer(p)
+	op.Sent++
+	q := op.queued()
+	op.Peak = max(op.Peak, q)
+	m.mu.Unlock()
+	stats.set(metricName("outbound_queue_length", "peer", p.String()), float64(q))
+}
+
+func (m *outboundMonitor) written(p peer.ID) {
+	m.mu.Lock()
+	op := m.peer(p)
+	op.Written++
+	op.dropping = false
+	q := op.queued()
+	m.mu.Unlock()
+	stats.set(metricName("outbound_queue_length", "peer", p.String()), float64(q))
+}
+
+func (m *outboundMonitor) dropped(p peer.ID) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	op := m.peer(p)
+	op.Dropped++
+	first := !op.dropping
+	op.dropping = true
+	q := op.queued()
+	m.mu.Unlock()
+	stats.inc(metricName("outbound_drops_total", "peer", p.String()), 1)
+	if first {
+		emitEvent("outbound_queue_full", map[string]interface{}{"peer": p.String(), "queued": q})
+		pubsubLog.Warnf("Outbound queue to %s full with %d RPCs, dropping", p, q)
+	}
+}
+
+// removed forgets the queue of a peer the router dropped.
+func (m *outboundMonitor) removed(p peer.ID) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	op := m.peer(p)
+	op.discarded += op.queued()
+	op.dropping = false
+	m.mu.Unlock()
+	stats.set(metricName("outbound_queue_length", "peer", p.String()), 0)
+}
+
+// records returns the peers' counters, by peer ID.
+func (m *outboundMonitor) records() []outboundPeer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]outboundPeer, 0, len(m.peers))
+	for _, op := range m.peers {
+		out = append(out, *op)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Peer < out[j].Peer })
+	return out
+}
+
+// outboundHost is the host given to the router, counting the writes on the
+// streams the router opens.
+type outboundHost struct {
+	host.Host
+	m *outboundMonitor
+}
+
+func (h outboundHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	return &outboundStream{Stream: s, m: h.m, p: p}, nil
+}
+
+// outboundStream counts the RPCs written to a peer. The first write on
+// every stream is the router's hello, which it queues without tracing it,
+// so it is not counted.
+type outboundStream struct {
+	network.Stream
+	m            *outboundMonitor
+	p            peer.ID
+	helloWritten bool
+}
+
+func (s *outboundStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if err == nil {
+		if s.helloWritten {
+			s.m.written(s.p)
+		}
+		s.helloWritten = true
+	}
+	return n, err
+}
+
+// outboundDrops is one node's drops towards one peer in the run report.
+type outboundDrops struct {
+	Node     int    `json:"node"`
+	Peer     string `json:"peer"`
+	PeerNode int    `json:"peerNode"`
+	Sent     int    `json:"sent"`
+	Dropped  int    `json:"dropped"`
+	Peak     int    `json:"peakQueue"`
+}
+
+// analyzeOutbound lists the queues that dropped RPCs, with the peer's node,
+// or -1 if the peer has no report among reports.
+func analyzeOutbound(reports []nodeReport) []outboundDrops {
+	nodeOf := make(map[string]int)
+	for _, rep := range reports {
+		nodeOf[rep.PeerID] = rep.Node
+	}
+	var out []outboundDrops
+	for _, rep := range reports {
+		for _, op := range rep.Outbound {
+			if op.Dropped == 0 {
+				continue
+			}
+			d := outboundDrops{Node: rep.Node, Peer: op.Peer, PeerNode: -1, Sent: op.Sent, Dropped: op.Dropped, Peak: op.Peak}
+			if n, ok := nodeOf[op.Peer]; ok {
+				d.PeerNode = n
+			}
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func (d outboundDrops) peerName() string {
+	if d.PeerNode >= 0 {
+		return fmt.Sprintf("node %d", d.PeerNode)
+	}
+	return d.Peer
+}
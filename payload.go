@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"text/template"
+	"time"
+)
+
+// PayloadConfig selects how message payloads are generated:
+//
+//   - "text" (the default) repeats "Hello world!" up to Size bytes
+//   - "random" sends Size random bytes
+//   - "json" fills Template for every message, see payloadTemplateFuncs
+//   - "zipf" sends random bytes whose sizes between MinSize and MaxSize
+//     follow a Zipf distribution with exponent Skew (> 1), so most messages
+//     are small and a few are large
+//   - "mixed" sends random bytes of each of Sizes in turn (default
+//     mtuSizes), so that every size gets the same number of messages
+//
+// Random content and sizes derive from Seed and the publisher's node number.
+type PayloadConfig struct {
+	Generator string  `json:"generator"`
+	Size      int     `json:"size"`
+	Template  string  `json:"template"`
+	MinSize   int     `json:"minSize"`
+	MaxSize   int     `json:"maxSize"`
+	Skew      float64 `json:"skew"`
+	Sizes     []int   `json:"sizes"`
+	Seed      int64   `json:"seed"`
+}
+
+// mtuSizes put messages into every one of sizeBuckets, with payloads just
+// below and above the Ethernet MTU, jumbo frames and the 64KiB of a noise
+// frame and of the loopback MTU. The buckets 1501-4096, 9001-16384 and
+// 16385-65535 get two of them.
+var mtuSizes = []int{1000, 1400, 1600, 4000, 8900, 9100, 16000, 32768, 65000, 65536}
+
+type payloadGenerator func(seq uint64) ([]byte, error)
+
+// payloadFields are what a JSON template can refer to.
+type payloadFields struct {
+	Seq  uint64
+	Node int
+	Time string
+}
+
+func (p *PayloadConfig) validate() error {
+	if p.Size < 0 {
+		return fmt.Errorf("payload: negative size %d", p.Size)
+	}
+	switch p.Generator {
+	case "", "text", "random":
+	case "json":
+		if p.Template == "" {
+			return fmt.Errorf("payload: json generator needs a template")
+		}
+		if _, err := template.New("payload").Funcs(payloadTemplateFuncs(nil)).Parse(p.Template); err != nil {
+			return fmt.Errorf("payload: %v", err)
+		}
+	case "zipf":
+		if p.Skew <= 1 {
+			return fmt.Errorf("payload: zipf skew must be greater than 1")
+		}
+		if p.MinSize < 0 {
+			return fmt.Errorf("payload: negative minSize %d", p.MinSize)
+		}
+		if p.MaxSize < p.MinSize {
+			return fmt.Errorf("payload: maxSize %d below minSize %d", p.MaxSize, p.MinSize)
+		}
+	case "mixed":
+		for _, size := range p.Sizes {
+			if size < 0 {
+				return fmt.Errorf("payload: negative size %d", size)
+			}
+		}
+	default:
+		return fmt.Errorf("payload: unknown generator %q", p.Generator)
+	}
+	return nil
+}
+
+// payloadTemplateFuncs are the template functions for variable fields:
+// randInt lo hi, randHex n (n random bytes, hex encoded) and pick a b c...
+func payloadTemplateFuncs(rng *rand.Rand) template.FuncMap {
+	return template.FuncMap{
+		"randInt": func(lo, hi int) int {
+			if hi <= lo {
+				return lo
+			}
+			return lo + rng.Intn(hi-lo+1)
+		},
+		"randHex": func(n int) string {
+			b := make([]byte, n)
+			rng.Read(b)
+			return hex.EncodeToString(b)
+		},
+		"pick": func(choices ...string) string {
+			if len(choices) == 0 {
+				return ""
+			}
+			return choices[rng.Intn(len(choices))]
+		},
+	}
+}
+
+func textPayload(size int) []byte {
+	text := []byte("Hello world!")
+	if size <= len(text) {
+		return text
+	}
+	return bytes.Repeat(text, size/len(text)+1)[:size]
+}
+
+// generator returns the payload source of one publisher.
+func (p *PayloadConfig) generator(nodeNum int) (payloadGenerator, error) {
+	rng := rand.New(rand.NewSource(p.Seed + int64(nodeNum)))
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	switch p.Generator {
+	case "random":
+		return func(uint64) ([]byte, error) { return randomBytes(p.Size), nil }, nil
+	case "json":
+		tmpl, err := template.New("payload").Funcs(payloadTemplateFuncs(rng)).Parse(p.Template)
+		if err != nil {
+			return nil, err
+		}
+		return func(seq uint64) ([]byte, error) {
+			var buf bytes.Buffer
+			fields := payloadFields{Seq: seq, Node: nodeNum, Time: time.Now().Format(time.RFC3339Nano)}
+			if err := tmpl.Execute(&buf, fields); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}, nil
+	case "zipf":
+		zipf := rand.NewZipf(rng, p.Skew, 1, uint64(p.MaxSize-p.MinSize))
+		return func(uint64) ([]byte, error) {
+			return randomBytes(p.MinSize + int(zipf.Uint64())), nil
+		}, nil
+	case "mixed":
+		sizes := p.Sizes
+		if len(sizes) == 0 {
+			sizes = mtuSizes
+		}
+		return func(seq uint64) ([]byte, error) {
+			return randomBytes(sizes[(seq-1)%uint64(len(sizes))]), nil
+		}, nil
+	}
+	text := textPayload(p.Size)
+	return func(uint64) ([]byte, error) { return text, nil }, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// startCapture records the traffic on the node's listen port with tcpdump
+// into path until the returned stop function is called. tcpdump must be
+// installed and allowed to capture (root or CAP_NET_RAW).
+func startCapture(path string, port int) (func(), error) {
+	cmd := exec.Command("tcpdump", "-i", "any", "-U", "-n", "-w", path, fmt.Sprintf("tcp port %d", port))
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting tcpdump: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	// tcpdump exits right away if it cannot open the interface.
+	select {
+	case err := <-done:
+		return nil, fmt.Errorf("tcpdump exited: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	transportLog.Infof("Capturing port %d to %s", port, path)
+
+	return func() {
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+		}
+	}, nil
+}
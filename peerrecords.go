@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	lpevent "github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+)
+
+// PeerRecordConfig makes nodes insist on signed peer records: peers learned
+// through PRUNE peer exchange must come with a valid record, and peers
+// whose identify carries none are disconnected. Forged records are dropped
+// either way.
+type PeerRecordConfig struct {
+	Require bool `json:"require"`
+}
+
+// ForgePXConfig makes a node send every peer Rate PRUNEs per second whose
+// peer exchange lists up to Peers of its other peers with records that
+// point to the misbehaving node's own addresses, signed with its own key.
+type ForgePXConfig struct {
+	Rate  float64 `json:"rate"`
+	Peers int     `json:"peers"`
+}
+
+// checkPeerRecord returns why a PX entry cannot be trusted, or "" if it
+// carries a valid record of the peer it names.
+func checkPeerRecord(pi *pb.PeerInfo, require bool) string {
+	if len(pi.GetSignedPeerRecord()) == 0 {
+		if require {
+			return "unsigned"
+		}
+		return ""
+	}
+	env, r, err := record.ConsumeEnvelope(pi.GetSignedPeerRecord(), peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		return "invalid"
+	}
+	rec, ok := r.(*peer.PeerRecord)
+	if !ok {
+		return "invalid"
+	}
+	if rec.PeerID != peer.ID(pi.GetPeerID()) {
+		return "mismatch"
+	}
+	if !rec.PeerID.MatchesPublicKey(env.PublicKey) {
+		return "forged"
+	}
+	return ""
+}
+
+// pxGuard drops the PX entries of inbound PRUNEs that fail checkPeerRecord
+// before the router sees them.
+type pxGuard struct {
+	require bool
+}
+
+func (g pxGuard) inspect(from peer.ID, rpc *pubsub.RPC) error {
+	for _, prune := range rpc.GetControl().GetPrune() {
+		kept := prune.Peers[:0]
+		for _, pi := range prune.GetPeers() {
+			reason := checkPeerRecord(pi, g.require)
+			if reason == "" {
+				kept = append(kept, pi)
+				continue
+			}
+			stats.inc(metricName("px_records_rejected_total", "reason", reason), 1)
+			emitEvent("px_record_rejected", map[string]interface{}{
+				"from":   from.String(),
+				"peer":   peer.ID(pi.GetPeerID()).String(),
+				"topic":  prune.GetTopicID(),
+				"reason": reason,
+			})
+		}
+		prune.Peers = kept
+	}
+	return nil
+}
+
+// watchIdentify counts the peers that did and did not send a signed peer
+// record with identify and, if required, disconnects the latter.
+func watchIdentify(h host.Host, require bool) error {
+	sub, err := h.EventBus().Subscribe(new(lpevent.EvtPeerIdentificationCompleted))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for e := range sub.Out() {
+			evt := e.(lpevent.EvtPeerIdentificationCompleted)
+			if evt.SignedPeerRecord != nil {
+				stats.inc("identify_signed_records_total", 1)
+				continue
+			}
+			stats.inc("identify_unsigned_records_total", 1)
+			if !require {
+				continue
+			}
+			emitEvent("unsigned_peer_record", map[string]interface{}{"peer": evt.Peer.String()})
+			if err := h.Network().ClosePeer(evt.Peer); err != nil {
+				transportLog.Warnf("Error disconnecting %s: %v", evt.Peer, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// runForgedPX sends PRUNEs carrying forged peer records on every topic
+// until end.
+func runForgedPX(ctx context.Context, h host.Host, topics []string, nodeNum int, cfg ForgePXConfig, end time.Time) {
+	if cfg.Rate <= 0 {
+		cfg.Rate = 1
+	}
+	if cfg.Peers <= 0 {
+		cfg.Peers = 5
+	}
+	pubsubLog.Infof("Node %d misbehaving: advertising forged addresses for %d peers", nodeNum, cfg.Peers)
+	key := h.Peerstore().PrivKey(h.ID())
+	newFlooder(ctx, h).run(FloodConfig{Rate: cfg.Rate}, end, "forged_px_rpcs_total", func() *pb.RPC {
+		var infos []*pb.PeerInfo
+		for _, p := range h.Network().Peers() {
+			if len(infos) >= cfg.Peers {
+				break
+			}
+			rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: p, Addrs: h.Addrs()})
+			env, err := record.Seal(rec, key)
+			if err != nil {
+				pubsubLog.Warnf("Error forging peer record: %v", err)
+				continue
+			}
+			data, err := env.Marshal()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, &pb.PeerInfo{PeerID: []byte(p), SignedPeerRecord: data})
+		}
+		ctl := &pb.ControlMessage{}
+		for _, t := range topics {
+			ctl.Prune = append(ctl.Prune, &pb.ControlPrune{TopicID: &t, Peers: infos})
+		}
+		return &pb.RPC{Control: ctl}
+	})
+}
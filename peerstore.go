@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoreds"
+)
+
+// openPeerstore backs the node's peerstore with a LevelDB datastore in dir,
+// so the peers it knew and their addresses survive a restart. The datastore
+// must be closed on shutdown to flush it.
+func openPeerstore(ctx context.Context, dir string) (peerstore.Peerstore, *leveldb.Datastore, error) {
+	store, err := leveldb.NewDatastore(dir, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ps, err := pstoreds.NewPeerstore(ctx, store, pstoreds.DefaultOpts())
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	return ps, store, nil
+}
+
+// reconnectKnownPeers dials every peer with addresses in the peerstore that
+// the node is not connected to yet, which after a restart with a persistent
+// peerstore are the peers of the previous run.
+func reconnectKnownPeers(ctx context.Context, h host.Host, nodeNum int) {
+	for _, p := range h.Peerstore().PeersWithAddrs() {
+		if p == h.ID() || h.Network().Connectedness(p) == network.Connected {
+			continue
+		}
+		if err := connect(ctx, h, h.Peerstore().PeerInfo(p)); err != nil {
+			transportLog.Warnf("Error reconnecting to known peer %s: %v", p, err)
+			continue
+		}
+		transportLog.Infof("Node %d reconnected to known peer: %s", nodeNum, p)
+	}
+}
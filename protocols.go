@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ProtocolConfig pins the listed nodes to gossipsub Version ("1.0", "1.1"
+// or "1.2"): they announce no newer protocol, so every peer falls back to
+// their version with them and leaves out the features it lacks (peer
+// exchange and scoring-era control messages before 1.1, IDONTWANT before
+// 1.2). Nodes pinned by no entry speak every version.
+type ProtocolConfig struct {
+	Nodes   []int  `json:"nodes"`
+	Version string `json:"version"`
+}
+
+// latestProtocol is the version of the nodes that are not pinned.
+const latestProtocol = "1.2"
+
+// protocolLabel is the label with each node's version once some node is
+// pinned, which groups the run report by version.
+const protocolLabel = "protocol"
+
+var gossipsubProtocols = map[string][]protocol.ID{
+	"1.0": {pubsub.GossipSubID_v10, pubsub.FloodSubID},
+	"1.1": {pubsub.GossipSubID_v11, pubsub.GossipSubID_v10, pubsub.FloodSubID},
+	"1.2": pubsub.GossipSubDefaultProtocols,
+}
+
+func (c ProtocolConfig) validate() error {
+	if _, ok := gossipsubProtocols[c.Version]; !ok {
+		return fmt.Errorf("protocols: unknown gossipsub version %q, want 1.0, 1.1 or 1.2", c.Version)
+	}
+	return nil
+}
+
+// protocolVersion is the version node nodeNum speaks, the last entry listing
+// it winning.
+func (c *Config) protocolVersion(nodeNum int) string {
+	version := latestProtocol
+	for _, p := range c.Protocols {
+		for _, n := range p.Nodes {
+			if n == nodeNum {
+				version = p.Version
+			}
+		}
+	}
+	return version
+}
+
+func protocolOptions(version string) []pubsub.Option {
+	return []pubsub.Option{pubsub.WithGossipSubProtocols(gossipsubProtocols[version], pubsub.GossipSubDefaultFeatures)}
+}
+
+func (r *recorder) addPeerProtocol(p, proto string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if r.peerProtocols == nil {
+		r.peerProtocols = make(map[string]string)
+	}
+	r.peerProtocols[p] = proto
+	r.mu.Unlock()
+}
+
+// protocolSummary is how the nodes of one version fared: what they received
+// of the messages published by others and over which protocols their peers
+// talked to them.
+type protocolSummary struct {
+	Version   string         `json:"version"`
+	Nodes     []int          `json:"nodes"`
+	Expected  int            `json:"expected"`
+	Delivered int            `json:"delivered"`
+	Coverage  float64        `json:"coverage"`
+	P50Ms     float64        `json:"p50Ms"`
+	P99Ms     float64        `json:"p99Ms"`
+	Links     map[string]int `json:"links"`
+}
+
+// analyzeProtocols summarises mixed-version runs by version, and returns
+// nil if no node was pinned.
+func analyzeProtocols(reports []nodeReport) []protocolSummary {
+	published := make(map[messageKey]bool)
+	mixed := false
+	for _, rep := range reports {
+		for _, p := range rep.Published {
+			published[messageKey{p.Topic, rep.Node, p.Seq}] = true
+		}
+		if _, ok := rep.Labels[protocolLabel]; ok {
+			mixed = true
+		}
+	}
+	if !mixed {
+		return nil
+	}
+	groups := make(map[string]*protocolSummary)
+	latencies := make(map[string][]float64)
+	for _, rep := range reports {
+		v := rep.Labels[protocolLabel]
+		if v == "" {
+			v = unlabelled
+		}
+		s := groups[v]
+		if s == nil {
+			s = &protocolSummary{Version: v, Links: make(map[string]int)}
+			groups[v] = s
+		}
+		s.Nodes = append(s.Nodes, rep.Node)
+		for k := range published {
+			if k.publisher != rep.Node {
+				s.Expected++
+			}
+		}
+		seen := make(map[messageKey]bool)
+		for _, rr := range rep.Received {
+			k := messageKey{rr.Topic, rr.Publisher, rr.Seq}
+			if rr.Publisher == rep.Node || seen[k] || !published[k] {
+				continue
+			}
+			seen[k] = true
+			latencies[v] = append(latencies[v], latencyMs(rr))
+		}
+		for _, proto := range rep.PeerProtocols {
+			s.Links[proto]++
+		}
+	}
+	var out []protocolSummary
+	for v, s := range groups {
+		l := latencies[v]
+		sort.Float64s(l)
+		s.Delivered = len(l)
+		if s.Expected > 0 {
+			s.Coverage = float64(s.Delivered) / float64(s.Expected)
+		}
+		s.P50Ms = percentile(l, 50)
+		s.P99Ms = percentile(l, 99)
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out
+}
+
+// formatLinks prints links by protocol as "proto=count" pairs.
+func formatLinks(links map[string]int) string {
+	labels := make(map[string]string, len(links))
+	for proto, n := range links {
+		labels[proto] = fmt.Sprint(n)
+	}
+	return formatLabels(labels)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// machineInfo identifies where and with which build a run was made, so
+// results from different machines and versions can be told apart.
+type machineInfo struct {
+	Host     string `json:"host"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	CPUs     int    `json:"cpus"`
+	Go       string `json:"go"`
+	Revision string `json:"revision,omitempty"`
+	// Modified is set when the binary was built from a tree with
+	// uncommitted changes, so Revision alone does not describe it.
+	Modified bool `json:"modified,omitempty"`
+}
+
+func currentMachine() machineInfo {
+	m := machineInfo{OS: runtime.GOOS, Arch: runtime.GOARCH, CPUs: runtime.NumCPU(), Go: runtime.Version()}
+	m.Host, _ = os.Hostname()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				m.Revision = s.Value
+			case "vcs.modified":
+				m.Modified = s.Value == "true"
+			}
+		}
+	}
+	return m
+}
+
+// provenanceModules are the dependencies whose versions decide the
+// protocol's behaviour.
+var provenanceModules = []string{
+	"github.com/libp2p/go-libp2p",
+	"github.com/libp2p/go-libp2p-pubsub",
+	"github.com/multiformats/go-multiaddr",
+}
+
+// provenance is the metadata.json of a run: the build and machine that ran
+// it, the exact inputs and the seed, so the results stay interpretable and
+// can be reproduced long after.
+type provenance struct {
+	Time    string            `json:"time"`
+	Machine machineInfo       `json:"machine"`
+	Modules map[string]string `json:"modules"`
+	Args    []string          `json:"args"`
+	// Config is the experiment config's path and ConfigSHA256 its content
+	// hash; Cluster is the cluster config as run, defaults filled in.
+	Config       string         `json:"config,omitempty"`
+	ConfigSHA256 string         `json:"configSha256,omitempty"`
+	Cluster      *ClusterConfig `json:"cluster,omitempty"`
+	Seed         int64          `json:"seed"`
+}
+
+// moduleVersions returns the versions of provenanceModules the binary was
+// built with; a replaced module is shown as its replacement.
+func moduleVersions() map[string]string {
+	out := make(map[string]string)
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return out
+	}
+	for _, dep := range info.Deps {
+		for _, path := range provenanceModules {
+			if dep.Path != path {
+				continue
+			}
+			v := dep.Version
+			if r := dep.Replace; r != nil {
+				v = strings.TrimSpace(v + " => " + r.Path + " " + r.Version)
+			}
+			out[path] = v
+		}
+	}
+	return out
+}
+
+func fileSHA256(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeProvenance writes dir/metadata.json for a cluster run.
+func writeProvenance(dir string, cc *ClusterConfig) error {
+	p := provenance{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Machine: currentMachine(),
+		Modules: moduleVersions(),
+		Args:    os.Args,
+		Config:  cc.Config,
+		Cluster: cc,
+		Seed:    cc.Seed,
+	}
+	if cc.Config != "" {
+		sum, err := fileSHA256(cc.Config)
+		if err != nil {
+			return err
+		}
+		p.ConfigSHA256 = sum
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "metadata.json"), data, 0644)
+}
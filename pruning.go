@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ScorePruningConfig makes the listed Nodes, or all nodes if none are
+// listed, disconnect their Count lowest-scoring peers (default 1) every
+// Interval (default 10s) and dial as many peers they know of but are not
+// connected to in their place. Only peers scoring below MaxScore, if set,
+// and connected for at least Grace (default Interval) are disconnected, and
+// never so many that fewer than MinPeers (default 2) are left. A peer that
+// was disconnected is not dialed again for Cooldown (default 1m). It needs
+// peer scoring, i.e. a topic with a score block.
+type ScorePruningConfig struct {
+	Nodes    []int    `json:"nodes"`
+	Interval duration `json:"interval"`
+	Count    int      `json:"count"`
+	MaxScore *float64 `json:"maxScore"`
+	Grace    duration `json:"grace"`
+	MinPeers int      `json:"minPeers"`
+	Cooldown duration `json:"cooldown"`
+}
+
+func (c *ScorePruningConfig) validate() error {
+	if c.Interval < 0 || c.Grace < 0 || c.Cooldown < 0 {
+		return fmt.Errorf("scorePruning: durations must not be negative")
+	}
+	if c.Count < 0 || c.MinPeers < 0 {
+		return fmt.Errorf("scorePruning: count and minPeers must not be negative")
+	}
+	return nil
+}
+
+func (c *ScorePruningConfig) applies(nodeNum int) bool {
+	if c == nil {
+		return false
+	}
+	if len(c.Nodes) == 0 {
+		return true
+	}
+	for _, n := range c.Nodes {
+		if n == nodeNum {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ScorePruningConfig) withDefaults() ScorePruningConfig {
+	if c.Interval == 0 {
+		c.Interval = duration(10 * time.Second)
+	}
+	if c.Count == 0 {
+		c.Count = 1
+	}
+	if c.Grace == 0 {
+		c.Grace = c.Interval
+	}
+	if c.MinPeers == 0 {
+		c.MinPeers = 2
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = duration(time.Minute)
+	}
+	return c
+}
+
+// pruneRound is one round of the policy that disconnected peers.
+type pruneRound struct {
+	At       int64        `json:"at"`
+	Pruned   []prunedPeer `json:"pruned"`
+	Replaced []string     `json:"replaced,omitempty"`
+}
+
+type prunedPeer struct {
+	Peer  string  `json:"peer"`
+	Score float64 `json:"score"`
+}
+
+// scorePruner applies a ScorePruningConfig to the score snapshots the
+// router hands to inspect.
+type scorePruner struct {
+	h       host.Host
+	cfg     ScorePruningConfig
+	nodeNum int
+	rec     *recorder
+
+	mu     sync.Mutex
+	scores map[peer.ID]float64
+	pruned map[peer.ID]time.Time
+}
+
+func newScorePruner(h host.Host, cfg ScorePruningConfig, nodeNum int, rec *recorder) *scorePruner {
+	return &scorePruner{h: h, cfg: cfg.withDefaults(), nodeNum: nodeNum, rec: rec, pruned: make(map[peer.ID]time.Time)}
+}
+
+// option has the router pass the pruner a score snapshot every second.
+func (s *scorePruner) option() pubsub.Option {
+	return pubsub.WithPeerScoreInspect(pubsub.PeerScoreInspectFn(s.inspect), time.Second)
+}
+
+func (s *scorePruner) inspect(scores map[peer.ID]float64) {
+	s.mu.Lock()
+	s.scores = scores
+	s.mu.Unlock()
+}
+
+func (s *scorePruner) run(ctx context.Context) {
+	pubsubLog.Infof("Node %d pruning its %d lowest-scoring peers every %s", s.nodeNum, s.cfg.Count, time.Duration(s.cfg.Interval))
+	ticker := time.NewTicker(time.Duration(s.cfg.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.round(ctx)
+		}
+	}
+}
+
+func (s *scorePruner) round(ctx context.Context) {
+	now := time.Now()
+	victims := s.victims(now)
+	if len(victims) == 0 {
+		return
+	}
+	r := pruneRound{At: now.UnixNano()}
+	for _, v := range victims {
+		p, _ := peer.Decode(v.Peer)
+		s.h.Network().ClosePeer(p)
+		s.mu.Lock()
+		s.pruned[p] = now
+		s.mu.Unlock()
+		stats.inc("score_pruned_peers_total", 1)
+		emitEvent("peer_score_pruned", map[string]interface{}{"peer": v.Peer, "score": v.Score})
+		pubsubLog.Infof("Node %d disconnected %s with score %.2f", s.nodeNum, v.Peer, v.Score)
+		r.Pruned = append(r.Pruned, v)
+	}
+	for _, p := range s.candidates(now) {
+		if len(r.Replaced) == len(r.Pruned) {
+			break
+		}
+		if err := connect(ctx, s.h, s.h.Peerstore().PeerInfo(p)); err != nil {
+			transportLog.Debugf("Error dialing replacement peer %s: %v", p, err)
+			continue
+		}
+		stats.inc("score_pruning_replacements_total", 1)
+		transportLog.Infof("Node %d connected to replacement peer: %s", s.nodeNum, p)
+		r.Replaced = append(r.Replaced, p.String())
+	}
+	if len(r.Replaced) < len(r.Pruned) {
+		pubsubLog.Warnf("Node %d found %d of %d replacement peers", s.nodeNum, len(r.Replaced), len(r.Pruned))
+	}
+	s.rec.addPruneRound(r)
+}
+
+// victims picks the connected peers to disconnect, lowest score first.
+func (s *scorePruner) victims(now time.Time) []prunedPeer {
+	s.mu.Lock()
+	scores := s.scores
+	s.mu.Unlock()
+
+	peers := s.h.Network().Peers()
+	var eligible []prunedPeer
+	for _, p := range peers {
+		score, ok := scores[p]
+		if !ok || (s.cfg.MaxScore != nil && score >= *s.cfg.MaxScore) || now.Sub(connectedSince(s.h, p)) < time.Duration(s.cfg.Grace) {
+			continue
+		}
+		eligible = append(eligible, prunedPeer{Peer: p.String(), Score: score})
+	}
+	sort.Slice(eligible, func(i, j int) bool { return eligible[i].Score < eligible[j].Score })
+	n := min(s.cfg.Count, len(peers)-s.cfg.MinPeers, len(eligible))
+	if n <= 0 {
+		return nil
+	}
+	return eligible[:n]
+}
+
+// connectedSince is when the oldest open connection to p was opened.
+func connectedSince(h host.Host, p peer.ID) time.Time {
+	since := time.Now()
+	for _, c := range h.Network().ConnsToPeer(p) {
+		if opened := c.Stat().Opened; opened.Before(since) {
+			since = opened
+		}
+	}
+	return since
+}
+
+// candidates are the peers with addresses in the peerstore, from -peers,
+// peer exchange or earlier connections, that the node is not connected to
+// and did not disconnect within the cooldown, in random order.
+func (s *scorePruner) candidates(now time.Time) []peer.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []peer.ID
+	for _, p := range s.h.Peerstore().PeersWithAddrs() {
+		if p == s.h.ID() || s.h.Network().Connectedness(p) == network.Connected {
+			continue
+		}
+		if at, ok := s.pruned[p]; ok && now.Sub(at) < time.Duration(s.cfg.Cooldown) {
+			continue
+		}
+		out = append(out, p)
+	}
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	return out
+}
+
+func (r *recorder) addPruneRound(p pruneRound) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.pruning = append(r.pruning, p)
+	r.mu.Unlock()
+}
+
+// pruningSummary tells whether score pruning paid off: the p50 latency of
+// first deliveries at the pruning nodes before their first round, between
+// consecutive rounds and after their last one.
+type pruningSummary struct {
+	Nodes    []int          `json:"nodes"`
+	Pruned   int            `json:"pruned"`
+	Replaced int            `json:"replaced"`
+	Periods  []prunedPeriod `json:"periods"`
+}
+
+// prunedPeriod covers the deliveries after Rounds rounds of pruning.
+type prunedPeriod struct {
+	Rounds     int     `json:"rounds"`
+	Deliveries int     `json:"deliveries"`
+	P50Ms      float64 `json:"p50Ms"`
+	P90Ms      float64 `json:"p90Ms"`
+}
+
+// analyzePruning is nil unless a node pruned peers.
+func analyzePruning(reports []nodeReport) *pruningSummary {
+	var s pruningSummary
+	var samples [][]float64
+	for _, rep := range reports {
+		if len(rep.Pruning) == 0 {
+			continue
+		}
+		s.Nodes = append(s.Nodes, rep.Node)
+		for _, r := range rep.Pruning {
+			s.Pruned += len(r.Pruned)
+			s.Replaced += len(r.Replaced)
+		}
+		seen := make(map[messageKey]bool)
+		for _, rr := range rep.Received {
+			k := messageKey{rr.Topic, rr.Publisher, rr.Seq}
+			if rr.Publisher == rep.Node || seen[k] {
+				continue
+			}
+			seen[k] = true
+			rounds := sort.Search(len(rep.Pruning), func(i int) bool { return rep.Pruning[i].At > rr.ReceivedAt })
+			for len(samples) <= rounds {
+				samples = append(samples, nil)
+			}
+			samples[rounds] = append(samples[rounds], latencyMs(rr))
+		}
+	}
+	if len(s.Nodes) == 0 {
+		return nil
+	}
+	for rounds, lat := range samples {
+		if len(lat) == 0 {
+			continue
+		}
+		sort.Float64s(lat)
+		s.Periods = append(s.Periods, prunedPeriod{Rounds: rounds, Deliveries: len(lat), P50Ms: percentile(lat, 50), P90Ms: percentile(lat, 90)})
+	}
+	return &s
+}
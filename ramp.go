@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// RampConfig replaces the constant publish rate with a rate that changes
+// over Duration. Rates are messages per second per publisher and topic:
+//
+//   - linear: from From to To
+//   - step: Steps equal steps from From to To
+//   - sine: oscillating between From and To with the given Period
+//   - burst: From, plus Burst back-to-back messages every Period
+type RampConfig struct {
+	Shape    string   `json:"shape"`
+	From     float64  `json:"from"`
+	To       float64  `json:"to"`
+	Duration duration `json:"duration"`
+	Steps    int      `json:"steps"`
+	Period   duration `json:"period"`
+	Burst    int      `json:"burst"`
+}
+
+func (r *RampConfig) validate() error {
+	switch r.Shape {
+	case "linear", "step", "sine", "burst":
+	default:
+		return fmt.Errorf("workload profile: unknown shape %q", r.Shape)
+	}
+	if r.Duration <= 0 {
+		return fmt.Errorf("workload profile: duration must be positive")
+	}
+	if r.From < 0 || r.To < 0 {
+		return fmt.Errorf("workload profile: rates must not be negative")
+	}
+	return nil
+}
+
+// rate is the target publish rate t into the profile.
+func (r *RampConfig) rate(t time.Duration) float64 {
+	frac := float64(t) / float64(r.Duration)
+	switch r.Shape {
+	case "linear":
+		return r.From + (r.To-r.From)*frac
+	case "step":
+		steps := r.Steps
+		if steps <= 0 {
+			steps = 4
+		}
+		step := math.Min(math.Floor(frac*float64(steps)), float64(steps-1))
+		if steps == 1 {
+			return r.From
+		}
+		return r.From + (r.To-r.From)*step/float64(steps-1)
+	case "sine":
+		period := r.Period
+		if period <= 0 {
+			period = r.Duration
+		}
+		phase := 2 * math.Pi * float64(t) / float64(period)
+		return r.From + (r.To-r.From)*(1-math.Cos(phase))/2
+	}
+	return r.From
+}
+
+// schedule returns the send offsets from the workload start, found by
+// integrating the rate in millisecond steps.
+func (r *RampConfig) schedule() []time.Duration {
+	const dt = time.Millisecond
+	var offsets []time.Duration
+	var acc float64
+	for t := time.Duration(0); t < time.Duration(r.Duration); t += dt {
+		acc += r.rate(t) * dt.Seconds()
+		for acc >= 1-1e-9 {
+			offsets = append(offsets, t)
+			acc--
+		}
+	}
+	if r.Shape == "burst" {
+		period := time.Duration(r.Period)
+		if period <= 0 {
+			period = 10 * time.Second
+		}
+		burst := r.Burst
+		if burst <= 0 {
+			burst = 10
+		}
+		var merged []time.Duration
+		i := 0
+		for b := period; b < time.Duration(r.Duration); b += period {
+			for i < len(offsets) && offsets[i] < b {
+				merged = append(merged, offsets[i])
+				i++
+			}
+			for n := 0; n < burst; n++ {
+				merged = append(merged, b)
+			}
+		}
+		offsets = append(merged, offsets[i:]...)
+	}
+	return offsets
+}
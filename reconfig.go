@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// liveConfig is the part of a node's experiment config that PUT /config
+// can change while it runs: the publish rate, the cost of the topic
+// validators, whether the node churns and the log level.
+type liveConfig struct {
+	mu sync.Mutex
+	// rate scales the publish rate of the workload schedule, which an
+	// adaptive workload does not have.
+	rate     float64
+	adaptive bool
+	costs    map[string]*atomic.Int64
+	churn    *churner
+}
+
+func newLiveConfig() *liveConfig {
+	return &liveConfig{rate: 1, costs: make(map[string]*atomic.Int64)}
+}
+
+func (l *liveConfig) publishRate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// validationCost registers the cost of topic's validator, which starts at
+// d, and returns where the validator reads it.
+func (l *liveConfig) validationCost(topic string, d time.Duration) *atomic.Int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cost := &atomic.Int64{}
+	cost.Store(int64(d))
+	l.costs[topic] = cost
+	return cost
+}
+
+type liveStatus struct {
+	PublishRate    float64           `json:"publishRate"`
+	ValidationCost map[string]string `json:"validationCost,omitempty"`
+	Churn          string            `json:"churn,omitempty"`
+	Log            LoggingConfig     `json:"log"`
+}
+
+func (l *liveConfig) status() liveStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := liveStatus{PublishRate: l.rate, Log: levels.config()}
+	if len(l.costs) > 0 {
+		s.ValidationCost = make(map[string]string)
+		for topic, cost := range l.costs {
+			s.ValidationCost[topic] = time.Duration(cost.Load()).String()
+		}
+	}
+	if l.churn != nil {
+		s.Churn = "on"
+		if l.churn.paused.Load() {
+			s.Churn = "paused"
+		}
+	}
+	return s
+}
+
+// liveChange is one parameter of a PUT /config request, checked and ready
+// to apply.
+type liveChange struct {
+	param, value string
+	apply        func()
+}
+
+// changes checks the parameters of q and returns them in a fixed order, so
+// that a request with an invalid one changes nothing.
+func (l *liveConfig) changes(q url.Values) ([]liveChange, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []liveChange
+	if v := q.Get("publishRate"); v != "" {
+		if l.adaptive {
+			return nil, fmt.Errorf("publishRate: the adaptive workload sets its own rate")
+		}
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("publishRate: %q is not a positive number", v)
+		}
+		out = append(out, liveChange{"publishRate", v, func() {
+			l.mu.Lock()
+			l.rate = rate
+			l.mu.Unlock()
+		}})
+	}
+	if v := q.Get("validationCost"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("validationCost: %q is not a duration", v)
+		}
+		var topics []string
+		if topic := q.Get("topic"); topic != "" {
+			if l.costs[topic] == nil {
+				return nil, fmt.Errorf("validationCost: topic %q has no validator", topic)
+			}
+			topics = []string{topic}
+		} else {
+			for topic := range l.costs {
+				topics = append(topics, topic)
+			}
+			if len(topics) == 0 {
+				return nil, fmt.Errorf("validationCost: no topic has a validator")
+			}
+			sort.Strings(topics)
+		}
+		for _, topic := range topics {
+			cost := l.costs[topic]
+			out = append(out, liveChange{"validationCost", topic + "=" + v, func() { cost.Store(int64(d)) }})
+		}
+	}
+	if v := q.Get("churn"); v != "" {
+		if l.churn == nil {
+			return nil, fmt.Errorf("churn: the node does not churn")
+		}
+		if v != "pause" && v != "resume" {
+			return nil, fmt.Errorf("churn: %q is neither pause nor resume", v)
+		}
+		c := l.churn
+		out = append(out, liveChange{"churn", v, func() { c.paused.Store(v == "pause") }})
+	}
+	if v := q.Get("logLevel"); v != "" {
+		if _, err := parseLogLevel(v); err != nil {
+			return nil, err
+		}
+		component := q.Get("component")
+		out = append(out, liveChange{"logLevel", v, func() { levels.set(component, v) }})
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no parameter to change")
+	}
+	return out, nil
+}
+
+// registerConfig exposes the live config; PUT /config?publishRate=2 doubles
+// the publish rate, and every change is counted and emitted as a
+// config_changed event.
+func (c *controlServer) registerConfig(l *liveConfig) {
+	c.mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, l.status())
+	})
+	c.mux.HandleFunc("PUT /config", func(w http.ResponseWriter, r *http.Request) {
+		changes, err := l.changes(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, ch := range changes {
+			ch.apply()
+			stats.inc(metricName("config_changes_total", "param", ch.param), 1)
+			emitEvent("config_changed", map[string]interface{}{"param": ch.param, "value": ch.value})
+			controlLog.Infof("Set %s to %s", ch.param, ch.value)
+		}
+		writeJSON(w, l.status())
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RegionConfig describes an emulated multi-region deployment. A node's
+// region is the value of its Label label, which Nodes can also assign
+// directly. Latency holds the delay in ms from one region to another, applied
+// on the sender's egress like the ping matrix; a missing entry falls back to
+// the reverse direction and then to Default.
+type RegionConfig struct {
+	Label   string                        `json:"label"`
+	Nodes   map[string][]int              `json:"nodes"`
+	Latency map[string]map[string]float64 `json:"latency"`
+	Default float64                       `json:"default"`
+}
+
+func (r *RegionConfig) label() string {
+	if r.Label == "" {
+		return "region"
+	}
+	return r.Label
+}
+
+func (r *RegionConfig) delay(from, to string) float64 {
+	if d, ok := r.Latency[from][to]; ok {
+		return d
+	}
+	if d, ok := r.Latency[to][from]; ok {
+		return d
+	}
+	return r.Default
+}
+
+// printDelays writes the delay in ms between every ordered pair of the given
+// nodes as "src,dst,ms" lines, for topo.py to install with netem.
+func printDelays(cfg *Config, nodeList string) error {
+	if cfg.Regions == nil {
+		return fmt.Errorf("delays need a config with a regions block")
+	}
+	var nodes []int
+	for _, s := range strings.Split(nodeList, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("delays: %v", err)
+		}
+		nodes = append(nodes, n)
+	}
+	key := cfg.Regions.label()
+	for _, i := range nodes {
+		for _, j := range nodes {
+			if i == j {
+				continue
+			}
+			from, to := cfg.labelsFor(i)[key], cfg.labelsFor(j)[key]
+			fmt.Printf("%d,%d,%g\n", i, j, cfg.Regions.delay(from, to))
+		}
+	}
+	return nil
+}
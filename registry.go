@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// registryWait is how long a node waits for the -peer-nodes to appear in
+// the registry.
+const registryWait = 30 * time.Second
+
+// portValue is -port: a port number, or "auto" (0) for a free one picked
+// when the node listens.
+type portValue int
+
+func (p *portValue) String() string {
+	if *p == 0 {
+		return "auto"
+	}
+	return strconv.Itoa(int(*p))
+}
+
+func (p *portValue) Set(s string) error {
+	if s == "auto" {
+		*p = 0
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("%q is neither a port nor auto", s)
+	}
+	*p = portValue(n)
+	return nil
+}
+
+// registryEntry is the line a node appends to a -registry file once it
+// listens. A restarted node appends a new line, and the last one counts.
+type registryEntry struct {
+	Node   int      `json:"node"`
+	PeerID string   `json:"peerId"`
+	Port   int      `json:"port"`
+	Addrs  []string `json:"addrs"`
+}
+
+// listenPort is the TCP port h listens on, or 0 if it has none.
+func listenPort(h host.Host) int {
+	for _, a := range h.Network().ListenAddresses() {
+		if v, err := a.ValueForProtocol(ma.P_TCP); err == nil {
+			port, _ := strconv.Atoi(v)
+			return port
+		}
+	}
+	return 0
+}
+
+// register appends the node's entry to the registry at path. The entry is
+// written in one append, so that nodes sharing the file do not interleave.
+func register(path string, h host.Host, nodeNum int) error {
+	e := registryEntry{Node: nodeNum, PeerID: h.ID().String(), Port: listenPort(h)}
+	for _, a := range h.Addrs() {
+		e.Addrs = append(e.Addrs, fmt.Sprintf("%s/p2p/%s", a, h.ID()))
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readRegistry returns the latest entry of every node in the registry at
+// path; a missing file has none.
+func readRegistry(path string) (map[int]registryEntry, error) {
+	entries := make(map[int]registryEntry)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e registryEntry
+		// A line being appended may be cut short; it is read again on
+		// the next look.
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		entries[e.Node] = e
+	}
+	return entries, sc.Err()
+}
+
+// lookupPeers waits up to registryWait for nodes to appear in the registry
+// at path and returns the peers it found and the nodes it did not.
+func lookupPeers(ctx context.Context, path string, nodes []int) ([]peer.AddrInfo, []int, error) {
+	ctx, cancel := context.WithTimeout(ctx, registryWait)
+	defer cancel()
+	for {
+		entries, err := readRegistry(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		var found []peer.AddrInfo
+		var missing []int
+		for _, n := range nodes {
+			e, ok := entries[n]
+			if !ok {
+				missing = append(missing, n)
+				continue
+			}
+			pi, err := registryPeer(e)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: node %d: %v", path, n, err)
+			}
+			found = append(found, pi)
+		}
+		if len(missing) == 0 {
+			return found, nil, nil
+		}
+		select {
+		case <-ctx.Done():
+			return found, missing, nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func registryPeer(e registryEntry) (peer.AddrInfo, error) {
+	id, err := peer.Decode(e.PeerID)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	pi := peer.AddrInfo{ID: id}
+	for _, a := range e.Addrs {
+		m, err := ma.NewMultiaddr(strings.TrimSuffix(a, "/p2p/"+e.PeerID))
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		pi.Addrs = append(pi.Addrs, m)
+	}
+	return pi, nil
+}
+
+// parseNodeList parses a comma-separated list of node numbers such as
+// -peer-nodes 2,3,5.
+func parseNodeList(s string) ([]int, error) {
+	var nodes []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("node list %q: %v", s, err)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type receiveRecord struct {
+	Topic      string `json:"topic"`
+	Publisher  int    `json:"publisher"`
+	Seq        uint64 `json:"seq"`
+	SentAt     int64  `json:"sentAt"`
+	ReceivedAt int64  `json:"receivedAt"`
+	From       string `json:"from"`
+}
+
+type publishRecord struct {
+	Topic  string `json:"topic"`
+	Seq    uint64 `json:"seq"`
+	SentAt int64  `json:"sentAt"`
+	// Size is the length of the message payload, without the header.
+	Size int `json:"size,omitempty"`
+}
+
+// nodeReport is written by every node on shutdown (-report) and merged into
+// the final run report by -analyze.
+type nodeReport struct {
+	Node      int                `json:"node"`
+	PeerID    string             `json:"peerId"`
+	Labels    map[string]string  `json:"labels,omitempty"`
+	GossipSub *GossipSubConfig   `json:"gossipsub,omitempty"`
+	Profile   string             `json:"profile,omitempty"`
+	Role      string             `json:"role,omitempty"`
+	Published []publishRecord    `json:"published"`
+	Received  []receiveRecord    `json:"received"`
+	Metrics   map[string]float64 `json:"metrics"`
+	Events    []event            `json:"events"`
+	Resources []resourceSample   `json:"resources"`
+	StartedAt int64              `json:"startedAt,omitempty"`
+	MeshFull  []meshFullRecord   `json:"meshFull,omitempty"`
+	// Connections is the node's connection timeline.
+	Connections []connEvent    `json:"connections,omitempty"`
+	History     []historyFetch `json:"history,omitempty"`
+	// PeerProtocols is the protocol each peer last spoke with the node.
+	PeerProtocols map[string]string `json:"peerProtocols,omitempty"`
+	Outbound      []outboundPeer    `json:"outbound,omitempty"`
+	Adaptive      []adaptiveStep    `json:"adaptive,omitempty"`
+	// Unsampled nodes leave Received empty and only keep Counts.
+	Unsampled bool           `json:"unsampled,omitempty"`
+	Counts    []receiveCount `json:"counts,omitempty"`
+	// Tampered is the number of tampered copies the node relayed, Rejected
+	// what it rejected by peer, see TamperConfig.
+	Tampered int           `json:"tampered,omitempty"`
+	Rejected []rejectCount `json:"rejected,omitempty"`
+	// Pruning lists the rounds of ScorePruningConfig.
+	Pruning []pruneRound `json:"pruning,omitempty"`
+	// SLA lists the windows the node judged against its topics' SLAs.
+	SLA []slaReport `json:"sla,omitempty"`
+}
+
+// recorder collects the messages a node sent and received, in the order in
+// which they happened.
+type recorder struct {
+	mu        sync.Mutex
+	published []publishRecord
+	received  []receiveRecord
+	resources []resourceSample
+	delivered map[messageKey]bool
+	labels    map[string]string
+	gossipsub *GossipSubConfig
+	profile   string
+	role      string
+	conv      *convergenceMonitor
+	outbound  *outboundMonitor
+	// connections is the connection timeline, see watchConnections.
+	connections []connEvent
+	history     []historyFetch
+	// store persists the delivered messages, see StoreConfig.
+	store *messageStore
+	// acks and adaptive are the two ends of the adaptive publisher, see
+	// AdaptiveConfig.
+	acks     *acker
+	adaptive *adaptiveController
+	// sla judges the deliveries against the topics' SLAs, see SLAConfig.
+	sla *slaMonitor
+	// peerProtocols is PeerProtocols, see tracer.AddPeer.
+	peerProtocols map[string]string
+	// process is set on the node that reports the process-wide metrics,
+	// events and resources; the other nodes of a -node-range leave them out.
+	process bool
+	// unsampled is set if the node only counts its deliveries, see
+	// SamplingConfig.
+	unsampled bool
+	counts    map[streamKey]*receiveCount
+	tampered  int
+	rejected  map[rejectKey]int
+	pruning   []pruneRound
+}
+
+func (r *recorder) addPublished(p publishRecord) {
+	r.mu.Lock()
+	r.published = append(r.published, p)
+	r.mu.Unlock()
+}
+
+// addReceived records a delivery and reports whether it was the first one
+// of that message.
+func (r *recorder) addReceived(rr receiveRecord) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.unsampled {
+		r.received = append(r.received, rr)
+	}
+	if r.delivered == nil {
+		r.delivered = make(map[messageKey]bool)
+	}
+	k := messageKey{rr.Topic, rr.Publisher, rr.Seq}
+	first := !r.delivered[k]
+	r.delivered[k] = true
+	if r.unsampled {
+		r.countReceived(rr, first)
+	}
+	return first
+}
+
+func (r *recorder) addResources(s resourceSample) {
+	r.mu.Lock()
+	r.resources = append(r.resources, s)
+	r.mu.Unlock()
+}
+
+func (r *recorder) writeReport(path string, nodeNum int, peerID string) error {
+	r.mu.Lock()
+	rep := nodeReport{
+		Node:          nodeNum,
+		PeerID:        peerID,
+		Labels:        r.labels,
+		GossipSub:     r.gossipsub,
+		Profile:       r.profile,
+		Role:          r.role,
+		Published:     r.published,
+		Received:      r.received,
+		StartedAt:     processStart.UnixNano(),
+		Connections:   r.connections,
+		History:       r.history,
+		PeerProtocols: r.peerProtocols,
+		Adaptive:      r.adaptive.records(),
+		Unsampled:     r.unsampled,
+		Counts:        r.receiveCounts(),
+		Tampered:      r.tampered,
+		Rejected:      r.rejectCounts(),
+		Pruning:       r.pruning,
+		SLA:           r.sla.records(),
+	}
+	if r.process {
+		rep.Metrics, rep.Events, rep.Resources = stats.snapshot(), events.snapshot(), r.resources
+	}
+	if r.conv != nil {
+		rep.MeshFull = r.conv.records()
+	}
+	if r.outbound != nil {
+		rep.Outbound = r.outbound.records()
+	}
+	data, err := json.MarshalIndent(rep, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func loadNodeReports(dir string) ([]nodeReport, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "node*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		// A results run keeps them in nodes/.
+		paths, err = filepath.Glob(filepath.Join(dir, "nodes", "node*.json"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var reports []nodeReport
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var rep nodeReport
+		if err := json.Unmarshal(data, &rep); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		reports = append(reports, rep)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Node < reports[j].Node })
+	return reports, nil
+}
+
+// runReport is the merged result of one experiment run.
+type runReport struct {
+	Nodes     int               `json:"nodes"`
+	Delivery  deliverySummary   `json:"delivery"`
+	Ordering  []orderingReport  `json:"ordering"`
+	Latency   []latencyCell     `json:"latency"`
+	Resources []resourceSummary `json:"resources"`
+	Overhead  []profileOverhead `json:"overhead"`
+	// Convergence is left out for reports written before nodes recorded
+	// their start.
+	Convergence *convergenceSummary `json:"convergence,omitempty"`
+	Connections []connectionSummary `json:"connections,omitempty"`
+	History     *historySummary     `json:"history,omitempty"`
+	Protocols   []protocolSummary   `json:"protocols,omitempty"`
+	Outbound    []outboundDrops     `json:"outbound,omitempty"`
+	Adaptive    []adaptiveSummary   `json:"adaptive,omitempty"`
+	Tampering   *tamperSummary      `json:"tampering,omitempty"`
+	Pruning     *pruningSummary     `json:"pruning,omitempty"`
+	Sizes       []sizeBucket        `json:"sizes,omitempty"`
+	SLA         []slaSummary        `json:"sla,omitempty"`
+	Heartbeats  []heartbeatSummary  `json:"heartbeats,omitempty"`
+	Groups      []labelReport       `json:"groups,omitempty"`
+	Assertions  []assertionResult   `json:"assertions,omitempty"`
+}
+
+// deliverySummary measures the run as a whole: every published message is
+// expected at every other node, and latencies are taken over all first
+// deliveries.
+type deliverySummary struct {
+	Expected  int `json:"expected"`
+	Delivered int `json:"delivered"`
+	// Redelivered counts deliveries of a message a node already had, which
+	// only happen once its ID left the seen cache.
+	Redelivered int     `json:"redelivered"`
+	Coverage    float64 `json:"coverage"`
+	P50Ms       float64 `json:"p50Ms"`
+	P90Ms       float64 `json:"p90Ms"`
+	P99Ms       float64 `json:"p99Ms"`
+	MaxMs       float64 `json:"maxMs"`
+	// Sampled is the number of nodes with full records, which the
+	// latencies are taken over, if not all of them.
+	Sampled int `json:"sampled,omitempty"`
+}
+
+type messageKey struct {
+	topic     string
+	publisher int
+	seq       uint64
+}
+
+func analyzeDelivery(reports []nodeReport) deliverySummary {
+	var d deliverySummary
+	var latencies []float64
+	d.Expected, latencies = firstDeliveries(reports)
+	counted, duplicates := countedDeliveries(reports)
+	d.Delivered = len(latencies) + counted
+	d.Redelivered = duplicates
+	if sampled := len(sampledReports(reports)); sampled < len(reports) {
+		d.Sampled = sampled
+	}
+	for _, rep := range reports {
+		seen := make(map[messageKey]bool)
+		for _, rr := range rep.Received {
+			k := messageKey{rr.Topic, rr.Publisher, rr.Seq}
+			if seen[k] {
+				d.Redelivered++
+			}
+			seen[k] = true
+		}
+	}
+	if d.Expected > 0 {
+		d.Coverage = float64(d.Delivered) / float64(d.Expected)
+	}
+	sort.Float64s(latencies)
+	d.P50Ms = percentile(latencies, 50)
+	d.P90Ms = percentile(latencies, 90)
+	d.P99Ms = percentile(latencies, 99)
+	d.MaxMs = percentile(latencies, 100)
+	return d
+}
+
+// firstDeliveries returns how many deliveries the run should have had and
+// the latency of each first delivery of a published message at another node.
+func firstDeliveries(reports []nodeReport) (expected int, latencies []float64) {
+	published := make(map[messageKey]bool)
+	for _, rep := range reports {
+		for _, p := range rep.Published {
+			published[messageKey{p.Topic, rep.Node, p.Seq}] = true
+		}
+	}
+	receivers := expectedDeliveries(reports)
+	for k := range published {
+		expected += receivers(k.publisher)
+	}
+
+	for _, rep := range reports {
+		seen := make(map[messageKey]bool)
+		for _, rr := range rep.Received {
+			k := messageKey{rr.Topic, rr.Publisher, rr.Seq}
+			if rr.Publisher == rep.Node || seen[k] || !published[k] {
+				continue
+			}
+			seen[k] = true
+			latencies = append(latencies, latencyMs(rr))
+		}
+	}
+	return expected, latencies
+}
+
+// percentile returns the nearest-rank percentile of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// orderingReport describes how one publisher's stream on one topic arrived
+// across all receivers. A message is out of order if a higher sequence
+// number from the same publisher was received before it.
+type orderingReport struct {
+	Topic           string  `json:"topic"`
+	Publisher       int     `json:"publisher"`
+	Published       int     `json:"published"`
+	Received        int     `json:"received"`
+	OutOfOrder      int     `json:"outOfOrder"`
+	OutOfOrderRatio float64 `json:"outOfOrderRatio"`
+	Duplicates      int     `json:"duplicates"`
+	MaxDisplacement uint64  `json:"maxDisplacement"`
+	ReorderingNodes []int   `json:"reorderingNodes"`
+}
+
+type streamKey struct {
+	topic     string
+	publisher int
+}
+
+func analyzeOrdering(reports []nodeReport) []orderingReport {
+	streams := make(map[streamKey]*orderingReport)
+	get := func(k streamKey) *orderingReport {
+		o, ok := streams[k]
+		if !ok {
+			o = &orderingReport{Topic: k.topic, Publisher: k.publisher, ReorderingNodes: []int{}}
+			streams[k] = o
+		}
+		return o
+	}
+
+	for _, rep := range reports {
+		for _, p := range rep.Published {
+			get(streamKey{p.Topic, rep.Node}).Published++
+		}
+	}
+
+	for _, rep := range reports {
+		highest := make(map[streamKey]uint64)
+		seen := make(map[streamKey]map[uint64]bool)
+		reordered := make(map[streamKey]bool)
+		for _, rr := range rep.Received {
+			k := streamKey{rr.Topic, rr.Publisher}
+			o := get(k)
+			if seen[k] == nil {
+				seen[k] = make(map[uint64]bool)
+			}
+			if seen[k][rr.Seq] {
+				o.Duplicates++
+				continue
+			}
+			seen[k][rr.Seq] = true
+			o.Received++
+			if rr.Seq < highest[k] {
+				o.OutOfOrder++
+				reordered[k] = true
+				if d := highest[k] - rr.Seq; d > o.MaxDisplacement {
+					o.MaxDisplacement = d
+				}
+			} else {
+				highest[k] = rr.Seq
+			}
+		}
+		for k := range reordered {
+			streams[k].ReorderingNodes = append(streams[k].ReorderingNodes, rep.Node)
+		}
+	}
+
+	out := make([]orderingReport, 0, len(streams))
+	for _, o := range streams {
+		if o.Received > 0 {
+			o.OutOfOrderRatio = float64(o.OutOfOrder) / float64(o.Received)
+		}
+		sort.Ints(o.ReorderingNodes)
+		out = append(out, *o)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Topic != out[j].Topic {
+			return out[i].Topic < out[j].Topic
+		}
+		return out[i].Publisher < out[j].Publisher
+	})
+	return out
+}
+
+// analyzeRun merges the node reports in dir, prints a summary and writes
+// report.json and the latency heatmap next to them. If checks are given the
+// run fails with an error when one of them does not hold.
+func analyzeRun(dir string, checks []assertion) error {
+	reports, err := loadNodeReports(dir)
+	if err != nil {
+		return err
+	}
+	if len(reports) == 0 {
+		return fmt.Errorf("no node reports found in %s", dir)
+	}
+
+	// The analyses of individual deliveries only see the sampled nodes.
+	sampled := sampledReports(reports)
+	run := runReport{
+		Nodes:       len(reports),
+		Delivery:    analyzeDelivery(reports),
+		Ordering:    analyzeOrdering(sampled),
+		Latency:     analyzeLatencyMatrix(sampled),
+		Resources:   analyzeResources(reports),
+		Heartbeats:  analyzeHeartbeats(reports),
+		Groups:      analyzeGroups(sampled),
+		Convergence: analyzeConvergence(sampled),
+		Connections: analyzeConnections(sampled),
+		History:     analyzeHistory(reports),
+		Protocols:   analyzeProtocols(sampled),
+		Outbound:    analyzeOutbound(reports),
+		Adaptive:    analyzeAdaptive(reports),
+		Tampering:   analyzeTampering(sampled),
+		Pruning:     analyzePruning(sampled),
+		Sizes:       analyzeSizes(sampled),
+		SLA:         analyzeSLA(sampled),
+	}
+
+	fmt.Printf("Nodes: %d\n", run.Nodes)
+	d := run.Delivery
+	fmt.Printf("Delivery: %d/%d (%.2f%%) p50=%.1fms p90=%.1fms p99=%.1fms max=%.1fms redelivered=%d\n",
+		d.Delivered, d.Expected, d.Coverage*100, d.P50Ms, d.P90Ms, d.P99Ms, d.MaxMs, d.Redelivered)
+	if d.Sampled > 0 {
+		fmt.Printf("Latencies and per-node results over %d sampled nodes\n", d.Sampled)
+	}
+	for _, o := range run.Ordering {
+		fmt.Printf("Topic %s publisher %d: published=%d received=%d out-of-order=%d (%.2f%%) max-displacement=%d duplicates=%d\n",
+			o.Topic, o.Publisher, o.Published, o.Received, o.OutOfOrder, o.OutOfOrderRatio*100, o.MaxDisplacement, o.Duplicates)
+	}
+
+	if c := run.Convergence; c != nil {
+		fmt.Printf("Convergence: mesh full at %d/%d nodes p50=%.0fms max=%.0fms after start\n",
+			c.MeshFullNodes, len(c.Nodes), c.MeshFullP50Ms, c.MeshFullMaxMs)
+		if c.AllDeliveredMs > 0 {
+			fmt.Printf("First message at all nodes %.0fms after the first start\n", c.AllDeliveredMs)
+		}
+	}
+
+	for _, c := range run.Connections {
+		if c.Disconnects == 0 {
+			continue
+		}
+		fmt.Printf("Node %d: disconnects=%d disconnected=%.0fms isolated=%.0fms missed=%d (%d while disconnected)\n",
+			c.Node, c.Disconnects, c.DisconnectedMs, c.IsolatedMs, c.Missed, c.MissedDisconnected)
+	}
+
+	if hs := run.History; hs != nil {
+		fmt.Printf("History: %d fetches, %d messages (%d new), catch-up mean=%.1fms max=%.1fms\n",
+			hs.Fetches, hs.Messages, hs.New, hs.MeanMs, hs.MaxMs)
+	}
+
+	for _, d := range run.Outbound {
+		fmt.Printf("Node %d -> %s: outbound dropped=%d of %d RPCs peak-queue=%d\n",
+			d.Node, d.peerName(), d.Dropped, d.Sent+d.Dropped, d.Peak)
+	}
+
+	for _, a := range run.Adaptive {
+		fmt.Printf("Adaptive publisher %d: rate mean=%.1f min=%.1f max=%.1f final=%.1f msg/s over %d windows, %d decreases, mean p95=%.1fms min coverage=%.2f%%\n",
+			a.Node, a.MeanRate, a.MinRate, a.MaxRate, a.FinalRate, a.Windows, a.Decreases, a.MeanP95Ms, a.MinCoverage*100)
+	}
+
+	if t := run.Tampering; t != nil {
+		fmt.Printf("Tampering: nodes %v relayed %d tampered copies, honest nodes rejected %d messages and accepted %d from them\n",
+			t.Adversaries, t.Tampered, t.rejectedTotal(), t.Accepted)
+		for _, r := range t.Rejected {
+			fmt.Printf("Node %d rejected %d from %s: %s\n", r.Node, r.Count, r.peerName(), r.Reason)
+		}
+	}
+
+	if p := run.Pruning; p != nil {
+		fmt.Printf("Score pruning: nodes %v disconnected %d peers and replaced %d\n", p.Nodes, p.Pruned, p.Replaced)
+		for _, pp := range p.Periods {
+			fmt.Printf("After %d rounds: %d deliveries p50=%.1fms p90=%.1fms\n", pp.Rounds, pp.Deliveries, pp.P50Ms, pp.P90Ms)
+		}
+	}
+
+	for _, b := range run.Sizes {
+		fmt.Printf("Size %s: %d messages delivery=%d/%d (%.2f%%) p50=%.1fms p90=%.1fms p99=%.1fms\n",
+			b.Label, b.Messages, b.Delivered, b.Expected, b.Coverage*100, b.P50Ms, b.P90Ms, b.P99Ms)
+	}
+
+	for _, s := range run.SLA {
+		fmt.Printf("SLA %s: %d/%d (%.2f%%) within %s, objective %.2f%%, %d of %d windows violated",
+			s.Topic, s.OnTime, s.Expected, s.Compliance*100, s.within(), s.Coverage*100, s.Violated, s.Windows)
+		if len(s.Nodes) > 0 {
+			fmt.Printf(" at nodes %v", s.Nodes)
+		}
+		fmt.Println()
+	}
+
+	for _, p := range run.Protocols {
+		fmt.Printf("Protocol %s: nodes=%v delivery=%d/%d (%.2f%%) p50=%.1fms p99=%.1fms links: %s\n",
+			p.Version, p.Nodes, p.Delivered, p.Expected, p.Coverage*100, p.P50Ms, p.P99Ms, formatLinks(p.Links))
+	}
+
+	var totalRSS int64
+	for _, r := range run.Resources {
+		fmt.Printf("Node %d: cpu=%.1f%% peak-rss=%.1fMiB peak-goroutines=%d peak-fds=%d\n",
+			r.Node, r.MeanCPUPct, float64(r.PeakRSSBytes)/(1<<20), r.PeakGoroutines, r.PeakOpenFDs)
+		totalRSS += r.PeakRSSBytes
+	}
+	if len(run.Resources) > 0 {
+		fmt.Printf("Sum of peak RSS: %.1fMiB\n", float64(totalRSS)/(1<<20))
+	}
+	run.Overhead = analyzeOverhead(run.Resources)
+	for _, o := range run.Overhead {
+		fmt.Printf("Per-node overhead (%s, %d nodes): cpu=%.1f%% peak-rss=%.1fMiB peak-goroutines=%.0f peak-fds=%.0f\n",
+			o.Profile, o.Nodes, o.MeanCPUPct, o.MeanPeakRSSBytes/(1<<20), o.MeanPeakGoroutines, o.MeanPeakOpenFDs)
+	}
+
+	if len(run.Heartbeats) > 0 {
+		var beats, grafts, prunes, ids int
+		for _, h := range run.Heartbeats {
+			beats += h.Heartbeats
+			grafts += h.Grafts
+			prunes += h.Prunes
+			ids += h.IHaveIDs
+		}
+		n := float64(beats)
+		fmt.Printf("Heartbeats: %d per heartbeat: grafts=%.2f prunes=%.2f ihave-ids=%.2f\n",
+			beats, float64(grafts)/n, float64(prunes)/n, float64(ids)/n)
+	}
+
+	for _, g := range run.Groups {
+		for _, l := range g.Latency {
+			fmt.Printf("%s %s -> %s: messages=%d median=%.1fms p99=%.1fms\n",
+				g.Label, l.From, l.To, l.Messages, l.MedianMs, l.P99Ms)
+		}
+	}
+
+	rows, cols := heatmapAxes(sampled, run.Latency)
+	if err := writeHeatmapCSV(filepath.Join(dir, "heatmap.csv"), rows, cols, run.Latency); err != nil {
+		return err
+	}
+	if err := writeHeatmapPNG(filepath.Join(dir, "heatmap.png"), rows, cols, run.Latency); err != nil {
+		return err
+	}
+
+	failed := 0
+	results := make([]assertionResult, 0, len(checks)+len(run.SLA))
+	for _, a := range checks {
+		results = append(results, a.check(run.Delivery))
+	}
+	// Topic SLAs are checked like -assert limits.
+	for _, s := range run.SLA {
+		results = append(results, s.result())
+	}
+	for _, res := range results {
+		run.Assertions = append(run.Assertions, res)
+		status := "PASS"
+		if !res.Passed {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("%s %s: %s\n", status, res.Assertion, res.Actual)
+	}
+
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, runReportName(dir)), data, 0644); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return assertionError(fmt.Errorf("%d of %d assertions failed", failed, len(results)))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// resourceSample is one reading of the node's own process usage.
+type resourceSample struct {
+	Time       int64   `json:"time"`
+	CPUSeconds float64 `json:"cpuSeconds"`
+	RSSBytes   int64   `json:"rssBytes"`
+	Goroutines int     `json:"goroutines"`
+	OpenFDs    int     `json:"openFds"`
+}
+
+func sampleResources() resourceSample {
+	s := resourceSample{
+		Time:       time.Now().UnixNano(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err == nil {
+		s.CPUSeconds = float64(ru.Utime.Nano()+ru.Stime.Nano()) / 1e9
+	}
+	// /proc is only available on Linux; elsewhere these stay zero.
+	if data, err := os.ReadFile("/proc/self/statm"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 1 {
+			pages, _ := strconv.ParseInt(fields[1], 10, 64)
+			s.RSSBytes = pages * int64(os.Getpagesize())
+		}
+	}
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		s.OpenFDs = len(fds)
+	}
+	return s
+}
+
+func runResourceSampler(interval time.Duration, rec *recorder) {
+	for {
+		s := sampleResources()
+		rec.addResources(s)
+		stats.set("process_cpu_seconds_total", s.CPUSeconds)
+		stats.set("process_resident_memory_bytes", float64(s.RSSBytes))
+		stats.set("process_goroutines", float64(s.Goroutines))
+		stats.set("process_open_fds", float64(s.OpenFDs))
+		time.Sleep(interval)
+	}
+}
+
+// resourceSummary condenses one node's samples for the run report.
+type resourceSummary struct {
+	Node           int              `json:"node"`
+	Profile        string           `json:"profile,omitempty"`
+	MeanCPUPct     float64          `json:"meanCpuPct"`
+	PeakRSSBytes   int64            `json:"peakRssBytes"`
+	PeakGoroutines int              `json:"peakGoroutines"`
+	PeakOpenFDs    int              `json:"peakOpenFds"`
+	Samples        []resourceSample `json:"samples"`
+}
+
+func analyzeResources(reports []nodeReport) []resourceSummary {
+	var out []resourceSummary
+	for _, rep := range reports {
+		if len(rep.Resources) == 0 {
+			continue
+		}
+		sum := resourceSummary{Node: rep.Node, Profile: rep.Profile, Samples: rep.Resources}
+		for _, s := range rep.Resources {
+			if s.RSSBytes > sum.PeakRSSBytes {
+				sum.PeakRSSBytes = s.RSSBytes
+			}
+			if s.Goroutines > sum.PeakGoroutines {
+				sum.PeakGoroutines = s.Goroutines
+			}
+			if s.OpenFDs > sum.PeakOpenFDs {
+				sum.PeakOpenFDs = s.OpenFDs
+			}
+		}
+		first, last := rep.Resources[0], rep.Resources[len(rep.Resources)-1]
+		if elapsed := float64(last.Time-first.Time) / 1e9; elapsed > 0 {
+			sum.MeanCPUPct = (last.CPUSeconds - first.CPUSeconds) / elapsed * 100
+		}
+		out = append(out, sum)
+	}
+	return out
+}
+
+// profileOverhead is what one node of a host profile (-lite or default)
+// costs on average, from the peaks of each node.
+type profileOverhead struct {
+	Profile            string  `json:"profile"`
+	Nodes              int     `json:"nodes"`
+	MeanCPUPct         float64 `json:"meanCpuPct"`
+	MeanPeakRSSBytes   float64 `json:"meanPeakRssBytes"`
+	MeanPeakGoroutines float64 `json:"meanPeakGoroutines"`
+	MeanPeakOpenFDs    float64 `json:"meanPeakOpenFds"`
+}
+
+func analyzeOverhead(resources []resourceSummary) []profileOverhead {
+	byProfile := make(map[string]*profileOverhead)
+	var order []string
+	for _, r := range resources {
+		name := r.Profile
+		if name == "" {
+			name = "default"
+		}
+		o, ok := byProfile[name]
+		if !ok {
+			o = &profileOverhead{Profile: name}
+			byProfile[name] = o
+			order = append(order, name)
+		}
+		o.Nodes++
+		o.MeanCPUPct += r.MeanCPUPct
+		o.MeanPeakRSSBytes += float64(r.PeakRSSBytes)
+		o.MeanPeakGoroutines += float64(r.PeakGoroutines)
+		o.MeanPeakOpenFDs += float64(r.PeakOpenFDs)
+	}
+	var out []profileOverhead
+	for _, name := range order {
+		o := byProfile[name]
+		n := float64(o.Nodes)
+		o.MeanCPUPct /= n
+		o.MeanPeakRSSBytes /= n
+		o.MeanPeakGoroutines /= n
+		o.MeanPeakOpenFDs /= n
+		out = append(out, *o)
+	}
+	return out
+}
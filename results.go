@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A results directory keeps one run per subdirectory, named after its start
+// time and cluster config, or the run it replays:
+//
+//	<run>/metadata.json     provenance of the run
+//	<run>/topology.json     the random graph, with degree
+//	<run>/config/           copies of the experiment and cluster config
+//	<run>/logs/node<N>.log  node output
+//	<run>/nodes/node<N>.json node reports
+//	<run>/metrics/node<N>.prom final metrics in Prometheus text format
+//	<run>/metrics/node<N>.csv metrics sampled every second
+//	<run>/traces/node<N>.pcap packet captures, with pcap
+//	<run>/summary.json      the run report, next to the heatmap
+//
+// and <run>.tar.gz next to it once the run is over.
+var resultsSubdirs = []string{"config", "logs", "nodes", "metrics", "traces"}
+
+// runFile is where the file of kind ("log", "report", "metrics", "history"
+// or "pcap") of node n goes in LogDir: side by side in a plain log
+// directory, sorted into subdirectories in a results directory. Plain log
+// directories have no metrics dumps or histories.
+func (cc *ClusterConfig) runFile(kind string, n int) string {
+	ext := map[string]string{"log": "log", "report": "json", "metrics": "prom", "history": "csv", "pcap": "pcap"}[kind]
+	name := fmt.Sprintf("node%d.%s", n, ext)
+	if !cc.Results {
+		if kind == "metrics" || kind == "history" {
+			return ""
+		}
+		return filepath.Join(cc.LogDir, name)
+	}
+	sub := map[string]string{"log": "logs", "report": "nodes", "metrics": "metrics", "history": "metrics", "pcap": "traces"}[kind]
+	return filepath.Join(cc.LogDir, sub, name)
+}
+
+// newResultsRun points the cluster's LogDir at a fresh run directory under
+// root and copies the configs into it.
+func (cc *ClusterConfig) newResultsRun(root, name, clusterPath string) error {
+	cc.LogDir = filepath.Join(root, time.Now().Format("20060102-150405")+"-"+name)
+	cc.Results = true
+	for _, sub := range resultsSubdirs {
+		if err := os.MkdirAll(filepath.Join(cc.LogDir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	if err := copyFile(clusterPath, filepath.Join(cc.LogDir, "config", "cluster.json")); err != nil {
+		return err
+	}
+	if cc.Config != "" {
+		return copyFile(cc.Config, filepath.Join(cc.LogDir, "config", filepath.Base(cc.Config)))
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}
+
+// runReportName is the run report's file name in dir: summary.json in a
+// results run, report.json in a plain log directory.
+func runReportName(dir string) string {
+	if fi, err := os.Stat(filepath.Join(dir, "nodes")); err == nil && fi.IsDir() {
+		return "summary.json"
+	}
+	return "report.json"
+}
+
+// archiveRun packs dir into dir.tar.gz, with paths relative to its parent
+// so the archive unpacks into the run's own directory.
+func archiveRun(dir string) (string, error) {
+	dir = filepath.Clean(dir)
+	path := dir + ".tar.gz"
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	base := filepath.Dir(dir)
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
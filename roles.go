@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Node roles, which replace the workload's choice of publishers for the
+// nodes that have one:
+//
+//   - "publisher" publishes and joins its topics without subscribing, so
+//     its messages leave through fanout peers
+//   - "subscriber" subscribes and never publishes
+//   - "relay" subscribes, so that it is in the mesh, validates and forwards
+//     messages, but does not deliver them or publish
+//   - "observer" neither subscribes, validates nor publishes, and only
+//     traces what its peers send it
+const (
+	rolePublisher  = "publisher"
+	roleSubscriber = "subscriber"
+	roleRelay      = "relay"
+	roleObserver   = "observer"
+)
+
+// RoleConfig gives the listed Nodes, or all nodes if none are listed, a
+// Role; the last entry listing a node wins.
+type RoleConfig struct {
+	Nodes []int  `json:"nodes"`
+	Role  string `json:"role"`
+}
+
+func (c RoleConfig) validate() error {
+	switch c.Role {
+	case rolePublisher, roleSubscriber, roleRelay, roleObserver:
+		return nil
+	}
+	return fmt.Errorf("roles: unknown role %q", c.Role)
+}
+
+func (c RoleConfig) applies(nodeNum int) bool {
+	if len(c.Nodes) == 0 {
+		return true
+	}
+	for _, n := range c.Nodes {
+		if n == nodeNum {
+			return true
+		}
+	}
+	return false
+}
+
+// roleOf is the role of node nodeNum, or "" if it has none.
+func (c *Config) roleOf(nodeNum int) string {
+	role := ""
+	for _, r := range c.Roles {
+		if r.applies(nodeNum) {
+			role = r.Role
+		}
+	}
+	return role
+}
+
+// publishesAs reports whether a node with role publishes; publisher is the
+// workload's choice for nodes without a role.
+func publishesAs(role string, publisher bool) bool {
+	if role == "" {
+		return publisher
+	}
+	return role == rolePublisher
+}
+
+// subscribes reports whether a node with role subscribes to its topics.
+func subscribes(role string) bool {
+	return role != rolePublisher && role != roleObserver
+}
+
+// relayMessages consumes the messages of a relay's subscription without
+// delivering them, so that the subscription keeps the node in the mesh.
+func relayMessages(ctx context.Context, sub *pubsub.Subscription) {
+	for {
+		msg, err := next(ctx, sub)
+		if err != nil {
+			return
+		}
+		stats.inc(metricName("messages_relayed_total", "topic", msg.GetTopic()), 1)
+	}
+}
+
+// receives reports whether the node delivers messages, which is what the
+// run report expects of every node but relays, observers and publisher-only
+// nodes.
+func (rep nodeReport) receives() bool {
+	return rep.Role == "" || rep.Role == roleSubscriber
+}
+
+// expectedDeliveries is the number of nodes other than the publisher that
+// should deliver each of its messages.
+func expectedDeliveries(reports []nodeReport) func(publisher int) int {
+	receivers := 0
+	receives := make(map[int]bool)
+	for _, rep := range reports {
+		if rep.receives() {
+			receivers++
+			receives[rep.Node] = true
+		}
+	}
+	return func(publisher int) int {
+		if receives[publisher] {
+			return receivers - 1
+		}
+		return receivers
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// SamplingConfig keeps full receive records at a sample of the nodes only,
+// to make delivery experiments with hundreds of nodes fit on one machine:
+// the listed Nodes, and every other node with probability Fraction, drawn
+// from Seed and the node number. Publishers always keep full records. The
+// other nodes only count the messages they get per topic and publisher and
+// log each one at debug level. Coverage still covers every node; latencies
+// and the per-node analyses cover the sampled nodes.
+type SamplingConfig struct {
+	Nodes    []int   `json:"nodes"`
+	Fraction float64 `json:"fraction"`
+	Seed     int64   `json:"seed"`
+}
+
+func (s *SamplingConfig) validate() error {
+	if s.Fraction < 0 || s.Fraction > 1 {
+		return fmt.Errorf("sampling: fraction must be in [0, 1]")
+	}
+	return nil
+}
+
+// samples reports whether nodeNum keeps full records; publisher is whether
+// it publishes.
+func (s *SamplingConfig) samples(nodeNum int, publisher bool) bool {
+	if s == nil || publisher {
+		return true
+	}
+	for _, n := range s.Nodes {
+		if n == nodeNum {
+			return true
+		}
+	}
+	return rand.New(rand.NewSource(s.Seed+int64(nodeNum))).Float64() < s.Fraction
+}
+
+// receiveCount is what an unsampled node keeps of one publisher's stream.
+type receiveCount struct {
+	Topic      string `json:"topic"`
+	Publisher  int    `json:"publisher"`
+	Delivered  int    `json:"delivered"`
+	Duplicates int    `json:"duplicates"`
+}
+
+func (r *recorder) countReceived(rr receiveRecord, first bool) {
+	if r.counts == nil {
+		r.counts = make(map[streamKey]*receiveCount)
+	}
+	k := streamKey{rr.Topic, rr.Publisher}
+	c := r.counts[k]
+	if c == nil {
+		c = &receiveCount{Topic: rr.Topic, Publisher: rr.Publisher}
+		r.counts[k] = c
+	}
+	if first {
+		c.Delivered++
+	} else {
+		c.Duplicates++
+	}
+}
+
+func (r *recorder) receiveCounts() []receiveCount {
+	if r.counts == nil {
+		return nil
+	}
+	out := make([]receiveCount, 0, len(r.counts))
+	for _, c := range r.counts {
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Topic != out[j].Topic {
+			return out[i].Topic < out[j].Topic
+		}
+		return out[i].Publisher < out[j].Publisher
+	})
+	return out
+}
+
+// sampledReports returns the reports with full receive records.
+func sampledReports(reports []nodeReport) []nodeReport {
+	out := make([]nodeReport, 0, len(reports))
+	for _, rep := range reports {
+		if !rep.Unsampled {
+			out = append(out, rep)
+		}
+	}
+	return out
+}
+
+// countedDeliveries adds up the first deliveries and duplicates the
+// unsampled reports counted of the published streams.
+func countedDeliveries(reports []nodeReport) (delivered, duplicates int) {
+	published := make(map[streamKey]bool)
+	for _, rep := range reports {
+		for _, p := range rep.Published {
+			published[streamKey{p.Topic, rep.Node}] = true
+		}
+	}
+	for _, rep := range reports {
+		for _, c := range rep.Counts {
+			if c.Publisher == rep.Node || !published[streamKey{c.Topic, c.Publisher}] {
+				continue
+			}
+			delivered += c.Delivered
+			duplicates += c.Duplicates
+		}
+	}
+	return delivered, duplicates
+}
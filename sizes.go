@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// sizeBuckets are the upper bounds, in bytes of message data, of the size
+// buckets of the run report: 1KiB, the Ethernet MTU, 4KiB, jumbo frames,
+// 16KiB and the largest noise frame. Larger messages go in a last bucket.
+var sizeBuckets = []int{1024, 1500, 4096, 9000, 16384, 65535}
+
+// sizeBucket is the delivery of the messages of one size bucket. Coverage
+// counts the deliveries at the sampled nodes only.
+type sizeBucket struct {
+	Label     string  `json:"label"`
+	MaxBytes  int     `json:"maxBytes,omitempty"`
+	Messages  int     `json:"messages"`
+	Expected  int     `json:"expected"`
+	Delivered int     `json:"delivered"`
+	Coverage  float64 `json:"coverage"`
+	P50Ms     float64 `json:"p50Ms"`
+	P90Ms     float64 `json:"p90Ms"`
+	P99Ms     float64 `json:"p99Ms"`
+}
+
+func sizeBucketOf(size int) int {
+	return sort.SearchInts(sizeBuckets, size)
+}
+
+func sizeBucketLabel(i int) string {
+	if i == len(sizeBuckets) {
+		return fmt.Sprintf(">%dB", sizeBuckets[i-1])
+	}
+	lo := 0
+	if i > 0 {
+		lo = sizeBuckets[i-1] + 1
+	}
+	return fmt.Sprintf("%d-%dB", lo, sizeBuckets[i])
+}
+
+// analyzeSizes breaks the first deliveries down by the size of the message.
+// It is nil unless the published messages fall into more than one bucket.
+func analyzeSizes(reports []nodeReport) []sizeBucket {
+	bucket := make(map[messageKey]int)
+	messages := make([]int, len(sizeBuckets)+1)
+	expected := make([]int, len(messages))
+	receivers := expectedDeliveries(reports)
+	for _, rep := range reports {
+		for _, p := range rep.Published {
+			if p.Size == 0 {
+				continue
+			}
+			b := sizeBucketOf(p.Size)
+			bucket[messageKey{p.Topic, rep.Node, p.Seq}] = b
+			messages[b]++
+			expected[b] += receivers(rep.Node)
+		}
+	}
+	used := 0
+	for _, n := range messages {
+		if n > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		return nil
+	}
+
+	latencies := make([][]float64, len(messages))
+	for _, rep := range reports {
+		seen := make(map[messageKey]bool)
+		for _, rr := range rep.Received {
+			k := messageKey{rr.Topic, rr.Publisher, rr.Seq}
+			b, ok := bucket[k]
+			if rr.Publisher == rep.Node || seen[k] || !ok {
+				continue
+			}
+			seen[k] = true
+			latencies[b] = append(latencies[b], latencyMs(rr))
+		}
+	}
+
+	var out []sizeBucket
+	for i, n := range messages {
+		if n == 0 {
+			continue
+		}
+		lat := latencies[i]
+		sort.Float64s(lat)
+		s := sizeBucket{
+			Label:     sizeBucketLabel(i),
+			Messages:  n,
+			Expected:  expected[i],
+			Delivered: len(lat),
+			P50Ms:     percentile(lat, 50),
+			P90Ms:     percentile(lat, 90),
+			P99Ms:     percentile(lat, 99),
+		}
+		if i < len(sizeBuckets) {
+			s.MaxBytes = sizeBuckets[i]
+		}
+		if s.Expected > 0 {
+			s.Coverage = float64(s.Delivered) / float64(s.Expected)
+		}
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SLAConfig is a topic's delivery objective, e.g. 99% of its messages
+// delivered within 500ms. Every receiver judges its own deliveries once per
+// Window (default 10s).
+type SLAConfig struct {
+	Coverage float64  `json:"coverage"`
+	Within   duration `json:"within"`
+	Window   duration `json:"window"`
+}
+
+func (c *SLAConfig) validate(topic string) error {
+	if c.Coverage <= 0 || c.Coverage > 1 {
+		return fmt.Errorf("topic %s: sla coverage must be in (0, 1]", topic)
+	}
+	if c.Within <= 0 {
+		return fmt.Errorf("topic %s: sla within must be positive", topic)
+	}
+	if c.Window < 0 {
+		return fmt.Errorf("topic %s: sla window must not be negative", topic)
+	}
+	return nil
+}
+
+func (c *SLAConfig) window() time.Duration {
+	if c.Window == 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.Window)
+}
+
+// slaWindow is one judgement of a receiver's deliveries on a topic. Missed
+// counts the gaps in publishers' sequence numbers that were not filled in
+// time.
+type slaWindow struct {
+	End        int64   `json:"end"`
+	Delivered  int     `json:"delivered"`
+	OnTime     int     `json:"onTime"`
+	Missed     int     `json:"missed"`
+	Compliance float64 `json:"compliance"`
+	Met        bool    `json:"met"`
+}
+
+// slaReport is a topic's objective and windows in the node report.
+type slaReport struct {
+	Topic    string      `json:"topic"`
+	Coverage float64     `json:"coverage"`
+	WithinMs float64     `json:"withinMs"`
+	Windows  []slaWindow `json:"windows"`
+}
+
+type slaGap struct {
+	publisher int
+	seq       uint64
+}
+
+// slaTopic is a receiver's account of one topic's current window.
+type slaTopic struct {
+	cfg       SLAConfig
+	delivered int
+	onTime    int
+	missed    int
+	// next is the sequence number expected next from each publisher, and
+	// gaps holds the skipped ones until they are due. judged holds the gaps
+	// already counted as missed, whose late arrivals are not counted again.
+	next     map[int]uint64
+	gaps     map[slaGap]time.Time
+	judged   map[slaGap]bool
+	violated bool
+	windows  []slaWindow
+}
+
+// slaMonitor judges a receiver's first deliveries against the SLAs of its
+// topics. A message that never arrives is noticed once a later one of its
+// publisher does, or at flush if last, the sequence number every publisher
+// ends on, is known.
+type slaMonitor struct {
+	node int
+	last uint64
+
+	mu     sync.Mutex
+	topics map[string]*slaTopic
+}
+
+// newSLAMonitor returns nil if none of the topics has an SLA. last is zero
+// if the publishers' last sequence number is not known in advance.
+func newSLAMonitor(topics []TopicConfig, nodeNum int, last uint64) *slaMonitor {
+	m := &slaMonitor{node: nodeNum, last: last, topics: make(map[string]*slaTopic)}
+	for _, tc := range topics {
+		if tc.SLA != nil {
+			m.topics[tc.Name] = &slaTopic{
+				cfg:    *tc.SLA,
+				next:   make(map[int]uint64),
+				gaps:   make(map[slaGap]time.Time),
+				judged: make(map[slaGap]bool),
+			}
+		}
+	}
+	if len(m.topics) == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m *slaMonitor) add(hdr msgHeader, topic string, receivedAt time.Time) {
+	if m == nil || hdr.Publisher == m.node {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.topics[topic]
+	if t == nil {
+		return
+	}
+	within := time.Duration(t.cfg.Within)
+	g := slaGap{hdr.Publisher, hdr.Seq}
+	if t.judged[g] {
+		delete(t.judged, g)
+		return
+	}
+	delete(t.gaps, g)
+	if next, ok := t.next[hdr.Publisher]; !ok || hdr.Seq >= next {
+		if ok {
+			// The skipped messages were sent before this one, so they are
+			// late once this one's deadline passes.
+			for seq := next; seq < hdr.Seq; seq++ {
+				t.gaps[slaGap{hdr.Publisher, seq}] = hdr.SentAt.Add(within)
+			}
+		}
+		t.next[hdr.Publisher] = hdr.Seq + 1
+	}
+	t.delivered++
+	if receivedAt.Sub(hdr.SentAt) <= within {
+		t.onTime++
+	}
+}
+
+func (m *slaMonitor) run(ctx context.Context) {
+	for name, t := range m.topics {
+		go func(name string, interval time.Duration) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C:
+					m.judge(name, now)
+				}
+			}
+		}(name, t.cfg.window())
+	}
+}
+
+// flush judges the last, partial windows before the node reports. The run
+// is over by then, so every gap still open counts as missed, and so do the
+// messages after the last one received from a publisher.
+func (m *slaMonitor) flush() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	for _, t := range m.topics {
+		for g := range t.gaps {
+			t.miss(g)
+		}
+		for pub, next := range t.next {
+			for seq := next; seq <= m.last; seq++ {
+				t.miss(slaGap{pub, seq})
+			}
+			t.next[pub] = m.last + 1
+		}
+	}
+	m.mu.Unlock()
+	now := time.Now()
+	for name := range m.topics {
+		m.judge(name, now)
+	}
+}
+
+// judge closes the current window of topic name. A window without
+// deliveries or misses is not judged. Every window below the objective is
+// emitted as an sla_violated event, and the first one that meets it again
+// as sla_recovered.
+func (m *slaMonitor) judge(name string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.topics[name]
+	for g, due := range t.gaps {
+		if now.After(due) {
+			t.miss(g)
+		}
+	}
+	total := t.delivered + t.missed
+	if total == 0 {
+		return
+	}
+	w := slaWindow{
+		End:        now.UnixNano(),
+		Delivered:  t.delivered,
+		OnTime:     t.onTime,
+		Missed:     t.missed,
+		Compliance: float64(t.onTime) / float64(total),
+	}
+	w.Met = w.Compliance >= t.cfg.Coverage
+	t.windows = append(t.windows, w)
+	t.delivered, t.onTime, t.missed = 0, 0, 0
+
+	stats.set(metricName("sla_compliance", "topic", name), w.Compliance)
+	stats.inc(metricName("sla_windows_total", "topic", name), 1)
+	fields := map[string]interface{}{
+		"topic":      name,
+		"compliance": w.Compliance,
+		"coverage":   t.cfg.Coverage,
+		"within":     time.Duration(t.cfg.Within).String(),
+		"delivered":  w.Delivered,
+		"missed":     w.Missed,
+	}
+	switch {
+	case !w.Met:
+		stats.inc(metricName("sla_violations_total", "topic", name), 1)
+		emitEvent("sla_violated", fields)
+		t.violated = true
+	case t.violated:
+		emitEvent("sla_recovered", fields)
+		t.violated = false
+	}
+}
+
+func (t *slaTopic) miss(g slaGap) {
+	t.missed++
+	t.judged[g] = true
+	delete(t.gaps, g)
+}
+
+func (m *slaMonitor) records() []slaReport {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []slaReport
+	for name, t := range m.topics {
+		out = append(out, slaReport{
+			Topic:    name,
+			Coverage: t.cfg.Coverage,
+			WithinMs: float64(t.cfg.Within) / float64(time.Millisecond),
+			Windows:  t.windows,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Topic < out[j].Topic })
+	return out
+}
+
+// slaSummary judges a topic over the whole run: OnTime of the Expected
+// deliveries at the sampled nodes arrived within the SLA. Windows and
+// Violated count the windows the receivers judged.
+type slaSummary struct {
+	Topic      string  `json:"topic"`
+	Coverage   float64 `json:"coverage"`
+	WithinMs   float64 `json:"withinMs"`
+	Expected   int     `json:"expected"`
+	OnTime     int     `json:"onTime"`
+	Compliance float64 `json:"compliance"`
+	Met        bool    `json:"met"`
+	Windows    int     `json:"windows"`
+	Violated   int     `json:"violated"`
+	// Nodes are the nodes with a violated window.
+	Nodes []int `json:"nodes,omitempty"`
+}
+
+func analyzeSLA(reports []nodeReport) []slaSummary {
+	summaries := make(map[string]*slaSummary)
+	for _, rep := range reports {
+		for _, r := range rep.SLA {
+			s := summaries[r.Topic]
+			if s == nil {
+				s = &slaSummary{Topic: r.Topic, Coverage: r.Coverage, WithinMs: r.WithinMs}
+				summaries[r.Topic] = s
+			}
+			violated := false
+			for _, w := range r.Windows {
+				s.Windows++
+				if !w.Met {
+					s.Violated++
+					violated = true
+				}
+			}
+			if violated {
+				s.Nodes = append(s.Nodes, rep.Node)
+			}
+		}
+	}
+	if len(summaries) == 0 {
+		return nil
+	}
+
+	receivers := expectedDeliveries(reports)
+	for _, rep := range reports {
+		for _, p := range rep.Published {
+			if s := summaries[p.Topic]; s != nil {
+				s.Expected += receivers(rep.Node)
+			}
+		}
+	}
+	for _, rep := range reports {
+		seen := make(map[messageKey]bool)
+		for _, rr := range rep.Received {
+			k := messageKey{rr.Topic, rr.Publisher, rr.Seq}
+			s := summaries[rr.Topic]
+			if s == nil || rr.Publisher == rep.Node || seen[k] {
+				continue
+			}
+			seen[k] = true
+			if latencyMs(rr) <= s.WithinMs {
+				s.OnTime++
+			}
+		}
+	}
+
+	var out []slaSummary
+	for _, s := range summaries {
+		if s.Expected > 0 {
+			s.Compliance = float64(s.OnTime) / float64(s.Expected)
+		}
+		s.Met = s.Expected > 0 && s.Compliance >= s.Coverage
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Topic < out[j].Topic })
+	return out
+}
+
+func (s slaSummary) within() time.Duration {
+	return time.Duration(s.WithinMs * float64(time.Millisecond))
+}
+
+func (s slaSummary) result() assertionResult {
+	return assertionResult{
+		Assertion: fmt.Sprintf("sla %s: %g%% within %s", s.Topic, s.Coverage*100, s.within()),
+		Actual:    fmt.Sprintf("%.2f%%", s.Compliance*100),
+		Passed:    s.Met,
+	}
+}
+
+// slaWatcher passes a node's output on to w and logs the SLA events in it
+// as they happen, so that the coordinator shows violations during the run.
+// The node's stdout and stderr share one watcher, which exec then writes
+// from a single goroutine.
+type slaWatcher struct {
+	w    io.Writer
+	node int
+	buf  []byte
+	// violations counts the node's sla_violated events.
+	violations int
+}
+
+func (s *slaWatcher) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.buf = append(s.buf, p...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		s.line(s.buf[:i])
+		s.buf = s.buf[i+1:]
+	}
+	return n, err
+}
+
+func (s *slaWatcher) line(line []byte) {
+	i := bytes.Index(line, []byte("EVENT {"))
+	if i < 0 {
+		return
+	}
+	var e event
+	if err := json.Unmarshal(line[i+len("EVENT "):], &e); err != nil {
+		return
+	}
+	compliance, _ := e.Fields["compliance"].(float64)
+	coverage, _ := e.Fields["coverage"].(float64)
+	switch e.Type {
+	case "sla_violated":
+		s.violations++
+		clusterLog.Warnf("Node %d: topic %v below its SLA, %.2f%% within %v (objective %.2f%%)",
+			s.node, e.Fields["topic"], compliance*100, e.Fields["within"], coverage*100)
+	case "sla_recovered":
+		clusterLog.Infof("Node %d: topic %v meets its SLA again, %.2f%% within %v",
+			s.node, e.Fields["topic"], compliance*100, e.Fields["within"])
+	}
+}
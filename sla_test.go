@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSLAMonitorMisses checks that a gap is counted as missed once it is
+// due, that its late arrival is not counted again, and that the messages
+// after the last one received are counted as missed at flush.
+func TestSLAMonitorMisses(t *testing.T) {
+	const topic = "sla"
+	within := 100 * time.Millisecond
+	topics := []TopicConfig{{Name: topic, SLA: &SLAConfig{Coverage: 0.5, Within: duration(within)}}}
+	m := newSLAMonitor(topics, 1, 5)
+	sent := time.Now().Add(-time.Second)
+	receive := func(seq uint64) {
+		m.add(msgHeader{Publisher: 2, Seq: seq, SentAt: sent}, topic, sent.Add(within/2))
+	}
+
+	receive(1)
+	receive(3)
+	m.judge(topic, time.Now())
+	receive(2)
+	m.flush()
+
+	want := []slaWindow{
+		{Delivered: 2, OnTime: 2, Missed: 1},
+		{Delivered: 0, OnTime: 0, Missed: 2},
+	}
+	got := m.records()[0].Windows
+	if len(got) != len(want) {
+		t.Fatalf("got %d windows, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Delivered != w.Delivered || g.OnTime != w.OnTime || g.Missed != w.Missed {
+			t.Errorf("window %d: got delivered=%d onTime=%d missed=%d, want delivered=%d onTime=%d missed=%d",
+				i, g.Delivered, g.OnTime, g.Missed, w.Delivered, w.OnTime, w.Missed)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// nodeSnapshot is the part of a running node's state that is carried over a
+// restart with -restore: its connections, the topics it was in and the
+// messages it had seen. pubsub's own seen cache is not accessible, so the
+// seen IDs are the ones the tracer saw delivered.
+type nodeSnapshot struct {
+	Node      int                 `json:"node"`
+	PeerID    string              `json:"peerId"`
+	Time      int64               `json:"time"`
+	Peers     []string            `json:"peers"`
+	Topics    map[string][]string `json:"topics"`
+	Blacklist BlacklistConfig     `json:"blacklist"`
+	Seen      []seenEntry         `json:"seen"`
+}
+
+// seenEntry holds a message ID as bytes since the default IDs (sender and
+// sequence number) are not valid UTF-8.
+type seenEntry struct {
+	ID   []byte `json:"id"`
+	Time int64  `json:"time"`
+}
+
+// seenSet records the IDs of the messages delivered to this node; ttl is
+// the router's seen cache duration.
+type seenSet struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	ids map[string]int64
+}
+
+func newSeenSet(ttl time.Duration) *seenSet {
+	return &seenSet{ttl: ttl, ids: make(map[string]int64)}
+}
+
+func (s *seenSet) add(id string) {
+	s.mu.Lock()
+	if _, ok := s.ids[id]; !ok {
+		s.ids[id] = time.Now().UnixNano()
+	}
+	s.mu.Unlock()
+}
+
+// recent returns up to n of the most recently seen IDs.
+func (s *seenSet) recent(n int) []string {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.ids))
+	for id := range s.ids {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return s.ids[ids[i]] > s.ids[ids[j]] })
+	s.mu.Unlock()
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// entries returns the IDs still inside pubsub's seen window, the only ones
+// that a restored node must keep refusing.
+func (s *seenSet) entries() []seenEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-s.ttl).UnixNano()
+	var out []seenEntry
+	for id, t := range s.ids {
+		if t >= cutoff {
+			out = append(out, seenEntry{ID: []byte(id), Time: t})
+		}
+	}
+	return out
+}
+
+type snapshotter struct {
+	h      host.Host
+	ps     *pubsub.PubSub
+	bl     *blacklist
+	seen   *seenSet
+	node   int
+	topics []string
+}
+
+func (s *snapshotter) take() nodeSnapshot {
+	snap := nodeSnapshot{
+		Node:      s.node,
+		PeerID:    s.h.ID().String(),
+		Time:      time.Now().UnixNano(),
+		Topics:    make(map[string][]string),
+		Blacklist: s.bl.list(),
+		Seen:      s.seen.entries(),
+	}
+	for _, p := range s.h.Network().Peers() {
+		for _, a := range s.h.Peerstore().Addrs(p) {
+			snap.Peers = append(snap.Peers, fmt.Sprintf("%s/p2p/%s", a, p))
+		}
+	}
+	for _, t := range s.topics {
+		var peers []string
+		for _, p := range s.ps.ListPeers(t) {
+			peers = append(peers, p.String())
+		}
+		snap.Topics[t] = peers
+	}
+	return snap
+}
+
+func (s *snapshotter) write(path string) error {
+	data, err := json.MarshalIndent(s.take(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	nodeLog.Infof("Node %d wrote snapshot %s", s.node, path)
+	return nil
+}
+
+func loadSnapshot(path string) (*nodeSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snap := &nodeSnapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return snap, nil
+}
+
+// missingTopics returns the topics of the snapshot that are not among
+// topics, so the node rejoins everything it was in.
+func (snap *nodeSnapshot) missingTopics(topics []TopicConfig) []TopicConfig {
+	known := make(map[string]bool)
+	for _, tc := range topics {
+		known[tc.Name] = true
+	}
+	var missing []TopicConfig
+	for t := range snap.Topics {
+		if !known[t] {
+			missing = append(missing, TopicConfig{Name: t})
+		}
+	}
+	return missing
+}
+
+// restoreSeen makes the node ignore the messages it had seen before the
+// snapshot until they would have left pubsub's seen cache.
+func (snap *nodeSnapshot) restoreSeen(ps *pubsub.PubSub, topics []string, ttl time.Duration) error {
+	expiry := make(map[string]time.Time, len(snap.Seen))
+	for _, e := range snap.Seen {
+		expiry[string(e.ID)] = time.Unix(0, e.Time).Add(ttl)
+	}
+	validate := func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		if t, ok := expiry[msg.ID]; ok && time.Now().Before(t) {
+			stats.inc(metricName("restored_seen_ignored_total", "topic", msg.GetTopic()), 1)
+			return pubsub.ValidationIgnore
+		}
+		return pubsub.ValidationAccept
+	}
+	for _, t := range topics {
+		if err := ps.RegisterTopicValidator(t, validate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreConnections dials the peers the node was connected to.
+func (snap *nodeSnapshot) restoreConnections(ctx context.Context, h host.Host, nodeNum int) {
+	var addrs []multiaddr.Multiaddr
+	for _, a := range snap.Peers {
+		maddr, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			transportLog.Warnf("Error parsing snapshot peer %s: %v", a, err)
+			continue
+		}
+		addrs = append(addrs, maddr)
+	}
+	infos, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		transportLog.Warnf("Error parsing snapshot peers: %v", err)
+		return
+	}
+	for _, info := range infos {
+		if err := connect(ctx, h, info); err != nil {
+			transportLog.Warnf("Error restoring connection to %s: %v", info.ID, err)
+			continue
+		}
+		transportLog.Infof("Node %d restored connection to %s", nodeNum, info.ID)
+	}
+}
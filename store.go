@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// StoreConfig makes the listed Nodes (default: all) persist every message
+// delivered to them to Dir/node<N>.store (default dir "store") before
+// handling it, on the goroutine that drains the subscription, so slow
+// persistence backs up into the subscription buffer. Every write takes at
+// least WriteLatency and every fsync at least FsyncLatency. Fsync is
+// "always" (default, after every write), "interval" (every FsyncInterval,
+// default 1s, blocking writes meanwhile) or "never".
+type StoreConfig struct {
+	Dir           string   `json:"dir"`
+	Nodes         []int    `json:"nodes"`
+	WriteLatency  duration `json:"writeLatency"`
+	Fsync         string   `json:"fsync"`
+	FsyncInterval duration `json:"fsyncInterval"`
+	FsyncLatency  duration `json:"fsyncLatency"`
+}
+
+func (c *StoreConfig) validate() error {
+	switch c.Fsync {
+	case "", "always", "interval", "never":
+	default:
+		return fmt.Errorf("store: unknown fsync policy %q", c.Fsync)
+	}
+	if c.WriteLatency < 0 || c.FsyncLatency < 0 || c.FsyncInterval < 0 {
+		return fmt.Errorf("store: latencies must not be negative")
+	}
+	return nil
+}
+
+func (c *StoreConfig) applies(nodeNum int) bool {
+	if c == nil {
+		return false
+	}
+	if len(c.Nodes) == 0 {
+		return true
+	}
+	for _, n := range c.Nodes {
+		if n == nodeNum {
+			return true
+		}
+	}
+	return false
+}
+
+// messageStore appends messages to a file as a 4-byte big-endian length
+// followed by the message data.
+type messageStore struct {
+	cfg StoreConfig
+
+	mu    sync.Mutex
+	f     *os.File
+	dirty bool
+	done  chan struct{}
+}
+
+func openMessageStore(cfg StoreConfig, nodeNum int) (*messageStore, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = "store"
+	}
+	if cfg.Fsync == "" {
+		cfg.Fsync = "always"
+	}
+	if cfg.FsyncInterval == 0 {
+		cfg.FsyncInterval = duration(time.Second)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(cfg.Dir, fmt.Sprintf("node%d.store", nodeNum))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &messageStore{cfg: cfg, f: f, done: make(chan struct{})}
+	if cfg.Fsync == "interval" {
+		go s.syncLoop()
+	}
+	return s, nil
+}
+
+// write persists msg under the fsync policy.
+func (s *messageStore) write(msg *pubsub.Message) {
+	if s == nil {
+		return
+	}
+	start := time.Now()
+	topic := msg.GetTopic()
+	buf := make([]byte, 4+len(msg.Data))
+	binary.BigEndian.PutUint32(buf, uint32(len(msg.Data)))
+	copy(buf[4:], msg.Data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return
+	}
+	if _, err := s.f.Write(buf); err != nil {
+		pubsubLog.Warnf("Error writing message store: %v", err)
+		stats.inc(metricName("store_errors_total", "topic", topic), 1)
+		return
+	}
+	time.Sleep(time.Until(start.Add(time.Duration(s.cfg.WriteLatency))))
+	s.dirty = true
+	if s.cfg.Fsync == "always" {
+		s.sync()
+	}
+	stats.inc(metricName("store_writes_total", "topic", topic), 1)
+	stats.inc(metricName("store_bytes_total", "topic", topic), float64(len(buf)))
+	stats.inc(metricName("store_write_seconds_total", "topic", topic), time.Since(start).Seconds())
+}
+
+// sync flushes the file to disk; s.mu must be held.
+func (s *messageStore) sync() {
+	if !s.dirty {
+		return
+	}
+	start := time.Now()
+	if err := s.f.Sync(); err != nil {
+		pubsubLog.Warnf("Error syncing message store: %v", err)
+		stats.inc("store_fsync_errors_total", 1)
+		return
+	}
+	time.Sleep(time.Until(start.Add(time.Duration(s.cfg.FsyncLatency))))
+	s.dirty = false
+	stats.inc("store_fsyncs_total", 1)
+	stats.inc("store_fsync_seconds_total", time.Since(start).Seconds())
+}
+
+func (s *messageStore) syncLoop() {
+	ticker := time.NewTicker(time.Duration(s.cfg.FsyncInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.sync()
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// close syncs whatever the policy has not, unless it is "never".
+func (s *messageStore) close() error {
+	if s == nil {
+		return nil
+	}
+	close(s.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg.Fsync != "never" {
+		s.sync()
+	}
+	f := s.f
+	s.f = nil
+	return f.Close()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// TamperConfig makes a node relay every message with Bytes payload bytes
+// flipped (default 1) but the original author, sequence number and
+// signature. Honest nodes drop copies of a message they have already seen
+// before checking the signature; Seqno also changes the sequence number, so
+// every copy gets a new ID and has its signature checked.
+type TamperConfig struct {
+	Bytes int  `json:"bytes"`
+	Seqno bool `json:"seqno"`
+}
+
+// tamperer forwards the mutated copies on one raw stream per peer.
+type tamperer struct {
+	h   host.Host
+	cfg TamperConfig
+	rec *recorder
+
+	mu sync.Mutex
+	f  *flooder
+}
+
+// tamper replaces the normal forwarding of the topics by tampered copies:
+// the node ignores each message and sends every connected peer but the
+// ones it came from a mutated copy instead.
+func tamper(ctx context.Context, h host.Host, ps *pubsub.PubSub, topics []string, nodeNum int, cfg TamperConfig, rec *recorder) error {
+	if cfg.Bytes <= 0 {
+		cfg.Bytes = 1
+	}
+	pubsubLog.Infof("Node %d misbehaving: relaying messages with %d bytes flipped", nodeNum, cfg.Bytes)
+	t := &tamperer{h: h, cfg: cfg, rec: rec, f: newFlooder(ctx, h)}
+	for _, topic := range topics {
+		err := ps.RegisterTopicValidator(topic, func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+			// The node's own messages go out untouched, so that a
+			// tampering publisher still publishes.
+			if msg.ReceivedFrom == h.ID() {
+				return pubsub.ValidationAccept
+			}
+			t.relay(msg)
+			return pubsub.ValidationIgnore
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tamperer) relay(msg *pubsub.Message) {
+	m := t.mutate(msg.Message)
+	rpc := &pb.RPC{Publish: []*pb.Message{m}}
+	author := peer.ID(msg.GetFrom())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.h.Network().Peers() {
+		if p == msg.ReceivedFrom || p == author {
+			continue
+		}
+		if err := t.f.send(p, rpc); err != nil {
+			pubsubLog.Debugf("Error relaying tampered message to %s: %v", p, err)
+			continue
+		}
+		stats.inc(metricName("tampered_messages_total", "topic", msg.GetTopic()), 1)
+		t.rec.addTampered()
+	}
+}
+
+// mutate copies m with cfg.Bytes bytes flipped from the end of the data, so
+// that the message header stays intact as long as there is a payload.
+func (t *tamperer) mutate(m *pb.Message) *pb.Message {
+	out := *m
+	out.Data = append([]byte(nil), m.GetData()...)
+	for i := 0; i < t.cfg.Bytes && i < len(out.Data); i++ {
+		out.Data[len(out.Data)-1-i] ^= 0xff
+	}
+	if t.cfg.Seqno && len(m.GetSeqno()) == 8 {
+		out.Seqno = binary.BigEndian.AppendUint64(nil, binary.BigEndian.Uint64(m.GetSeqno())^1<<63)
+	}
+	return &out
+}
+
+func (r *recorder) addTampered() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.tampered++
+	r.mu.Unlock()
+}
+
+// rejectKey is a peer whose messages a node rejected, and why.
+type rejectKey struct {
+	peer, reason string
+}
+
+// rejectCount is how many messages a node rejected from Peer for Reason.
+type rejectCount struct {
+	Peer   string `json:"peer"`
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+func (r *recorder) addRejected(p peer.ID, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if r.rejected == nil {
+		r.rejected = make(map[rejectKey]int)
+	}
+	r.rejected[rejectKey{p.String(), reason}]++
+	r.mu.Unlock()
+}
+
+func (r *recorder) rejectCounts() []rejectCount {
+	var out []rejectCount
+	for k, n := range r.rejected {
+		out = append(out, rejectCount{Peer: k.peer, Reason: k.reason, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Peer != out[j].Peer {
+			return out[i].Peer < out[j].Peer
+		}
+		return out[i].Reason < out[j].Reason
+	})
+	return out
+}
+
+// tamperSummary checks a tampering run: how many tampered copies the
+// adversaries relayed, which honest nodes rejected messages from whom, and
+// how many messages honest nodes accepted from an adversary, which are
+// tampered copies that got past the signature check.
+type tamperSummary struct {
+	Adversaries []int              `json:"adversaries"`
+	Tampered    int                `json:"tampered"`
+	Rejected    []rejectionSummary `json:"rejected"`
+	Accepted    int                `json:"accepted"`
+}
+
+// rejectionSummary is a rejectCount of one node, with the peer's node or -1
+// if the peer has no report.
+type rejectionSummary struct {
+	Node     int    `json:"node"`
+	Peer     string `json:"peer"`
+	PeerNode int    `json:"peerNode"`
+	Reason   string `json:"reason"`
+	Count    int    `json:"count"`
+}
+
+func (r rejectionSummary) peerName() string {
+	if r.PeerNode >= 0 {
+		return fmt.Sprintf("node %d", r.PeerNode)
+	}
+	return r.Peer
+}
+
+// analyzeTampering is nil unless a node relayed tampered messages.
+func analyzeTampering(reports []nodeReport) *tamperSummary {
+	var s tamperSummary
+	adversary := make(map[string]bool)
+	nodeOf := make(map[string]int)
+	for _, rep := range reports {
+		nodeOf[rep.PeerID] = rep.Node
+		if rep.Tampered > 0 {
+			s.Adversaries = append(s.Adversaries, rep.Node)
+			s.Tampered += rep.Tampered
+			adversary[rep.PeerID] = true
+		}
+	}
+	if len(s.Adversaries) == 0 {
+		return nil
+	}
+	for _, rep := range reports {
+		if adversary[rep.PeerID] {
+			continue
+		}
+		for _, rc := range rep.Rejected {
+			r := rejectionSummary{Node: rep.Node, Peer: rc.Peer, PeerNode: -1, Reason: rc.Reason, Count: rc.Count}
+			if n, ok := nodeOf[rc.Peer]; ok {
+				r.PeerNode = n
+			}
+			s.Rejected = append(s.Rejected, r)
+		}
+		for _, rr := range rep.Received {
+			if adversary[rr.From] {
+				s.Accepted++
+			}
+		}
+	}
+	return &s
+}
+
+func (s *tamperSummary) rejectedTotal() int {
+	n := 0
+	for _, r := range s.Rejected {
+		n += r.Count
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// timeouts bound the network operations of every node in the process, so
+// that a stuck peer cannot hang a node. They are set by -connect-timeout,
+// -publish-timeout and -next-timeout; zero means no limit.
+var timeouts = struct {
+	// connect covers dialing a peer or opening a stream to it.
+	connect time.Duration
+	// publish covers handing a message to the router, which includes
+	// validating it.
+	publish time.Duration
+	// next is how long a subscription may go without a message before it
+	// is counted as idle; the node keeps waiting.
+	next time.Duration
+}{
+	connect: 10 * time.Second,
+	publish: 10 * time.Second,
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// connect dials pi within the connect timeout.
+func connect(ctx context.Context, h host.Host, pi peer.AddrInfo) error {
+	ctx, cancel := withTimeout(ctx, timeouts.connect)
+	defer cancel()
+	return h.Connect(ctx, pi)
+}
+
+// newStream opens a stream to p within the connect timeout.
+func newStream(ctx context.Context, h host.Host, p peer.ID, protos ...protocol.ID) (network.Stream, error) {
+	ctx, cancel := withTimeout(ctx, timeouts.connect)
+	defer cancel()
+	return h.NewStream(ctx, p, protos...)
+}
+
+// publish publishes data on topic within the publish timeout.
+func publish(ctx context.Context, topic *pubsub.Topic, data []byte) error {
+	ctx, cancel := withTimeout(ctx, timeouts.publish)
+	defer cancel()
+	return topic.Publish(ctx, data)
+}
+
+// next waits for the next message of sub until ctx is done, counting every
+// next timeout that passes without one in subscription_idle_total.
+func next(ctx context.Context, sub *pubsub.Subscription) (*pubsub.Message, error) {
+	for {
+		wait, cancel := withTimeout(ctx, timeouts.next)
+		msg, err := sub.Next(wait)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			stats.inc(metricName("subscription_idle_total", "topic", sub.Topic()), 1)
+			pubsubLog.Debugf("No message on %s for %s", sub.Topic(), timeouts.next)
+			continue
+		}
+		return msg, err
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricHistory buffers a snapshot of every metric each interval, so that
+// -metrics-history can write the time series on shutdown.
+type metricHistory struct {
+	mu      sync.Mutex
+	samples []metricSample
+}
+
+type metricSample struct {
+	at     time.Time
+	values map[string]float64
+}
+
+func (h *metricHistory) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.sample()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *metricHistory) sample() {
+	s := metricSample{at: time.Now(), values: stats.snapshot()}
+	h.mu.Lock()
+	h.samples = append(h.samples, s)
+	h.mu.Unlock()
+}
+
+// write takes a last sample and writes the samples to path as CSV in long
+// form, one time,node,metric,labels,value row per metric and sample, which
+// pandas and DuckDB read as is. labels are the metric's Prometheus labels
+// without the braces, e.g. topic="a".
+func (h *metricHistory) write(path string, nodeNum int) error {
+	h.sample()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"time", "node", "metric", "labels", "value"})
+	node := strconv.Itoa(nodeNum)
+	h.mu.Lock()
+	for _, s := range h.samples {
+		at := s.at.UTC().Format(time.RFC3339Nano)
+		names := make([]string, 0, len(s.values))
+		for k := range s.values {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			name, labels := splitMetricName(k)
+			w.Write([]string{at, node, name, labels, strconv.FormatFloat(s.values[k], 'g', -1, 64)})
+		}
+	}
+	h.mu.Unlock()
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// splitMetricName splits a metricName into the name and its labels.
+func splitMetricName(k string) (name, labels string) {
+	i := strings.IndexByte(k, '{')
+	if i < 0 {
+		return k, ""
+	}
+	return k[:i], strings.TrimSuffix(k[i+1:], "}")
+}
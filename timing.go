@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// TimingConfig shapes when a publisher actually sends each message of the
+// schedule. Align moves every send time up to the next multiple of Align on
+// the wall clock, the same instant on every synchronised machine, so all
+// publishers send their n-th message together. Window then spreads each
+// send over a random point in the first Window after it, which bounds the
+// burst, e.g. all publishers within the same 10ms. Jitter moves every send
+// time by a random amount of up to ±Jitter. Random offsets derive from Seed
+// and the publisher's node number; no message goes out before the previous
+// one.
+type TimingConfig struct {
+	Align  duration `json:"align"`
+	Window duration `json:"window"`
+	Jitter duration `json:"jitter"`
+	Seed   int64    `json:"seed"`
+}
+
+func (t *TimingConfig) validate() error {
+	if t.Align < 0 || t.Window < 0 || t.Jitter < 0 {
+		return fmt.Errorf("workload timing: durations must not be negative")
+	}
+	if t.Align > 0 && t.Window > t.Align {
+		return fmt.Errorf("workload timing: window must not exceed align")
+	}
+	return nil
+}
+
+// slack is how much later than scheduled a message can go out.
+func (t *TimingConfig) slack() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Duration(t.Align + t.Window + t.Jitter)
+}
+
+// sendTimes turns the schedule's offsets from start into the wall-clock
+// times at which the publisher sends.
+func (w WorkloadConfig) sendTimes(start time.Time, nodeNum int) []time.Time {
+	offsets := w.schedule()
+	times := make([]time.Time, len(offsets))
+	t := w.Timing
+	var rng *rand.Rand
+	if t != nil {
+		rng = rand.New(rand.NewSource(t.Seed + int64(nodeNum)))
+	}
+	for i, offset := range offsets {
+		at := start.Add(offset)
+		if t != nil {
+			if t.Align > 0 {
+				align := time.Duration(t.Align)
+				if rem := time.Duration(at.UnixNano() % int64(align)); rem > 0 {
+					at = at.Add(align - rem)
+				}
+			}
+			if t.Window > 0 {
+				at = at.Add(time.Duration(rng.Int63n(int64(t.Window))))
+			}
+			if t.Jitter > 0 {
+				at = at.Add(time.Duration(rng.Int63n(2*int64(t.Jitter)+1) - int64(t.Jitter)))
+			}
+		}
+		if i > 0 && at.Before(times[i-1]) {
+			at = times[i-1]
+		}
+		times[i] = at
+	}
+	return times
+}
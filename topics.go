@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p-pubsub/timecache"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// GossipSubConfig overrides the router-wide gossipsub parameters. Zero values
+// keep the library defaults.
+type GossipSubConfig struct {
+	D                   int      `json:"d"`
+	Dlo                 int      `json:"dlo"`
+	Dhi                 int      `json:"dhi"`
+	Dscore              int      `json:"dscore"`
+	Dout                int      `json:"dout"`
+	Dlazy               int      `json:"dlazy"`
+	GossipFactor        float64  `json:"gossipFactor"`
+	HistoryLength       int      `json:"historyLength"`
+	HistoryGossip       int      `json:"historyGossip"`
+	HeartbeatInterval   duration `json:"heartbeatInterval"`
+	FanoutTTL           duration `json:"fanoutTTL"`
+	FloodPublish        *bool    `json:"floodPublish"`
+	PeerExchange        bool     `json:"peerExchange"`
+	PrunePeers          int      `json:"prunePeers"`
+	PruneBackoff        duration `json:"pruneBackoff"`
+	GraftFloodThreshold duration `json:"graftFloodThreshold"`
+	HeartbeatEvents     bool     `json:"heartbeatEvents"`
+	// SeenTTL and SeenStrategy configure the seen-messages cache, which
+	// go-libp2p-pubsub only bounds by age, not by size.
+	SeenTTL      duration `json:"seenTTL"`
+	SeenStrategy string   `json:"seenStrategy"`
+	// OutboundQueueSize is the RPCs the router queues per peer before it
+	// drops (default 32).
+	OutboundQueueSize int `json:"outboundQueueSize"`
+}
+
+func (g GossipSubConfig) validate() error {
+	switch g.SeenStrategy {
+	case "", "first-seen", "last-seen":
+		return nil
+	}
+	return fmt.Errorf("gossipsub: unknown seenStrategy %q", g.SeenStrategy)
+}
+
+// seenTTL is how long a message ID stays in the router's seen cache.
+func (g GossipSubConfig) seenTTL() time.Duration {
+	if g.SeenTTL != 0 {
+		return time.Duration(g.SeenTTL)
+	}
+	return pubsub.TimeCacheDuration
+}
+
+// TopicConfig describes one topic the node joins. Router parameters such as
+// flood publishing and lazy gossip degree are shared by every topic in
+// go-libp2p-pubsub, so a topic's behaviour can only be tuned through its
+// buffer, score parameters, validator and SLA.
+type TopicConfig struct {
+	Name       string                `json:"name"`
+	BufferSize int                   `json:"bufferSize"`
+	Score      *TopicScoreConfig     `json:"score"`
+	Validator  *TopicValidatorConfig `json:"validator"`
+	SLA        *SLAConfig            `json:"sla"`
+}
+
+type TopicScoreConfig struct {
+	TopicWeight                     float64  `json:"topicWeight"`
+	TimeInMeshWeight                float64  `json:"timeInMeshWeight"`
+	TimeInMeshQuantum               duration `json:"timeInMeshQuantum"`
+	TimeInMeshCap                   float64  `json:"timeInMeshCap"`
+	FirstMessageDeliveriesWeight    float64  `json:"firstMessageDeliveriesWeight"`
+	FirstMessageDeliveriesDecay     float64  `json:"firstMessageDeliveriesDecay"`
+	FirstMessageDeliveriesCap       float64  `json:"firstMessageDeliveriesCap"`
+	MeshMessageDeliveriesWeight     float64  `json:"meshMessageDeliveriesWeight"`
+	MeshMessageDeliveriesDecay      float64  `json:"meshMessageDeliveriesDecay"`
+	MeshMessageDeliveriesCap        float64  `json:"meshMessageDeliveriesCap"`
+	MeshMessageDeliveriesThreshold  float64  `json:"meshMessageDeliveriesThreshold"`
+	MeshMessageDeliveriesWindow     duration `json:"meshMessageDeliveriesWindow"`
+	MeshMessageDeliveriesActivation duration `json:"meshMessageDeliveriesActivation"`
+	MeshFailurePenaltyWeight        float64  `json:"meshFailurePenaltyWeight"`
+	MeshFailurePenaltyDecay         float64  `json:"meshFailurePenaltyDecay"`
+	InvalidMessageDeliveriesWeight  float64  `json:"invalidMessageDeliveriesWeight"`
+	InvalidMessageDeliveriesDecay   float64  `json:"invalidMessageDeliveriesDecay"`
+}
+
+// ScoreThresholdsConfig overrides the peer score thresholds field by field;
+// a zero field keeps the default.
+type ScoreThresholdsConfig struct {
+	Gossip             float64 `json:"gossip"`
+	Publish            float64 `json:"publish"`
+	Graylist           float64 `json:"graylist"`
+	AcceptPX           float64 `json:"acceptPX"`
+	OpportunisticGraft float64 `json:"opportunisticGraft"`
+}
+
+func (c *ScoreThresholdsConfig) params() *pubsub.PeerScoreThresholds {
+	t := &pubsub.PeerScoreThresholds{
+		GossipThreshold:   -10,
+		PublishThreshold:  -50,
+		GraylistThreshold: -80,
+	}
+	if c == nil {
+		return t
+	}
+	set := func(dst *float64, v float64) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	set(&t.GossipThreshold, c.Gossip)
+	set(&t.PublishThreshold, c.Publish)
+	set(&t.GraylistThreshold, c.Graylist)
+	set(&t.AcceptPXThreshold, c.AcceptPX)
+	set(&t.OpportunisticGraftThreshold, c.OpportunisticGraft)
+	return t
+}
+
+func (c *ScoreThresholdsConfig) validate() error {
+	t := c.params()
+	switch {
+	case t.GossipThreshold > 0:
+		return fmt.Errorf("scoreThresholds: gossip must not be positive")
+	case t.PublishThreshold > t.GossipThreshold:
+		return fmt.Errorf("scoreThresholds: publish %g is above gossip %g", t.PublishThreshold, t.GossipThreshold)
+	case t.GraylistThreshold > t.PublishThreshold:
+		return fmt.Errorf("scoreThresholds: graylist %g is above publish %g", t.GraylistThreshold, t.PublishThreshold)
+	case t.AcceptPXThreshold < 0:
+		return fmt.Errorf("scoreThresholds: acceptPX must not be negative")
+	case t.OpportunisticGraftThreshold < 0:
+		return fmt.Errorf("scoreThresholds: opportunisticGraft must not be negative")
+	}
+	return nil
+}
+
+// topics returns the topics to join, the lanes' topics included.
+func (c *Config) topics() []TopicConfig {
+	if len(c.Topics) == 0 && len(c.Lanes) == 0 {
+		return []TopicConfig{{Name: topicName}}
+	}
+	topics := append([]TopicConfig(nil), c.Topics...)
+	for _, l := range c.Lanes {
+		topics = append(topics, l.Topic)
+	}
+	return topics
+}
+
+// laneOf returns the priority class whose lane uses topic, if any.
+func (c *Config) laneOf(topic string) (string, bool) {
+	for _, l := range c.Lanes {
+		if l.Topic.Name == topic {
+			return l.Class, true
+		}
+	}
+	return "", false
+}
+
+func (g GossipSubConfig) params() pubsub.GossipSubParams {
+	p := pubsub.DefaultGossipSubParams()
+	setInt := func(dst *int, v int) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	setInt(&p.D, g.D)
+	setInt(&p.Dlo, g.Dlo)
+	setInt(&p.Dhi, g.Dhi)
+	setInt(&p.Dscore, g.Dscore)
+	setInt(&p.Dout, g.Dout)
+	setInt(&p.Dlazy, g.Dlazy)
+	setInt(&p.HistoryLength, g.HistoryLength)
+	setInt(&p.HistoryGossip, g.HistoryGossip)
+	setInt(&p.PrunePeers, g.PrunePeers)
+	if g.GossipFactor != 0 {
+		p.GossipFactor = g.GossipFactor
+	}
+	if g.HeartbeatInterval != 0 {
+		p.HeartbeatInterval = time.Duration(g.HeartbeatInterval)
+	}
+	if g.FanoutTTL != 0 {
+		p.FanoutTTL = time.Duration(g.FanoutTTL)
+	}
+	if g.PruneBackoff != 0 {
+		p.PruneBackoff = time.Duration(g.PruneBackoff)
+	}
+	if g.GraftFloodThreshold != 0 {
+		p.GraftFloodThreshold = time.Duration(g.GraftFloodThreshold)
+	}
+	return p
+}
+
+func (t *TopicScoreConfig) params() *pubsub.TopicScoreParams {
+	// The router divides by the quantum whenever it scores a mesh peer.
+	quantum := time.Duration(t.TimeInMeshQuantum)
+	if quantum == 0 {
+		quantum = time.Second
+	}
+	return &pubsub.TopicScoreParams{
+		SkipAtomicValidation:            true,
+		TopicWeight:                     t.TopicWeight,
+		TimeInMeshWeight:                t.TimeInMeshWeight,
+		TimeInMeshQuantum:               quantum,
+		TimeInMeshCap:                   t.TimeInMeshCap,
+		FirstMessageDeliveriesWeight:    t.FirstMessageDeliveriesWeight,
+		FirstMessageDeliveriesDecay:     t.FirstMessageDeliveriesDecay,
+		FirstMessageDeliveriesCap:       t.FirstMessageDeliveriesCap,
+		MeshMessageDeliveriesWeight:     t.MeshMessageDeliveriesWeight,
+		MeshMessageDeliveriesDecay:      t.MeshMessageDeliveriesDecay,
+		MeshMessageDeliveriesCap:        t.MeshMessageDeliveriesCap,
+		MeshMessageDeliveriesThreshold:  t.MeshMessageDeliveriesThreshold,
+		MeshMessageDeliveriesWindow:     time.Duration(t.MeshMessageDeliveriesWindow),
+		MeshMessageDeliveriesActivation: time.Duration(t.MeshMessageDeliveriesActivation),
+		MeshFailurePenaltyWeight:        t.MeshFailurePenaltyWeight,
+		MeshFailurePenaltyDecay:         t.MeshFailurePenaltyDecay,
+		InvalidMessageDeliveriesWeight:  t.InvalidMessageDeliveriesWeight,
+		InvalidMessageDeliveriesDecay:   t.InvalidMessageDeliveriesDecay,
+	}
+}
+
+// scored reports whether peer scoring is enabled, which it is as soon as
+// one topic has a score block.
+func (c *Config) scored() bool {
+	for _, t := range c.topics() {
+		if t.Score != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// pubsubOptions turns the config into gossipsub options. Peer scoring is only
+// enabled when at least one topic carries score parameters.
+func pubsubOptions(cfg *Config) []pubsub.Option {
+	opts := []pubsub.Option{pubsub.WithGossipSubParams(cfg.GossipSub.params())}
+	if cfg.GossipSub.FloodPublish != nil {
+		opts = append(opts, pubsub.WithFloodPublish(*cfg.GossipSub.FloodPublish))
+	}
+	if cfg.GossipSub.OutboundQueueSize > 0 {
+		opts = append(opts, pubsub.WithPeerOutboundQueueSize(cfg.GossipSub.OutboundQueueSize))
+	}
+	if cfg.GossipSub.PeerExchange {
+		opts = append(opts, pubsub.WithPeerExchange(true))
+	}
+	if cfg.GossipSub.SeenTTL != 0 {
+		opts = append(opts, pubsub.WithSeenMessagesTTL(time.Duration(cfg.GossipSub.SeenTTL)))
+	}
+	if cfg.GossipSub.SeenStrategy == "last-seen" {
+		opts = append(opts, pubsub.WithSeenMessagesStrategy(timecache.Strategy_LastSeen))
+	}
+	if cfg.Workload.Republish != nil {
+		opts = append(opts, pubsub.WithMessageIdFn(headerMessageID))
+	}
+	opts = append(opts, cfg.Validation.options()...)
+
+	if !cfg.scored() {
+		return opts
+	}
+	// The topics' own parameters are set as each one is joined.
+	return append(opts, pubsub.WithPeerScore(
+		&pubsub.PeerScoreParams{
+			SkipAtomicValidation: true,
+			Topics:               make(map[string]*pubsub.TopicScoreParams),
+			AppSpecificScore:     func(peer.ID) float64 { return 0 },
+			DecayInterval:        time.Second,
+			DecayToZero:          0.01,
+		},
+		cfg.ScoreThresholds.params(),
+	))
+}
@@ -12,6 +12,8 @@ import subprocess
 import random
 import csv
 import argparse
+import json
+import sys
 
 
 class LinuxRouter(Node):
@@ -66,7 +68,7 @@ class GossipSubTopo(Topo):
 
 def get_peer_ids(max_node, binary_path):
     result = subprocess.run(
-        [binary_path, "-generate", "-node", str(max_node)],
+        [binary_path, "keys", "generate", "-max-node", str(max_node)],
         capture_output=True,
         text=True,
     )
@@ -82,9 +84,25 @@ def get_peer_ids(max_node, binary_path):
     return peer_ids
 
 
-def run(binary_path):
+def get_region_delays(binary_path, config_path, nodes):
+    result = subprocess.run(
+        [binary_path, "node", "delays", "-config", config_path, ",".join(map(str, nodes))],
+        capture_output=True,
+        text=True,
+    )
+    if result.returncode != 0:
+        print("Error computing region delays:", result.stderr)
+        return None
+    delays = {}
+    for line in result.stdout.splitlines():
+        src, dst, ms = line.split(",")
+        delays[(int(src), int(dst))] = int(round(float(ms)))
+    return delays
+
+
+def run(binary_path, assert_spec="", config_path="", pcap=False):
     print("[INFO] Cleaning logs...")
-    os.system("rm -f logs/*.log")
+    os.system("rm -f logs/*.log logs/*.json logs/*.pcap")
     os.makedirs("logs", exist_ok=True)
 
     print("[INFO] Loading ping data...")
@@ -100,11 +118,11 @@ def run(binary_path):
                     selected_nodes.append(int(line))
     except Exception as e:
         print("Error reading participants.txt:", e)
-        return
+        return 1
 
     if not selected_nodes:
         print("No nodes selected.")
-        return
+        return 1
 
     print(f"[INFO] Selected nodes: {selected_nodes}")
 
@@ -112,7 +130,7 @@ def run(binary_path):
     peer_ids = get_peer_ids(max(selected_nodes), binary_path)
     if not peer_ids:
         print("Failed to get peer IDs")
-        return
+        return 1
 
     print("[INFO] Building delay matrix...")
     delays = {}
@@ -123,6 +141,15 @@ def run(binary_path):
             elif i != j:
                 delays[(i, j)] = 20
 
+    if config_path:
+        with open(config_path) as f:
+            has_regions = "regions" in json.load(f)
+        if has_regions:
+            print("[INFO] Using region latency matrix from config...")
+            delays = get_region_delays(binary_path, config_path, selected_nodes)
+            if delays is None:
+                return 1
+
     print("[INFO] Shuffling and initializing topology...")
     random.shuffle(selected_nodes)
     topo = GossipSubTopo(selected_nodes)
@@ -194,15 +221,21 @@ def run(binary_path):
         net[f"h{i}"].popen(
             [
                 binary_path,
+                "node",
+                "run",
                 "-port",
                 str(node_port),
                 "-node",
                 str(i),
-                "-minnode",
+                "-lowest-node",
                 str(min_node),
                 "-peers",
                 peers_arg,
-            ],
+                "-report",
+                f"logs/node{i}.json",
+            ]
+            + (["-config", config_path] if config_path else [])
+            + (["-pcap", f"logs/node{i}.pcap"] if pcap else []),
             stdout=log_file,
             stderr=subprocess.STDOUT,
         )
@@ -217,6 +250,12 @@ def run(binary_path):
     for f in log_files.values():
         f.close()
 
+    print("[INFO] Building run report...")
+    analyze = [binary_path, "report", "analyze", "logs"]
+    if assert_spec:
+        analyze += ["-assert", assert_spec]
+    return subprocess.run(analyze).returncode
+
 
 if __name__ == "__main__":
     setLogLevel("info")
@@ -227,5 +266,23 @@ if __name__ == "__main__":
         default="bin/node",
         help="Path to node binary (default: bin/node)",
     )
+    parser.add_argument(
+        "--assert",
+        dest="assert_spec",
+        type=str,
+        default="",
+        help="Fail unless the run meets these limits, e.g. coverage=99.5,p99=800ms",
+    )
+    parser.add_argument(
+        "--config",
+        type=str,
+        default="",
+        help="Experiment config passed to every node; its regions block replaces the ping matrix",
+    )
+    parser.add_argument(
+        "--pcap",
+        action="store_true",
+        help="Capture every node's traffic into logs/node<N>.pcap",
+    )
     args = parser.parse_args()
-    run(args.binary)
+    sys.exit(run(args.binary, args.assert_spec, args.config, args.pcap))
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// TopologyConstraints restrict a cluster's random graph by the nodes'
+// regions, as the experiment config's regions block assigns them. No node
+// links to more than MaxSameRegion peers of its own region, and every region
+// gets at least MinInterRegion links to other regions, even if that takes a
+// node past the degree. Zero disables a constraint.
+type TopologyConstraints struct {
+	MaxSameRegion  int `json:"maxSameRegion"`
+	MinInterRegion int `json:"minInterRegion"`
+}
+
+// topologyFile is a graph as the nodes dial it, written into the log
+// directory of every run with a random topology so that the run can be
+// repeated with TopologyFile.
+type topologyFile struct {
+	Degree int           `json:"degree,omitempty"`
+	Seed   int64         `json:"seed"`
+	Dials  map[int][]int `json:"dials"`
+}
+
+// graph is the graph the nodes dial, nil for a full mesh.
+func (cc *ClusterConfig) graph(addrs map[int]string) (map[int][]int, error) {
+	if cc.TopologyFile != "" {
+		return cc.loadTopology(addrs)
+	}
+	if cc.Degree <= 0 {
+		if cc.Constraints != nil {
+			return nil, fmt.Errorf("topology constraints need a degree")
+		}
+		return nil, nil
+	}
+	if cc.Constraints == nil {
+		return randomGraph(addrs, cc.Degree, cc.Seed), nil
+	}
+	if cc.Constraints.MaxSameRegion < 0 || cc.Constraints.MinInterRegion < 0 {
+		return nil, fmt.Errorf("topology constraints must not be negative")
+	}
+	if cc.Config == "" {
+		return nil, fmt.Errorf("topology constraints need an experiment config with regions")
+	}
+	cfg, err := loadConfig(cc.Config)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Regions == nil {
+		return nil, fmt.Errorf("topology constraints need a regions block in %s", cc.Config)
+	}
+	regions := make(map[int]string)
+	for n := range addrs {
+		region := cfg.labelsFor(n)[cfg.Regions.label()]
+		if region == "" {
+			return nil, fmt.Errorf("node %d has no region", n)
+		}
+		regions[n] = region
+	}
+	g, err := constrainedGraph(regions, cc.Degree, cc.Seed, *cc.Constraints)
+	if err != nil {
+		return nil, err
+	}
+	logTopology(g, regions)
+	return g, nil
+}
+
+// constrainedGraph is randomGraph under constraints: it skips the
+// same-region links beyond MaxSameRegion, then adds links between the
+// least-connected nodes of a region short of MinInterRegion links and of
+// the other regions.
+func constrainedGraph(regions map[int]string, degree int, seed int64, c TopologyConstraints) (map[int][]int, error) {
+	var nodes []int
+	for n := range regions {
+		nodes = append(nodes, n)
+	}
+	sort.Ints(nodes)
+	rng := rand.New(rand.NewSource(seed))
+	links := make(map[int]map[int]bool)
+	for _, n := range nodes {
+		links[n] = make(map[int]bool)
+	}
+	sameRegion := func(n int) int {
+		count := 0
+		for m := range links[n] {
+			if regions[m] == regions[n] {
+				count++
+			}
+		}
+		return count
+	}
+	dials := make(map[int][]int)
+	link := func(n, m int) {
+		links[n][m] = true
+		links[m][n] = true
+		dials[n] = append(dials[n], m)
+	}
+	for _, n := range nodes {
+		for _, i := range rng.Perm(len(nodes)) {
+			if len(links[n]) >= degree {
+				break
+			}
+			m := nodes[i]
+			if m == n || links[n][m] || len(links[m]) >= degree {
+				continue
+			}
+			if c.MaxSameRegion > 0 && regions[m] == regions[n] && (sameRegion(n) >= c.MaxSameRegion || sameRegion(m) >= c.MaxSameRegion) {
+				continue
+			}
+			link(n, m)
+		}
+	}
+
+	if c.MinInterRegion == 0 {
+		return dials, nil
+	}
+	members := make(map[string][]int)
+	for _, n := range nodes {
+		members[regions[n]] = append(members[regions[n]], n)
+	}
+	var names []string
+	for r := range members {
+		names = append(names, r)
+	}
+	sort.Strings(names)
+	if len(names) < 2 {
+		return nil, fmt.Errorf("minInterRegion needs at least two regions, have %d", len(names))
+	}
+	interRegion := func(r string) int {
+		count := 0
+		for _, n := range members[r] {
+			for m := range links[n] {
+				if regions[m] != r {
+					count++
+				}
+			}
+		}
+		return count
+	}
+	for _, r := range names {
+		for interRegion(r) < c.MinInterRegion {
+			var pairs [][2]int
+			for _, n := range members[r] {
+				for _, m := range nodes {
+					if regions[m] != r && !links[n][m] {
+						pairs = append(pairs, [2]int{n, m})
+					}
+				}
+			}
+			if len(pairs) == 0 {
+				return nil, fmt.Errorf("region %s cannot get %d inter-region links", r, c.MinInterRegion)
+			}
+			rng.Shuffle(len(pairs), func(i, j int) { pairs[i], pairs[j] = pairs[j], pairs[i] })
+			sort.SliceStable(pairs, func(i, j int) bool {
+				return len(links[pairs[i][0]])+len(links[pairs[i][1]]) < len(links[pairs[j][0]])+len(links[pairs[j][1]])
+			})
+			link(pairs[0][0], pairs[0][1])
+		}
+	}
+	return dials, nil
+}
+
+// logTopology prints each region's links of a constrained graph.
+func logTopology(graph map[int][]int, regions map[int]string) {
+	same := make(map[string]int)
+	inter := make(map[string]int)
+	for n, peers := range graph {
+		for _, m := range peers {
+			if regions[n] == regions[m] {
+				same[regions[n]]++
+				continue
+			}
+			inter[regions[n]]++
+			inter[regions[m]]++
+		}
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, r := range regions {
+		if !seen[r] {
+			seen[r] = true
+			names = append(names, r)
+		}
+	}
+	sort.Strings(names)
+	for _, r := range names {
+		clusterLog.Infof("Region %s: %d links within, %d to other regions", r, same[r], inter[r])
+	}
+}
+
+// loadTopology reads TopologyFile and takes over its degree and seed, which
+// the run's topology.json then repeats.
+func (cc *ClusterConfig) loadTopology(addrs map[int]string) (map[int][]int, error) {
+	path := cc.TopologyFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tf topologyFile
+	if err := json.Unmarshal(data, &tf); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for n, peers := range tf.Dials {
+		for _, m := range append([]int{n}, peers...) {
+			if _, ok := addrs[m]; !ok {
+				return nil, fmt.Errorf("%s: node %d is not in the cluster", path, m)
+			}
+		}
+	}
+	cc.Degree, cc.Seed = tf.Degree, tf.Seed
+	clusterLog.Infof("Topology loaded from %s", path)
+	return tf.Dials, nil
+}
+
+// writeTopology saves the graph of the run to dir/topology.json.
+func (cc *ClusterConfig) writeTopology(dir string, graph map[int][]int) error {
+	data, err := json.MarshalIndent(topologyFile{Degree: cc.Degree, Seed: cc.Seed, Dials: graph}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "topology.json"), data, 0644)
+}
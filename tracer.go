@@ -0,0 +1,216 @@
+package main
+
+import (
+	"sync"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// tracer feeds gossipsub router events into the metrics registry.
+type tracer struct {
+	h    host.Host
+	self peer.ID
+
+	mu     sync.Mutex
+	rounds map[string]*publishRound
+	// pxCandidates are peers we were told about in PRUNE peer exchange and
+	// were not connected to at the time.
+	pxCandidates map[peer.ID]struct{}
+
+	backoff   *backoffMonitor
+	seen      *seenSet
+	heartbeat *heartbeatMonitor
+	churn     *churner
+	conv      *convergenceMonitor
+	history   *historyStore
+	rec       *recorder
+	outbound  *outboundMonitor
+}
+
+// publishRound tracks the peers our latest own message on a topic was sent
+// to. When not subscribed these are the fanout peers, so the difference
+// between consecutive rounds shows how the fanout set is being maintained.
+type publishRound struct {
+	id    string
+	peers map[peer.ID]struct{}
+	prev  map[peer.ID]struct{}
+}
+
+func newTracer(h host.Host) *tracer {
+	t := &tracer{
+		h:            h,
+		self:         h.ID(),
+		rounds:       make(map[string]*publishRound),
+		pxCandidates: make(map[peer.ID]struct{}),
+	}
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, c network.Conn) {
+			stats.set("connected_peers", float64(len(n.Peers())))
+			stats.inc(metricName("connections_opened_total", "transport", connTransport(c)), 1)
+			t.mu.Lock()
+			if _, ok := t.pxCandidates[c.RemotePeer()]; ok {
+				delete(t.pxCandidates, c.RemotePeer())
+				stats.inc("px_peers_connected_total", 1)
+			}
+			t.mu.Unlock()
+		},
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			stats.set("connected_peers", float64(len(n.Peers())))
+		},
+	})
+	return t
+}
+
+func (t *tracer) AddPeer(p peer.ID, proto protocol.ID) {
+	pubsubLog.Debugf("Added peer %s speaking %s", p, proto)
+	stats.inc(metricName("peers_added_total", "protocol", string(proto)), 1)
+	t.rec.addPeerProtocol(p.String(), string(proto))
+}
+
+func (t *tracer) RemovePeer(p peer.ID) {
+	pubsubLog.Debugf("Removed peer %s", p)
+	stats.inc("peers_removed_total", 1)
+	t.outbound.removed(p)
+}
+
+func (t *tracer) Join(topic string) {}
+
+func (t *tracer) Leave(topic string) {}
+
+func (t *tracer) Graft(p peer.ID, topic string) {
+	pubsubLog.Debugf("Grafted %s on %s", p, topic)
+	stats.inc(metricName("graft_total", "topic", topic), 1)
+	t.churn.grafted(topic)
+	t.conv.graft(p, topic)
+}
+
+func (t *tracer) Prune(p peer.ID, topic string) {
+	pubsubLog.Debugf("Pruned %s from %s", p, topic)
+	stats.inc(metricName("prune_total", "topic", topic), 1)
+	t.conv.prune(p, topic)
+}
+
+func (t *tracer) ValidateMessage(msg *pubsub.Message) {}
+
+func (t *tracer) DeliverMessage(msg *pubsub.Message) {
+	stats.inc(metricName("messages_delivered_total", "topic", msg.GetTopic()), 1)
+	t.history.add(msg)
+	if t.seen != nil {
+		t.seen.add(msg.ID)
+	}
+}
+
+func (t *tracer) RejectMessage(msg *pubsub.Message, reason string) {
+	stats.inc(metricName("messages_rejected_total", "topic", msg.GetTopic(), "reason", reason), 1)
+	if msg.ReceivedFrom != t.self {
+		stats.inc(metricName("messages_rejected_by_peer_total", "peer", msg.ReceivedFrom.String(), "reason", reason), 1)
+		t.rec.addRejected(msg.ReceivedFrom, reason)
+	}
+}
+
+func (t *tracer) DuplicateMessage(msg *pubsub.Message) {
+	stats.inc(metricName("messages_duplicate_total", "topic", msg.GetTopic()), 1)
+}
+
+func (t *tracer) ThrottlePeer(p peer.ID) {
+	stats.inc("peers_throttled_total", 1)
+}
+
+func (t *tracer) RecvRPC(rpc *pubsub.RPC) {
+	stats.inc("rpc_received_bytes_total", float64(rpc.Size()))
+	for _, prune := range rpc.GetControl().GetPrune() {
+		stats.inc(metricName("prune_received_total", "topic", prune.GetTopicID()), 1)
+		for _, pi := range prune.GetPeers() {
+			stats.inc("px_peers_received_total", 1)
+			if len(pi.GetSignedPeerRecord()) > 0 {
+				stats.inc("px_signed_records_total", 1)
+			}
+			p, err := peer.IDFromBytes(pi.GetPeerID())
+			if err != nil || p == t.self || t.h.Network().Connectedness(p) == network.Connected {
+				continue
+			}
+			t.mu.Lock()
+			t.pxCandidates[p] = struct{}{}
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (t *tracer) SendRPC(rpc *pubsub.RPC, p peer.ID) {
+	stats.inc("rpc_sent_bytes_total", float64(rpc.Size()))
+	t.outbound.sent(p)
+	t.heartbeat.sent(rpc)
+	if t.backoff != nil {
+		t.backoff.sentPrunes(p, rpc.GetControl().GetPrune())
+	}
+	for _, m := range rpc.GetPublish() {
+		if peer.ID(m.GetFrom()) != t.self {
+			continue
+		}
+		t.recordSend(m.GetTopic(), pubsub.DefaultMsgIdFn(m), p)
+	}
+}
+
+func (t *tracer) DropRPC(rpc *pubsub.RPC, p peer.ID) {
+	stats.inc("rpc_dropped_total", 1)
+	t.outbound.dropped(p)
+}
+
+func (t *tracer) UndeliverableMessage(msg *pubsub.Message) {
+	stats.inc(metricName("messages_undeliverable_total", "topic", msg.GetTopic()), 1)
+}
+
+func (t *tracer) recordSend(topic, id string, p peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.rounds[topic]
+	if !ok {
+		r = &publishRound{}
+		t.rounds[topic] = r
+	}
+	if r.id != id {
+		if r.prev != nil {
+			changed := 0
+			for q := range r.peers {
+				if _, ok := r.prev[q]; !ok {
+					changed++
+				}
+			}
+			for q := range r.prev {
+				if _, ok := r.peers[q]; !ok {
+					changed++
+				}
+			}
+			stats.inc(metricName("publish_recipient_changes_total", "topic", topic), float64(changed))
+		}
+		r.id = id
+		r.prev = r.peers
+		r.peers = make(map[peer.ID]struct{})
+	}
+	r.peers[p] = struct{}{}
+	stats.set(metricName("publish_recipients", "topic", topic), float64(len(r.peers)))
+	stats.inc(metricName("publish_sends_total", "topic", topic), 1)
+}
+
+// connTransport names the transport a connection runs over by the
+// lowest protocol of its addresses that identifies one.
+func connTransport(c network.Conn) string {
+	for _, a := range []ma.Multiaddr{c.LocalMultiaddr(), c.RemoteMultiaddr()} {
+		if a == nil {
+			continue
+		}
+		for _, p := range a.Protocols() {
+			switch p.Code {
+			case ma.P_UNIX, ma.P_TCP, ma.P_UDP:
+				return p.Name
+			}
+		}
+	}
+	return "other"
+}
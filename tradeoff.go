@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// tradeoffPoint is one run of a D/Dlazy sweep: what it cost in bandwidth
+// and what latency it achieved.
+type tradeoffPoint struct {
+	Run         string          `json:"run"`
+	D           int             `json:"d"`
+	Dlazy       int             `json:"dlazy"`
+	BytesPerMsg float64         `json:"bytesPerMsg"`
+	LatencyMs   float64         `json:"latencyMs"`
+	Delivery    deliverySummary `json:"delivery"`
+	// Frontier marks the runs with deliveries that no other run beats on
+	// both bandwidth and latency.
+	Frontier bool `json:"frontier"`
+	Meets    bool `json:"meetsBudget"`
+}
+
+// tradeoffFit is latency = A * bytesPerMsg^B, fitted by least squares in
+// log-log space over the frontier.
+type tradeoffFit struct {
+	A  float64 `json:"a"`
+	B  float64 `json:"b"`
+	R2 float64 `json:"r2"`
+}
+
+func (f tradeoffFit) latency(bytes float64) float64 {
+	return f.A * math.Pow(bytes, f.B)
+}
+
+type tradeoffReport struct {
+	Metric      string          `json:"metric"`
+	Budget      []string        `json:"budget"`
+	Points      []tradeoffPoint `json:"points"`
+	Fit         *tradeoffFit    `json:"fit,omitempty"`
+	Recommended *tradeoffPoint  `json:"recommended,omitempty"`
+	// PredictedBytesPerMsg is the bandwidth at which the fit reaches the
+	// latency budget.
+	PredictedBytesPerMsg float64 `json:"predictedBytesPerMsg,omitempty"`
+}
+
+// loadTradeoffPoints reads every run directory under sweepDir. D and Dlazy
+// are the effective values recorded in the node reports.
+func loadTradeoffPoints(sweepDir, metric string) ([]tradeoffPoint, error) {
+	entries, err := os.ReadDir(sweepDir)
+	if err != nil {
+		return nil, err
+	}
+	var points []tradeoffPoint
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(sweepDir, e.Name())
+		reports, err := loadNodeReports(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(reports) == 0 {
+			continue
+		}
+		var g GossipSubConfig
+		if reports[0].GossipSub != nil {
+			g = *reports[0].GossipSub
+		}
+		params := g.params()
+		rs := newRunStats(dir, reports)
+		points = append(points, tradeoffPoint{
+			Run:         e.Name(),
+			D:           params.D,
+			Dlazy:       params.Dlazy,
+			BytesPerMsg: rs.bytesPerMsg,
+			LatencyMs:   rs.delivery.latency(metric),
+			Delivery:    rs.delivery,
+		})
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("no runs with node reports found in %s", sweepDir)
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].BytesPerMsg < points[j].BytesPerMsg })
+	best := math.Inf(1)
+	for i := range points {
+		if points[i].Delivery.Delivered > 0 && points[i].LatencyMs < best {
+			points[i].Frontier = true
+			best = points[i].LatencyMs
+		}
+	}
+	return points, nil
+}
+
+// fitTradeoff fits the power law through the frontier, or through all runs
+// if the frontier has fewer than two usable points.
+func fitTradeoff(points []tradeoffPoint) *tradeoffFit {
+	var xs, ys []float64
+	collect := func(frontierOnly bool) {
+		xs, ys = nil, nil
+		for _, p := range points {
+			if (frontierOnly && !p.Frontier) || p.BytesPerMsg <= 0 || p.LatencyMs <= 0 {
+				continue
+			}
+			xs = append(xs, math.Log(p.BytesPerMsg))
+			ys = append(ys, math.Log(p.LatencyMs))
+		}
+	}
+	collect(true)
+	if len(xs) < 2 {
+		collect(false)
+	}
+	if len(xs) < 2 {
+		return nil
+	}
+	n := float64(len(xs))
+	var sx, sy, sxx, sxy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxx += xs[i] * xs[i]
+		sxy += xs[i] * ys[i]
+	}
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return nil
+	}
+	b := (n*sxy - sx*sy) / den
+	lnA := (sy - b*sx) / n
+	var ssRes, ssTot float64
+	for i := range xs {
+		pred := lnA + b*xs[i]
+		ssRes += (ys[i] - pred) * (ys[i] - pred)
+		ssTot += (ys[i] - sy/n) * (ys[i] - sy/n)
+	}
+	fit := &tradeoffFit{A: math.Exp(lnA), B: b, R2: 1}
+	if ssTot > 0 {
+		fit.R2 = 1 - ssRes/ssTot
+	}
+	return fit
+}
+
+// analyzeTradeoff fits and plots the latency vs bandwidth curve of the runs
+// in sweepDir and recommends the cheapest run meeting the budget. The
+// budget's first latency limit picks the latency metric (default p99).
+func analyzeTradeoff(sweepDir string, budget []assertion) error {
+	metric := "p99"
+	var limit float64
+	for _, a := range budget {
+		if a.name != "coverage" {
+			metric, limit = a.name, a.limit
+			break
+		}
+	}
+	points, err := loadTradeoffPoints(sweepDir, metric)
+	if err != nil {
+		return err
+	}
+
+	rep := tradeoffReport{Metric: metric, Points: points, Fit: fitTradeoff(points)}
+	for _, a := range budget {
+		rep.Budget = append(rep.Budget, a.check(deliverySummary{}).Assertion)
+	}
+	for i := range rep.Points {
+		p := &rep.Points[i]
+		p.Meets = len(budget) > 0
+		for _, a := range budget {
+			if !a.check(p.Delivery).Passed {
+				p.Meets = false
+			}
+		}
+		if p.Meets && rep.Recommended == nil {
+			rep.Recommended = p
+		}
+	}
+	if f := rep.Fit; f != nil && limit > 0 && f.B < 0 {
+		rep.PredictedBytesPerMsg = math.Pow(limit/f.A, 1/f.B)
+	}
+
+	fmt.Printf("%-20s %4s %6s %12s %10s %9s\n", "run", "D", "Dlazy", "bytes/msg", metric+" ms", "coverage")
+	for _, p := range rep.Points {
+		var notes []string
+		if p.Frontier {
+			notes = append(notes, "frontier")
+		}
+		if p.Meets {
+			notes = append(notes, "meets budget")
+		}
+		fmt.Printf("%-20s %4d %6d %12.0f %10.1f %8.2f%%  %v\n",
+			p.Run, p.D, p.Dlazy, p.BytesPerMsg, p.LatencyMs, p.Delivery.Coverage*100, notes)
+	}
+	if f := rep.Fit; f != nil {
+		fmt.Printf("Fit: %s = %.4g * bytes^%.3f (R^2=%.3f)\n", metric, f.A, f.B, f.R2)
+		if f.B >= 0 {
+			fmt.Printf("Latency does not fall with bandwidth in this sweep; no tradeoff to exploit\n")
+		}
+	}
+	if rep.PredictedBytesPerMsg > 0 {
+		fmt.Printf("The fit reaches %s=%gms at %.0f bytes/msg\n", metric, limit, rep.PredictedBytesPerMsg)
+	}
+	switch {
+	case rep.Recommended != nil:
+		r := rep.Recommended
+		fmt.Printf("Recommended: d=%d dlazy=%d (run %s, %.0f bytes/msg, %s=%.1fms)\n",
+			r.D, r.Dlazy, r.Run, r.BytesPerMsg, metric, r.LatencyMs)
+	case len(budget) > 0:
+		fmt.Printf("No run meets the budget\n")
+	}
+
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(sweepDir, "tradeoff.json"), data, 0644); err != nil {
+		return err
+	}
+	return writeTradeoffPNG(filepath.Join(sweepDir, "tradeoff.png"), rep, limit)
+}
+
+const (
+	plotWidth  = 480
+	plotHeight = 320
+	plotMargin = 30
+)
+
+// writeTradeoffPNG plots latency (y) against bytes per message (x): frontier
+// runs in green, the others in grey, the fit in blue and the latency limit
+// in red. The axes are labelled with their minimum and maximum.
+func writeTradeoffPNG(path string, rep tradeoffReport, limit float64) error {
+	xMax, yMax := 0.0, limit
+	for _, p := range rep.Points {
+		xMax = math.Max(xMax, p.BytesPerMsg)
+		yMax = math.Max(yMax, p.LatencyMs)
+	}
+	xMax *= 1.1
+	yMax *= 1.1
+	if xMax == 0 || yMax == 0 {
+		xMax, yMax = 1, 1
+	}
+	x0, y0 := plotMargin, plotHeight-plotMargin
+	w, h := plotWidth-2*plotMargin, plotHeight-2*plotMargin
+	px := func(v float64) int { return x0 + int(v/xMax*float64(w)) }
+	py := func(v float64) int { return y0 - int(v/yMax*float64(h)) }
+
+	img := image.NewRGBA(image.Rect(0, 0, plotWidth, plotHeight))
+	fill(img, img.Bounds(), color.RGBA{255, 255, 255, 255})
+	black := color.RGBA{0, 0, 0, 255}
+	fill(img, image.Rect(x0, y0, x0+w, y0+1), black)
+	fill(img, image.Rect(x0, y0-h, x0+1, y0), black)
+	drawNumber(img, x0, y0+4, 0)
+	drawNumber(img, x0+w-20, y0+4, int(xMax))
+	drawNumber(img, 2, y0-h, int(yMax))
+
+	if limit > 0 {
+		fill(img, image.Rect(x0, py(limit), x0+w, py(limit)+1), color.RGBA{220, 0, 0, 255})
+	}
+	if f := rep.Fit; f != nil {
+		blue := color.RGBA{0, 0, 220, 255}
+		for x := 1; x < w; x++ {
+			y := py(f.latency(float64(x) / float64(w) * xMax))
+			if y >= y0-h && y < y0 {
+				img.SetRGBA(x0+x, y, blue)
+			}
+		}
+	}
+	for _, p := range rep.Points {
+		c := color.RGBA{150, 150, 150, 255}
+		if p.Frontier {
+			c = color.RGBA{0, 170, 0, 255}
+		}
+		x, y := px(p.BytesPerMsg), py(p.LatencyMs)
+		fill(img, image.Rect(x-2, y-2, x+3, y+3), c)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, img)
+}
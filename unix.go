@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// unixTransport carries libp2p connections over Unix domain sockets, so
+// nodes on the same machine skip the TCP loopback stack. Connections are
+// secured and multiplexed like TCP ones.
+type unixTransport struct {
+	upgrader transport.Upgrader
+	rcmgr    network.ResourceManager
+}
+
+func newUnixTransport(upgrader transport.Upgrader, rcmgr network.ResourceManager) *unixTransport {
+	return &unixTransport{upgrader: upgrader, rcmgr: rcmgr}
+}
+
+func (t *unixTransport) CanDial(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_UNIX)
+	return err == nil
+}
+
+func (t *unixTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	scope, err := t.rcmgr.OpenConnection(network.DirOutbound, false, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := scope.SetPeer(p); err != nil {
+		scope.Done()
+		return nil, err
+	}
+	var d manet.Dialer
+	c, err := d.DialContext(ctx, raddr)
+	if err != nil {
+		scope.Done()
+		return nil, err
+	}
+	conn, err := t.upgrader.Upgrade(ctx, t, c, network.DirOutbound, p, scope)
+	if err != nil {
+		c.Close()
+		scope.Done()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *unixTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	l, err := manet.Listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+	return t.upgrader.UpgradeListener(t, l), nil
+}
+
+func (t *unixTransport) Protocols() []int {
+	return []int{ma.P_UNIX}
+}
+
+func (t *unixTransport) Proxy() bool {
+	return false
+}
+
+// unixSocketPath is where the node listening on TCP port listens on in dir.
+func unixSocketPath(dir string, port int) (string, error) {
+	abs, err := filepath.Abs(filepath.Join(dir, fmt.Sprintf("%d.sock", port)))
+	if err != nil {
+		return "", err
+	}
+	return abs, nil
+}
+
+// unixListenAddr prepares the node's socket in dir, removing one left over
+// by a previous run.
+func unixListenAddr(dir string, port int) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path, err := unixSocketPath(dir, port)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return "/unix" + path, nil
+}
+
+// preferUnix puts the socket in dir of a peer ahead of its other addresses
+// if the peer runs on this machine, which the socket's existence tells. The
+// TCP addresses stay as a fallback.
+func preferUnix(dir string, info *peer.AddrInfo) {
+	for _, a := range info.Addrs {
+		v, err := a.ValueForProtocol(ma.P_TCP)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		path, err := unixSocketPath(dir, port)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		addr, err := ma.NewMultiaddr("/unix" + path)
+		if err != nil {
+			continue
+		}
+		info.Addrs = append([]ma.Multiaddr{addr}, info.Addrs...)
+		return
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ValidationConfig sizes the router's validation pipeline: Workers
+// goroutines take messages off a queue of QueueSize, and at most Throttle
+// asynchronous validations run at once across all topics. Zero keeps the
+// library defaults.
+type ValidationConfig struct {
+	Throttle  int `json:"throttle"`
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queueSize"`
+}
+
+func (v ValidationConfig) options() []pubsub.Option {
+	var opts []pubsub.Option
+	if v.Throttle > 0 {
+		opts = append(opts, pubsub.WithValidateThrottle(v.Throttle))
+	}
+	if v.Workers > 0 {
+		opts = append(opts, pubsub.WithValidateWorkers(v.Workers))
+	}
+	if v.QueueSize > 0 {
+		opts = append(opts, pubsub.WithValidateQueueSize(v.QueueSize))
+	}
+	return opts
+}
+
+// TopicValidatorConfig registers a validator on the topic that rejects
+// messages without a valid header, spending Cost on each to emulate
+// expensive validation. Inline validators run on the validation workers,
+// async ones in their own goroutine, at most Concurrency at a time for the
+// topic.
+type TopicValidatorConfig struct {
+	Inline      bool     `json:"inline"`
+	Concurrency int      `json:"concurrency"`
+	Timeout     duration `json:"timeout"`
+	Cost        duration `json:"cost"`
+}
+
+func (t *TopicValidatorConfig) options() []pubsub.ValidatorOpt {
+	var opts []pubsub.ValidatorOpt
+	if t.Inline {
+		opts = append(opts, pubsub.WithValidatorInline(true))
+	}
+	if t.Concurrency > 0 {
+		opts = append(opts, pubsub.WithValidatorConcurrency(t.Concurrency))
+	}
+	if t.Timeout > 0 {
+		opts = append(opts, pubsub.WithValidatorTimeout(time.Duration(t.Timeout)))
+	}
+	return opts
+}
+
+// validated reports whether some topic has a validator block. pubsub allows
+// one validator per topic, which the blackhole and tamper misbehaviours and
+// -restore take as well.
+func (c *Config) validated() bool {
+	for _, tc := range c.topics() {
+		if tc.Validator != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// registerValidators installs the configured topic validators, whose cost
+// live can change. The queue depth gauge counts the messages handed to a
+// topic's validator that have not been decided yet; pubsub does not expose
+// its own queue.
+func registerValidators(ps *pubsub.PubSub, topics []TopicConfig, live *liveConfig) error {
+	for _, tc := range topics {
+		vc := tc.Validator
+		if vc == nil {
+			continue
+		}
+		topic := tc.Name
+		var depth atomic.Int64
+		cost := live.validationCost(topic, time.Duration(vc.Cost))
+		validate := func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+			stats.set(metricName("validation_queue_depth", "topic", topic), float64(depth.Add(1)))
+			start := time.Now()
+			defer func() {
+				stats.set(metricName("validation_queue_depth", "topic", topic), float64(depth.Add(-1)))
+				stats.inc(metricName("validation_seconds_total", "topic", topic), time.Since(start).Seconds())
+			}()
+			if d := time.Duration(cost.Load()); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+					stats.inc(metricName("validations_total", "topic", topic, "result", "timeout"), 1)
+					return pubsub.ValidationIgnore
+				}
+			}
+			if _, _, err := decodeMessage(msg.Data); err != nil {
+				stats.inc(metricName("validations_total", "topic", topic, "result", "reject"), 1)
+				return pubsub.ValidationReject
+			}
+			stats.inc(metricName("validations_total", "topic", topic, "result", "accept"), 1)
+			return pubsub.ValidationAccept
+		}
+		if err := ps.RegisterTopicValidator(topic, validate, vc.options()...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
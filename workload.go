@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// WorkloadConfig controls what the publishing nodes send. Publishers defaults
+// to the lowest node only. PublishOnly makes publishers join topics without
+// subscribing, so their messages go out through the gossipsub fanout path
+// instead of the mesh. LaneMix spreads the messages over the priority lanes
+// by weight instead of sending each on every topic. A Profile replaces Count
+// and Interval with a changing publish rate. Size pads the payload to that
+// many bytes, unless a Payload generator is configured. WaitMesh holds the
+// publisher back after StartDelay until its meshes are full, for at most
+// MeshTimeout (default 30s). Timing aligns and jitters the send times. Adaptive
+// replaces the schedule with a rate that follows the receivers' acks.
+type WorkloadConfig struct {
+	Publishers  []int            `json:"publishers"`
+	StartDelay  duration         `json:"startDelay"`
+	Count       int              `json:"count"`
+	Interval    duration         `json:"interval"`
+	PublishOnly bool             `json:"publishOnly"`
+	WaitMesh    bool             `json:"waitMesh"`
+	MeshTimeout duration         `json:"meshTimeout"`
+	Profile     *RampConfig      `json:"profile"`
+	LaneMix     map[string]int   `json:"laneMix"`
+	Republish   *RepublishConfig `json:"republish"`
+	Size        int              `json:"size"`
+	Payload     *PayloadConfig   `json:"payload"`
+	Timing      *TimingConfig    `json:"timing"`
+	Adaptive    *AdaptiveConfig  `json:"adaptive"`
+	// Drain is how long nodes keep running after the last publish
+	// (default 60s).
+	Drain duration `json:"drain"`
+}
+
+// RepublishConfig re-sends the first Count messages (all if zero) unchanged,
+// once After has passed since the last publish. Message IDs are then derived
+// from the message header, so a re-sent message has its original ID and is
+// only delivered again if the ID has left the receivers' seen cache.
+type RepublishConfig struct {
+	After duration `json:"after"`
+	Count int      `json:"count"`
+}
+
+func (w WorkloadConfig) withDefaults() WorkloadConfig {
+	if w.StartDelay == 0 {
+		w.StartDelay = duration(60 * time.Second)
+	}
+	if w.Count == 0 {
+		w.Count = 1
+	}
+	if w.Interval == 0 {
+		w.Interval = duration(time.Second)
+	}
+	if w.Drain == 0 {
+		w.Drain = duration(60 * time.Second)
+	}
+	if w.MeshTimeout == 0 {
+		w.MeshTimeout = duration(30 * time.Second)
+	}
+	return w
+}
+
+func (w WorkloadConfig) publishes(nodeNum int, lowest bool) bool {
+	if len(w.Publishers) == 0 {
+		return lowest
+	}
+	for _, n := range w.Publishers {
+		if n == nodeNum {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule returns when each message is sent, relative to the start.
+func (w WorkloadConfig) schedule() []time.Duration {
+	if w.Adaptive != nil {
+		return nil
+	}
+	if w.Profile != nil {
+		return w.Profile.schedule()
+	}
+	offsets := make([]time.Duration, w.Count)
+	for i := range offsets {
+		offsets[i] = time.Duration(i) * time.Duration(w.Interval)
+	}
+	return offsets
+}
+
+// end is when a non-publishing node shuts down, leaving Drain after the last
+// publish for messages to propagate. With WaitMesh the publishers may start
+// up to MeshTimeout late.
+func (w WorkloadConfig) end(start time.Time) time.Time {
+	last := time.Duration(0)
+	if w.WaitMesh {
+		last += time.Duration(w.MeshTimeout)
+	}
+	if w.Adaptive != nil {
+		last += time.Duration(w.Adaptive.Duration)
+	} else if offsets := w.schedule(); len(offsets) > 0 {
+		last += offsets[len(offsets)-1]
+	}
+	if w.Republish != nil {
+		last += time.Duration(w.Republish.After)
+	}
+	return start.Add(last + w.Timing.slack() + time.Duration(w.Drain))
+}
+
+func (w WorkloadConfig) payloads(nodeNum int) (payloadGenerator, error) {
+	if w.Payload == nil {
+		return (&PayloadConfig{Size: w.Size}).generator(nodeNum)
+	}
+	return w.Payload.generator(nodeNum)
+}
+
+type sentMessage struct {
+	topic *pubsub.Topic
+	seq   uint64
+	data  []byte
+	at    time.Time
+}
+
+// runPublisher sends the workload schedule. The gaps between messages are
+// divided by the live publish rate, and the messages that no longer fit
+// before the last one of the schedule is due are skipped.
+func runPublisher(ctx context.Context, targets func(seq uint64) []*pubsub.Topic, nodeNum int, w WorkloadConfig, start time.Time, live *liveConfig, rec *recorder) {
+	if w.Adaptive != nil {
+		sent := runAdaptivePublisher(ctx, targets, nodeNum, w, start, rec)
+		if w.Republish != nil {
+			republish(ctx, sent, nodeNum, *w.Republish)
+		}
+		return
+	}
+	var sent []sentMessage
+	payloads, err := w.payloads(nodeNum)
+	if err != nil {
+		exit(configError(err))
+	}
+	offsets := w.schedule()
+	times := w.sendTimes(start, nodeNum)
+	var at time.Time
+	for i, planned := range times {
+		rate := live.publishRate()
+		if i == 0 {
+			at = planned
+		} else {
+			at = at.Add(time.Duration(float64(planned.Sub(times[i-1])) / rate))
+		}
+		if at.After(times[len(times)-1]) {
+			stats.inc("messages_skipped_total", float64(len(times)-i))
+			workloadLog.Warnf("Node %d skipping its last %d messages at %.2fx the publish rate", nodeNum, len(times)-i, rate)
+			break
+		}
+		time.Sleep(time.Until(at))
+		if w.Timing != nil {
+			stats.inc("publish_lateness_seconds_total", time.Since(at).Seconds())
+		}
+		if w.Profile != nil {
+			stats.set("workload_target_rate", w.Profile.rate(offsets[i])*rate)
+		}
+		seq := uint64(i + 1)
+		for _, topic := range targets(seq) {
+			m, ok := publishMessage(ctx, topic, nodeNum, seq, payloads, rec)
+			if ok && w.Republish != nil {
+				sent = append(sent, m)
+			}
+		}
+	}
+	if w.Republish != nil {
+		republish(ctx, sent, nodeNum, *w.Republish)
+	}
+}
+
+// publishMessage sends message seq on topic and records it; ok is false if
+// its payload could not be generated or publishing it failed.
+func publishMessage(ctx context.Context, topic *pubsub.Topic, nodeNum int, seq uint64, payloads payloadGenerator, rec *recorder) (m sentMessage, ok bool) {
+	stats.set(metricName("topic_peers", "topic", topic.String()), float64(len(topic.ListPeers())))
+	payload, err := payloads(seq)
+	if err != nil {
+		workloadLog.Warnf("Error generating payload of seq=%d: %v", seq, err)
+		return m, false
+	}
+	now := time.Now()
+	data := encodeMessage(msgHeader{Publisher: nodeNum, Seq: seq, SentAt: now}, payload)
+	if err := publish(ctx, topic, data); err != nil {
+		stats.inc(metricName("messages_publish_failed_total", "topic", topic.String()), 1)
+		workloadLog.Warnf("Error publishing seq=%d on %s: %v", seq, topic, err)
+		return m, false
+	}
+	rec.addPublished(publishRecord{Topic: topic.String(), Seq: seq, SentAt: now.UnixNano(), Size: len(payload)})
+	stats.inc(metricName("messages_published_total", "topic", topic.String()), 1)
+	workloadLog.Infof("Node %d published message to topic %s seq=%d", nodeNum, topic, seq)
+	return sentMessage{topic: topic, seq: seq, data: data, at: now}, true
+}
+
+func republish(ctx context.Context, sent []sentMessage, nodeNum int, r RepublishConfig) {
+	time.Sleep(time.Duration(r.After))
+	for _, m := range sent {
+		if r.Count > 0 && m.seq > uint64(r.Count) {
+			break
+		}
+		if err := publish(ctx, m.topic, m.data); err != nil {
+			workloadLog.Warnf("Error re-sending seq=%d on %s: %v", m.seq, m.topic, err)
+			continue
+		}
+		stats.inc(metricName("messages_republished_total", "topic", m.topic.String()), 1)
+		workloadLog.Infof("Node %d re-sent seq=%d on topic %s", nodeNum, m.seq, m.topic)
+	}
+}